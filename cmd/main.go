@@ -6,9 +6,11 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
 	"github.com/supercakecrumb/otvali-xray-bot/internal/telegram"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/web"
 	"github.com/supercakecrumb/otvali-xray-bot/internal/x3ui"
 	"github.com/supercakecrumb/otvali-xray-bot/pkg/config"
 	"github.com/supercakecrumb/otvali-xray-bot/pkg/logger"
@@ -28,25 +30,49 @@ func main() {
 		return
 	}
 
+	// Make sure the owner is always an admin
+	if cfg.OwnerTelegramID != 0 {
+		if err := db.EnsureOwnerAdmin(cfg.OwnerTelegramID); err != nil {
+			log.Error("Failed to promote owner to admin", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		log.Info("Owner promoted to admin", slog.Int64("telegram_id", cfg.OwnerTelegramID))
+	} else {
+		log.Warn("OWNER_TELEGRAM_ID is not set, admins can only be managed by existing admins")
+	}
+
 	servers, err := db.GetAllServers()
 	if err != nil {
 		log.Error("Error getting servers", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
 	// Initialize server Handler
-	serverHandler := x3ui.NewServerHandler(cfg.SSHKeyPath, servers, log)
+	quotas := x3ui.Quotas{
+		Default:   cfg.QuotaDefaultGB * x3ui.GiB,
+		Exclusive: cfg.QuotaExclusiveGB * x3ui.GiB,
+	}
+	serverHandler := x3ui.NewServerHandler(cfg.SSHKeyPath, servers, quotas, db, log)
 	if serverHandler == nil {
 		log.Error("Failed to init serverHandler")
 		os.Exit(1)
 	}
 
 	// Start the bot
-	bot, err := telegram.NewBot(cfg.TelegramToken, log, db, serverHandler)
+	bot, err := telegram.NewBot(cfg, log, db, serverHandler)
 	if err != nil {
 		log.Error("Failed to initialize bot", slog.String("error", err.Error()))
 		return
 	}
 
+	// Start the subscription server if it has a public address
+	var webServer *web.Server
+	if cfg.PublicBaseURL != "" {
+		webServer = web.NewServer(cfg, log, db, serverHandler)
+		go webServer.Start()
+	} else {
+		log.Warn("PUBLIC_BASE_URL is not set, subscription URLs are disabled")
+	}
+
 	// Create a context that is cancelled on OS interrupt or terminate signal
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
@@ -64,6 +90,13 @@ func main() {
 	// Stop the bot handler
 	bot.Stop()
 
+	// Stop the subscription server
+	if webServer != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		webServer.Shutdown(shutdownCtx)
+		cancel()
+	}
+
 	// Close the ServerHandler to clean up SSH connections
 	serverHandler.Close()
 
@@ -11,6 +11,16 @@ func main() {
 	fmt.Println("LOG_LEVEL:", os.Getenv("LOG_LEVEL"))
 	fmt.Println("DATABASE_URL:", os.Getenv("DATABASE_URL"))
 	fmt.Println("SSH_KEY_PATH:", os.Getenv("SSH_KEY_PATH"))
+	fmt.Println("OWNER_TELEGRAM_ID:", os.Getenv("OWNER_TELEGRAM_ID"))
+	fmt.Println("HTTP_LISTEN_ADDR:", os.Getenv("HTTP_LISTEN_ADDR"))
+	fmt.Println("PUBLIC_BASE_URL:", os.Getenv("PUBLIC_BASE_URL"))
+	fmt.Println("DEVICE_LIMIT:", os.Getenv("DEVICE_LIMIT"))
+	fmt.Println("QUOTA_DEFAULT_GB:", os.Getenv("QUOTA_DEFAULT_GB"))
+	fmt.Println("QUOTA_EXCLUSIVE_GB:", os.Getenv("QUOTA_EXCLUSIVE_GB"))
+	fmt.Println("INVITE_BUDGET_NEW:", os.Getenv("INVITE_BUDGET_NEW"))
+	fmt.Println("INVITE_BUDGET_TRUSTED:", os.Getenv("INVITE_BUDGET_TRUSTED"))
+	fmt.Println("INVITE_BUDGET_EXCLUSIVE:", os.Getenv("INVITE_BUDGET_EXCLUSIVE"))
+	fmt.Println("INVITE_BUDGET_DAYS:", os.Getenv("INVITE_BUDGET_DAYS"))
 
 	if os.Getenv("TELEGRAM_TOKEN") == "" {
 		fmt.Println("WARNING: TELEGRAM_TOKEN is not set")
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// BlockedClient is a panel client the bot disabled because its user was
+// suspended or their access ran out. Only these are turned back on when the
+// user is allowed again; clients an admin disabled by hand stay disabled.
+type BlockedClient struct {
+	ServerID  int64     `gorm:"primaryKey"`
+	Email     string    `gorm:"primaryKey"` // Client email on the panel
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// GetBlockedClients retrieves the emails of the clients the bot disabled on a server
+func (db *DB) GetBlockedClients(serverID int64) (map[string]bool, error) {
+	var emails []string
+	if err := db.Conn.Model(&BlockedClient{}).Where("server_id = ?", serverID).Pluck("email", &emails).Error; err != nil {
+		return nil, err
+	}
+	blocked := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		blocked[email] = true
+	}
+	return blocked, nil
+}
+
+// AddBlockedClient records that the bot disabled a client
+func (db *DB) AddBlockedClient(serverID int64, email string) error {
+	return db.Conn.Clauses(clause.OnConflict{DoNothing: true}).Create(&BlockedClient{ServerID: serverID, Email: email}).Error
+}
+
+// DeleteBlockedClients forgets clients that are running again
+func (db *DB) DeleteBlockedClients(serverID int64, emails []string) error {
+	if len(emails) == 0 {
+		return nil
+	}
+	return db.Conn.Where("server_id = ? AND email IN ?", serverID, emails).Delete(&BlockedClient{}).Error
+}
+
+// DeleteBlockedClientsByServer forgets every blocked client of a removed server
+func (db *DB) DeleteBlockedClientsByServer(serverID int64) error {
+	return db.Conn.Where("server_id = ?", serverID).Delete(&BlockedClient{}).Error
+}
@@ -32,6 +32,42 @@ func NewDB(connectionString string, logger *slog.Logger) (*DB, error) {
 		logger.Error("Failed to migrate database schema", slog.String("error", err.Error()))
 		return nil, err
 	}
+	if err := db.AutoMigrate(&PendingRevocation{}); err != nil {
+		logger.Error("Failed to migrate database schema", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if err := db.AutoMigrate(&IssuedKey{}); err != nil {
+		logger.Error("Failed to migrate database schema", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if err := db.AutoMigrate(&Device{}); err != nil {
+		logger.Error("Failed to migrate database schema", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if err := db.AutoMigrate(&TrafficRecord{}); err != nil {
+		logger.Error("Failed to migrate database schema", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if err := db.AutoMigrate(&TrafficCounter{}); err != nil {
+		logger.Error("Failed to migrate database schema", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if err := db.AutoMigrate(&QuotaNotice{}); err != nil {
+		logger.Error("Failed to migrate database schema", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if err := db.AutoMigrate(&ExpiryNotice{}); err != nil {
+		logger.Error("Failed to migrate database schema", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if err := db.AutoMigrate(&BlockedClient{}); err != nil {
+		logger.Error("Failed to migrate database schema", slog.String("error", err.Error()))
+		return nil, err
+	}
+	if err := db.AutoMigrate(&InviteCode{}); err != nil {
+		logger.Error("Failed to migrate database schema", slog.String("error", err.Error()))
+		return nil, err
+	}
 
 	return &DB{Conn: db}, nil
 }
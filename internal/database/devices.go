@@ -0,0 +1,88 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrDeviceNotFound is returned when no matching active device exists
+var ErrDeviceNotFound = errors.New("device not found")
+
+// ErrDeviceLimitReached is returned when a user already has as many active
+// devices as they may have
+var ErrDeviceLimitReached = errors.New("device limit reached")
+
+// Device is a named device of a user. Every device gets its own client on each
+// server, so it can be revoked without touching the user's other keys.
+type Device struct {
+	ID        int64      `gorm:"primaryKey;autoIncrement"`
+	UserID    int64      `gorm:"not null;index"` // User.ID of the owner
+	Name      string     `gorm:"not null"`
+	CreatedAt time.Time  `gorm:"autoCreateTime"`
+	RevokedAt *time.Time `gorm:"index"`
+}
+
+// AddDevice creates a device for a user if they have fewer than limit active
+// devices. It locks the user's row, so concurrent additions of the same user
+// are counted one after another.
+func (db *DB) AddDevice(device *Device, limit int) error {
+	return db.Conn.Transaction(func(tx *gorm.DB) error {
+		var user User
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "id = ?", device.UserID).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUserNotFound
+			}
+			return err
+		}
+		var count int64
+		if err := tx.Model(&Device{}).Where("user_id = ? AND revoked_at IS NULL", device.UserID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= int64(limit) {
+			return ErrDeviceLimitReached
+		}
+		return tx.Create(device).Error
+	})
+}
+
+// GetDevicesByUser retrieves the user's active devices, oldest first
+func (db *DB) GetDevicesByUser(userID int64) ([]Device, error) {
+	var devices []Device
+	if err := db.Conn.Where("user_id = ? AND revoked_at IS NULL", userID).Order("created_at").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// GetDevice retrieves an active device of a user. Devices of other users are
+// reported as not found.
+func (db *DB) GetDevice(userID, deviceID int64) (*Device, error) {
+	var device Device
+	err := db.Conn.Where("id = ? AND user_id = ? AND revoked_at IS NULL", deviceID, userID).First(&device).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDeviceNotFound
+		}
+		return nil, err
+	}
+	return &device, nil
+}
+
+// RenameDevice changes the name of a device
+func (db *DB) RenameDevice(deviceID int64, name string) error {
+	return db.Conn.Model(&Device{}).Where("id = ?", deviceID).Update("name", name).Error
+}
+
+// RevokeDevice marks a device as revoked
+func (db *DB) RevokeDevice(deviceID int64) error {
+	return db.Conn.Model(&Device{}).Where("id = ? AND revoked_at IS NULL", deviceID).Update("revoked_at", time.Now()).Error
+}
+
+// UpdateUserDeviceLimit sets the user's personal device limit; nil restores the default
+func (db *DB) UpdateUserDeviceLimit(userID int64, limit *int) error {
+	return db.Conn.Model(&User{}).Where("id = ?", userID).Update("device_limit", limit).Error
+}
@@ -0,0 +1,27 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// ExpiryNotice records an access expiry reminder sent to a user, so each one
+// is sent once per access period and number of days left
+type ExpiryNotice struct {
+	ID        int64     `gorm:"primaryKey;autoIncrement"`
+	UserID    int64     `gorm:"not null;uniqueIndex:idx_expiry_notice"`
+	ExpiresAt time.Time `gorm:"not null;uniqueIndex:idx_expiry_notice"` // End of the period the reminder is about; an extension makes new reminders possible
+	DaysLeft  int       `gorm:"not null;uniqueIndex:idx_expiry_notice"` // 0 for the notice that access has ended
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// AddExpiryNotice records a reminder and reports whether it is new, that is
+// whether it still has to be sent
+func (db *DB) AddExpiryNotice(notice *ExpiryNotice) (bool, error) {
+	result := db.Conn.Clauses(clause.OnConflict{DoNothing: true}).Create(notice)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
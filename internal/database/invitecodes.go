@@ -0,0 +1,250 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Errors returned when an invite code cannot be redeemed
+var (
+	ErrInviteNotFound    = errors.New("invite code not found")
+	ErrInviteExpired     = errors.New("invite code expired")
+	ErrInviteUsedUp      = errors.New("invite code used up")
+	ErrInviteWrongUser   = errors.New("invite code is for another user")
+	ErrAlreadyRegistered = errors.New("user already registered")
+)
+
+// ErrInviteBudgetExceeded is returned when an invite does not fit the
+// inviter's budget
+var ErrInviteBudgetExceeded = errors.New("invite budget exceeded")
+
+// InviteBudget limits the invites an inviter may spend since a moment. A nil
+// budget is unlimited.
+type InviteBudget struct {
+	Limit int
+	Since time.Time
+}
+
+// InviteCode is an invitation delivered as a t.me/<bot>?start=<code> link. It
+// works for users without a username too.
+type InviteCode struct {
+	ID                  int64      `gorm:"primaryKey;autoIncrement"`
+	Code                string     `gorm:"unique;not null"`
+	CreatedByTelegramID int64      `gorm:"not null;index"` // Telegram ID of the inviter, copied to User.InvitedByID
+	CreatedByUsername   string     `gorm:""`
+	TargetUsername      string     `gorm:""` // Only this user may redeem the code when set
+	MaxUses             int        `gorm:"not null"`
+	Uses                int        `gorm:"not null;default:0"`
+	ExpiresAt           time.Time  `gorm:"not null"`
+	RevokedAt           *time.Time `gorm:""`
+	CreatedAt           time.Time  `gorm:"autoCreateTime"`
+}
+
+// Usable reports whether the code can still be redeemed by someone
+func (c *InviteCode) Usable() bool {
+	return c.RevokedAt == nil && c.Uses < c.MaxUses && time.Now().Before(c.ExpiresAt)
+}
+
+// newInviteCode returns a random code that fits a Telegram start parameter
+func newInviteCode() (string, error) {
+	buf := make([]byte, 9)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// AddInviteCode generates a code for the invite and stores it if all of its
+// uses fit the inviter's budget
+func (db *DB) AddInviteCode(invite *InviteCode, budget *InviteBudget) error {
+	code, err := newInviteCode()
+	if err != nil {
+		return err
+	}
+	invite.Code = code
+	return db.Conn.Transaction(func(tx *gorm.DB) error {
+		if err := spendInvites(tx, invite.CreatedByTelegramID, invite.MaxUses, budget); err != nil {
+			return err
+		}
+		return tx.Create(invite).Error
+	})
+}
+
+// AddInvitedUser stores a user invited by username if the invite fits the
+// budget of the inviter in user.InvitedByID
+func (db *DB) AddInvitedUser(user *User, budget *InviteBudget) error {
+	if user.InvitedByID == nil {
+		return errors.New("invited user has no inviter")
+	}
+	return db.Conn.Transaction(func(tx *gorm.DB) error {
+		if err := spendInvites(tx, *user.InvitedByID, 1, budget); err != nil {
+			return err
+		}
+		return tx.Create(user).Error
+	})
+}
+
+// spendInvites checks that n more invites fit the inviter's budget. It locks
+// the inviter's row, so concurrent invites of the same inviter are counted
+// one after another.
+func spendInvites(tx *gorm.DB, inviterTelegramID int64, n int, budget *InviteBudget) error {
+	if budget == nil {
+		return nil
+	}
+	var inviter User
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("telegram_id = ?", inviterTelegramID).First(&inviter).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	used, err := countInvitesSince(tx, inviterTelegramID, budget.Since)
+	if err != nil {
+		return err
+	}
+	if used+n > budget.Limit {
+		return ErrInviteBudgetExceeded
+	}
+	return nil
+}
+
+// GetUsableInviteCodes retrieves the codes of an inviter that can still be
+// redeemed, newest first
+func (db *DB) GetUsableInviteCodes(creatorTelegramID int64) ([]InviteCode, error) {
+	var codes []InviteCode
+	err := db.Conn.
+		Where("created_by_telegram_id = ? AND revoked_at IS NULL AND uses < max_uses AND expires_at > ?", creatorTelegramID, time.Now()).
+		Order("created_at DESC").
+		Find(&codes).Error
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RevokeUserInviteCodes revokes every outstanding code of an inviter, when
+// they are suspended or deleted
+func (db *DB) RevokeUserInviteCodes(creatorTelegramID int64) error {
+	return db.Conn.Model(&InviteCode{}).
+		Where("created_by_telegram_id = ? AND revoked_at IS NULL", creatorTelegramID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeInviteCode revokes an inviter's code. Codes of other inviters are
+// reported as not found.
+func (db *DB) RevokeInviteCode(codeID, creatorTelegramID int64) error {
+	result := db.Conn.Model(&InviteCode{}).
+		Where("id = ? AND created_by_telegram_id = ? AND revoked_at IS NULL", codeID, creatorTelegramID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// RedeemInviteCode registers a Telegram user with an invite code and counts
+// the use. username is empty for users without one.
+func (db *DB) RedeemInviteCode(code string, telegramID int64, username string) (*User, *InviteCode, error) {
+	var user *User
+	var invite InviteCode
+	err := db.Conn.Transaction(func(tx *gorm.DB) error {
+		// Lock the code so concurrent redemptions cannot exceed MaxUses
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&invite, "code = ?", code).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInviteNotFound
+			}
+			return err
+		}
+		switch {
+		case invite.RevokedAt != nil:
+			return ErrInviteNotFound
+		case !time.Now().Before(invite.ExpiresAt):
+			return ErrInviteExpired
+		case invite.Uses >= invite.MaxUses:
+			return ErrInviteUsedUp
+		case invite.TargetUsername != "" && !strings.EqualFold(invite.TargetUsername, username):
+			return ErrInviteWrongUser
+		}
+
+		// Codes of inviters who were deleted or suspended no longer let anyone in
+		var creator User
+		err = tx.First(&creator, "telegram_id = ?", invite.CreatedByTelegramID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInviteNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if creator.Suspended() {
+			return ErrInviteNotFound
+		}
+
+		var count int64
+		if err := tx.Model(&User{}).Where("telegram_id = ?", telegramID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrAlreadyRegistered
+		}
+
+		if username == "" {
+			username = PlaceholderUsername(telegramID)
+		}
+		user = &User{
+			TelegramID:        &telegramID,
+			Username:          strings.ToLower(username),
+			InvitedByID:       &invite.CreatedByTelegramID,
+			InvitedByUsername: invite.CreatedByUsername,
+			Invited:           true,
+			InviteCodeID:      &invite.ID,
+		}
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		invite.Uses++
+		return tx.Model(&invite).Update("uses", invite.Uses).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, &invite, nil
+}
+
+// CountInvitesSince counts the invites an inviter spent since a moment: users
+// invited by username, plus every use a still valid invite code may have.
+// Revoked and expired codes only count the uses they actually had.
+func (db *DB) CountInvitesSince(inviterTelegramID int64, since time.Time) (int, error) {
+	return countInvitesSince(db.Conn, inviterTelegramID, since)
+}
+
+// countInvitesSince is CountInvitesSince on a connection or transaction
+func countInvitesSince(conn *gorm.DB, inviterTelegramID int64, since time.Time) (int, error) {
+	var byUsername int64
+	err := conn.Model(&User{}).
+		Where("invited_by_id = ? AND invite_code_id IS NULL AND created_at >= ?", inviterTelegramID, since).
+		Count(&byUsername).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var byCode int64
+	err = conn.Model(&InviteCode{}).
+		Select("COALESCE(SUM(CASE WHEN revoked_at IS NULL AND expires_at > ? THEN max_uses ELSE uses END), 0)", time.Now()).
+		Where("created_by_telegram_id = ? AND created_at >= ?", inviterTelegramID, since).
+		Scan(&byCode).Error
+	if err != nil {
+		return 0, err
+	}
+	return int(byUsername + byCode), nil
+}
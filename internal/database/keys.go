@@ -0,0 +1,114 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrIssuedKeyNotFound is returned when no matching issued key exists
+var ErrIssuedKeyNotFound = errors.New("issued key not found")
+
+// Issued key statuses
+const (
+	KeyStatusActive  = "active"
+	KeyStatusRevoked = "revoked"
+)
+
+// IssuedKey records a client the bot created on a server's inbound
+type IssuedKey struct {
+	ID         int64      `gorm:"primaryKey;autoIncrement"`
+	UserID     int64      `gorm:"not null;index"` // User.ID the key was issued to
+	DeviceID   *int64     `gorm:"index"`          // Device the key was issued for, nil for the user's main key
+	ServerID   int64      `gorm:"not null;index"`
+	InboundID  int        `gorm:"not null"`
+	ClientUUID string     `gorm:"not null"`
+	Email      string     `gorm:"not null;index"` // Client email on the panel
+	SubID      string     `gorm:""`
+	Status     string     `gorm:"not null;default:active;index"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime"`
+	RevokedAt  *time.Time `gorm:""`
+}
+
+// AddIssuedKey records a newly issued key
+func (db *DB) AddIssuedKey(key *IssuedKey) error {
+	return db.Conn.Create(key).Error
+}
+
+// GetActiveIssuedKey retrieves the active key of a user on a server, either the
+// main key (deviceID nil) or the key of one of their devices
+func (db *DB) GetActiveIssuedKey(userID, serverID int64, deviceID *int64) (*IssuedKey, error) {
+	var key IssuedKey
+	query := db.Conn.Where("user_id = ? AND server_id = ? AND status = ?", userID, serverID, KeyStatusActive)
+	if deviceID == nil {
+		query = query.Where("device_id IS NULL")
+	} else {
+		query = query.Where("device_id = ?", *deviceID)
+	}
+	err := query.Order("created_at DESC").First(&key).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrIssuedKeyNotFound
+		}
+		return nil, err
+	}
+	return &key, nil
+}
+
+// GetIssuedKeysByUser retrieves every key issued to a user, newest first
+func (db *DB) GetIssuedKeysByUser(userID int64) ([]IssuedKey, error) {
+	var keys []IssuedKey
+	if err := db.Conn.Where("user_id = ?", userID).Order("created_at DESC").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeIssuedKeys marks the active keys with the given email on a server as revoked
+func (db *DB) RevokeIssuedKeys(serverID int64, email string) error {
+	return db.Conn.Model(&IssuedKey{}).
+		Where("server_id = ? AND email = ? AND status = ?", serverID, email, KeyStatusActive).
+		Updates(map[string]interface{}{"status": KeyStatusRevoked, "revoked_at": time.Now()}).Error
+}
+
+// RevokeIssuedKeysWithPrefix marks the active keys on a server whose email
+// starts with prefix as revoked
+func (db *DB) RevokeIssuedKeysWithPrefix(serverID int64, prefix string) error {
+	return db.Conn.Model(&IssuedKey{}).
+		Where("server_id = ? AND email LIKE ? AND status = ?", serverID, prefix+"%", KeyStatusActive).
+		Updates(map[string]interface{}{"status": KeyStatusRevoked, "revoked_at": time.Now()}).Error
+}
+
+// RevokeIssuedKeysByServer marks every active key on a server as revoked
+func (db *DB) RevokeIssuedKeysByServer(serverID int64) error {
+	return db.Conn.Model(&IssuedKey{}).
+		Where("server_id = ? AND status = ?", serverID, KeyStatusActive).
+		Updates(map[string]interface{}{"status": KeyStatusRevoked, "revoked_at": time.Now()}).Error
+}
+
+// GetActiveIssuedKeysByServer retrieves every active key on a server
+func (db *DB) GetActiveIssuedKeysByServer(serverID int64) ([]IssuedKey, error) {
+	var keys []IssuedKey
+	if err := db.Conn.Where("server_id = ? AND status = ?", serverID, KeyStatusActive).Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// GetUserIDsWithActiveKeys reports which of the users have at least one active key
+func (db *DB) GetUserIDsWithActiveKeys(userIDs []int64) (map[int64]bool, error) {
+	var ids []int64
+	err := db.Conn.Model(&IssuedKey{}).
+		Distinct("user_id").
+		Where("user_id IN ? AND status = ?", userIDs, KeyStatusActive).
+		Pluck("user_id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	withKeys := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		withKeys[id] = true
+	}
+	return withKeys, nil
+}
@@ -6,31 +6,43 @@ import (
 
 // User represents a Telegram user in the database
 type User struct {
-	ID                int64     `gorm:"primaryKey;autoIncrement"`
-	TelegramID        *int64    `gorm:"unique;"`
-	Username          string    `gorm:"unique;not null"`
-	IsAdmin           bool      `gorm:"default:false"`
-	InvitedByID       *int64    `gorm:""`
-	InvitedByUsername string    `gorm:""`
-	Invited           bool      `gorm:""`
-	ExclusiveAccess   bool      `gorm:"default:false"`
-	CreatedAt         time.Time `gorm:"autoCreateTime"`
+	ID                int64      `gorm:"primaryKey;autoIncrement"`
+	TelegramID        *int64     `gorm:"unique;"`
+	Username          string     `gorm:"unique;not null"`
+	IsAdmin           bool       `gorm:"default:false"`
+	InvitedByID       *int64     `gorm:""`
+	InvitedByUsername string     `gorm:""`
+	Invited           bool       `gorm:""`
+	ExclusiveAccess   bool       `gorm:"default:false"`
+	SubscriptionToken *string    `gorm:"unique"`        // Secret part of the subscription URL, generated on first use
+	DeviceLimit       *int       `gorm:""`              // Personal device limit set by an admin, the configured default when nil
+	QuotaTopUp        int64      `gorm:"default:0"`     // Extra monthly traffic in bytes granted by an admin for QuotaTopUpPeriod
+	QuotaTopUpPeriod  string     `gorm:""`              // Month (2006-01) the top-up is for
+	AccessExpiresAt   *time.Time `gorm:"index"`         // End of the access period, unlimited when nil
+	SuspendedAt       *time.Time `gorm:""`              // Set while the user is suspended
+	SuspendedUntil    *time.Time `gorm:""`              // End of a timed suspension, until lifted by hand when nil
+	SuspendReason     string     `gorm:""`              // Reason shown to the user while suspended
+	InviteCodeID      *int64     `gorm:"index"`         // InviteCode the user registered with, nil for invites by username
+	Trusted           bool       `gorm:"default:false"` // Trust level above new users, raises the invite budget
+	InviteBudget      *int       `gorm:""`              // Personal invite budget set by an admin, the trust level's default when nil
+	CreatedAt         time.Time  `gorm:"autoCreateTime"`
 }
 
 // Server represents a VPN server configuration
 type Server struct {
-	ID           int64     `gorm:"primaryKey;autoIncrement"`
-	Name         string    `gorm:"unique;not null"`
-	Country      string    `gorm:"not null"`
-	City         string    `gorm:"not null"`
-	IP           string    `gorm:"not null"`
-	SSHPort      int       `gorm:"not null"`
-	SSHUser      string    `gorm:"not null"`
-	APIPort      int       `gorm:"not null"`
-	Username     string    `gorm:"not null"`
-	Password     string    `gorm:"not null"`
-	RealityCover string    `gorm:"not null"`
-	InboundID    *int      `gorm:""`              // Nullable if outbound ID is not provided
-	IsExclusive  bool      `gorm:"default:false"` // Indicates if the server is exclusive
-	CreatedAt    time.Time `gorm:"autoCreateTime"`
+	ID             int64      `gorm:"primaryKey;autoIncrement"`
+	Name           string     `gorm:"unique;not null"`
+	Country        string     `gorm:"not null"`
+	City           string     `gorm:"not null"`
+	IP             string     `gorm:"not null"`
+	SSHPort        int        `gorm:"not null"`
+	SSHUser        string     `gorm:"not null"`
+	APIPort        int        `gorm:"not null"`
+	Username       string     `gorm:"not null"`
+	Password       string     `gorm:"not null"`
+	RealityCover   string     `gorm:"not null"`
+	InboundID      *int       `gorm:""`              // Nullable if outbound ID is not provided
+	IsExclusive    bool       `gorm:"default:false"` // Indicates if the server is exclusive
+	TrafficResetAt *time.Time `gorm:""`              // Last monthly reset of the clients' traffic counters
+	CreatedAt      time.Time  `gorm:"autoCreateTime"`
 }
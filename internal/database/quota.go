@@ -0,0 +1,45 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// QuotaNotice records a traffic warning sent to a user, so each one is sent
+// once per client, month, limit and level
+type QuotaNotice struct {
+	ID        int64     `gorm:"primaryKey;autoIncrement"`
+	UserID    int64     `gorm:"not null;uniqueIndex:idx_quota_notice"`
+	ServerID  int64     `gorm:"not null;uniqueIndex:idx_quota_notice"`
+	Email     string    `gorm:"not null;uniqueIndex:idx_quota_notice"` // Client email on the panel
+	Period    string    `gorm:"not null;uniqueIndex:idx_quota_notice"` // Month (2006-01)
+	Quota     int64     `gorm:"not null;uniqueIndex:idx_quota_notice"` // Limit in bytes; a top-up makes new warnings possible
+	Level     int       `gorm:"not null;uniqueIndex:idx_quota_notice"` // Percentage of the limit used
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// AddQuotaNotice records a warning and reports whether it is new, that is
+// whether it still has to be sent
+func (db *DB) AddQuotaNotice(notice *QuotaNotice) (bool, error) {
+	result := db.Conn.Clauses(clause.OnConflict{DoNothing: true}).Create(notice)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// AddUserTopUp grants a user extra traffic for a month. Top-ups for the same
+// month add up; a top-up for a new month replaces the old one.
+func (db *DB) AddUserTopUp(userID int64, bytes int64, period string) error {
+	return db.Conn.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"quota_top_up":        gorm.Expr("CASE WHEN quota_top_up_period = ? THEN quota_top_up + ? ELSE ? END", period, bytes, bytes),
+		"quota_top_up_period": period,
+	}).Error
+}
+
+// UpdateServerTrafficReset records when the server's traffic counters were last reset
+func (db *DB) UpdateServerTrafficReset(serverID int64, resetAt time.Time) error {
+	return db.Conn.Model(&Server{}).Where("id = ?", serverID).Update("traffic_reset_at", resetAt).Error
+}
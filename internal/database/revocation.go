@@ -0,0 +1,52 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PendingRevocation is a client removal that could not be done because the
+// server was offline. It is retried once the server is reachable again.
+type PendingRevocation struct {
+	ID         int64     `gorm:"primaryKey;autoIncrement"`
+	ServerID   int64     `gorm:"not null;index"`
+	Email      string    `gorm:"not null"` // Client email on the panel
+	TelegramID *int64    `gorm:""`         // Telegram ID the client was created for
+	Attempts   int       `gorm:"default:0"`
+	LastError  string    `gorm:""`
+	CreatedAt  time.Time `gorm:"autoCreateTime"`
+}
+
+// AddPendingRevocation queues a client removal for later
+func (db *DB) AddPendingRevocation(revocation *PendingRevocation) error {
+	return db.Conn.Create(revocation).Error
+}
+
+// GetPendingRevocations retrieves all queued client removals
+func (db *DB) GetPendingRevocations() ([]PendingRevocation, error) {
+	var revocations []PendingRevocation
+	if err := db.Conn.Order("created_at").Find(&revocations).Error; err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
+
+// UpdatePendingRevocationAttempt records a failed retry of a queued removal
+func (db *DB) UpdatePendingRevocationAttempt(id int64, lastError string) error {
+	return db.Conn.Model(&PendingRevocation{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"attempts":   gorm.Expr("attempts + 1"),
+		"last_error": lastError,
+	}).Error
+}
+
+// DeletePendingRevocation removes a queued client removal once it is done
+func (db *DB) DeletePendingRevocation(id int64) error {
+	return db.Conn.Delete(&PendingRevocation{}, "id = ?", id).Error
+}
+
+// DeletePendingRevocationsByServer drops the queued client removals of a
+// removed server
+func (db *DB) DeletePendingRevocationsByServer(serverID int64) error {
+	return db.Conn.Where("server_id = ?", serverID).Delete(&PendingRevocation{}).Error
+}
@@ -40,7 +40,39 @@ func (db *DB) GetAllServers() ([]Server, error) {
 	return servers, nil
 }
 
+// GetServersForUser retrieves the servers the user is allowed to use
+func (db *DB) GetServersForUser(user *User) ([]Server, error) {
+	servers, err := db.GetAllServers()
+	if err != nil {
+		return nil, err
+	}
+	allowed := servers[:0]
+	for i := range servers {
+		if user.CanUseServer(&servers[i]) {
+			allowed = append(allowed, servers[i])
+		}
+	}
+	return allowed, nil
+}
+
 // UpdateServerExclusivity updates whether a server is exclusive or not
 func (db *DB) UpdateServerExclusivity(serverID int64, isExclusive bool) error {
 	return db.Conn.Model(&Server{}).Where("id = ?", serverID).Update("is_exclusive", isExclusive).Error
 }
+
+// DeleteServerByID removes a server from the database by its ID
+func (db *DB) DeleteServerByID(serverID int64) error {
+	result := db.Conn.Delete(&Server{}, "id = ?", serverID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrServerNotFound
+	}
+	return nil
+}
+
+// UpdateServer saves all fields of an existing server
+func (db *DB) UpdateServer(server *Server) error {
+	return db.Conn.Save(server).Error
+}
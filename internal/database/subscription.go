@@ -0,0 +1,53 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// newSubscriptionToken returns a random URL-safe token
+func newSubscriptionToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// GetUserBySubscriptionToken retrieves a user by their subscription token
+func (db *DB) GetUserBySubscriptionToken(token string) (*User, error) {
+	var user User
+	if err := db.Conn.First(&user, "subscription_token = ?", token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// EnsureSubscriptionToken returns the user's subscription token, generating
+// one if the user has none yet
+func (db *DB) EnsureSubscriptionToken(user *User) (string, error) {
+	if user.SubscriptionToken != nil {
+		return *user.SubscriptionToken, nil
+	}
+	return db.ResetSubscriptionToken(user)
+}
+
+// ResetSubscriptionToken replaces the user's subscription token, invalidating
+// the old subscription URL
+func (db *DB) ResetSubscriptionToken(user *User) (string, error) {
+	token, err := newSubscriptionToken()
+	if err != nil {
+		return "", err
+	}
+	if err := db.Conn.Model(&User{}).Where("id = ?", user.ID).Update("subscription_token", token).Error; err != nil {
+		return "", err
+	}
+	user.SubscriptionToken = &token
+	return token, nil
+}
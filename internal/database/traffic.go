@@ -0,0 +1,113 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TrafficRecord is the traffic of one panel client in one hourly bucket
+type TrafficRecord struct {
+	ID       int64     `gorm:"primaryKey;autoIncrement"`
+	UserID   int64     `gorm:"not null;index"` // User.ID the client belongs to
+	ServerID int64     `gorm:"not null;uniqueIndex:idx_traffic_bucket"`
+	Email    string    `gorm:"not null;uniqueIndex:idx_traffic_bucket"` // Client email, tells the main key and devices apart
+	Bucket   time.Time `gorm:"not null;uniqueIndex:idx_traffic_bucket;index"`
+	Up       int64     `gorm:"not null;default:0"`
+	Down     int64     `gorm:"not null;default:0"`
+}
+
+// TrafficCounter is the last absolute Up/Down value the panel reported for a
+// client. Deltas are computed against it, so they survive bot restarts.
+type TrafficCounter struct {
+	ServerID  int64     `gorm:"primaryKey"`
+	Email     string    `gorm:"primaryKey"`
+	Up        int64     `gorm:"not null"`
+	Down      int64     `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime"`
+}
+
+// GetTrafficCounters retrieves the last counters of every client on a server
+func (db *DB) GetTrafficCounters(serverID int64) ([]TrafficCounter, error) {
+	var counters []TrafficCounter
+	if err := db.Conn.Where("server_id = ?", serverID).Find(&counters).Error; err != nil {
+		return nil, err
+	}
+	return counters, nil
+}
+
+// DeleteTrafficCountersByServer forgets the counters of a removed server. The
+// traffic records are kept for the users' history.
+func (db *DB) DeleteTrafficCountersByServer(serverID int64) error {
+	return db.Conn.Where("server_id = ?", serverID).Delete(&TrafficCounter{}).Error
+}
+
+// SaveTrafficSample adds the records to their buckets and stores the new
+// counters in one transaction, so a sample is never counted twice
+func (db *DB) SaveTrafficSample(records []TrafficRecord, counters []TrafficCounter) error {
+	return db.Conn.Transaction(func(tx *gorm.DB) error {
+		for i := range records {
+			err := tx.Clauses(clause.OnConflict{
+				Columns: []clause.Column{{Name: "server_id"}, {Name: "email"}, {Name: "bucket"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{
+					"up":   gorm.Expr("traffic_records.up + excluded.up"),
+					"down": gorm.Expr("traffic_records.down + excluded.down"),
+				}),
+			}).Create(&records[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+		if len(counters) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "server_id"}, {Name: "email"}},
+			DoUpdates: clause.AssignmentColumns([]string{"up", "down", "updated_at"}),
+		}).Create(&counters).Error
+	})
+}
+
+// TrafficTotal is a user's traffic on one server over a period
+type TrafficTotal struct {
+	ServerID int64
+	Up       int64
+	Down     int64
+}
+
+// GetUserTrafficSince sums the user's recorded traffic per server from since on
+func (db *DB) GetUserTrafficSince(userID int64, since time.Time) ([]TrafficTotal, error) {
+	var totals []TrafficTotal
+	err := db.Conn.Model(&TrafficRecord{}).
+		Select("server_id, SUM(up) AS up, SUM(down) AS down").
+		Where("user_id = ? AND bucket >= ?", userID, since).
+		Group("server_id").
+		Scan(&totals).Error
+	if err != nil {
+		return nil, err
+	}
+	return totals, nil
+}
+
+// GetLastTrafficAt returns the start of the last hourly bucket with traffic
+// for each of the users. Users without recorded traffic are left out.
+func (db *DB) GetLastTrafficAt(userIDs []int64) (map[int64]time.Time, error) {
+	var rows []struct {
+		UserID int64
+		Last   time.Time
+	}
+	err := db.Conn.Model(&TrafficRecord{}).
+		Select("user_id, MAX(bucket) AS last").
+		Where("user_id IN ? AND up + down > 0", userIDs).
+		Group("user_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	last := make(map[int64]time.Time, len(rows))
+	for _, row := range rows {
+		last[row.UserID] = row.Last
+	}
+	return last, nil
+}
@@ -2,8 +2,11 @@ package database
 
 import (
 	"errors"
+	"fmt"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var ErrUserNotFound = errors.New("user not found")
@@ -57,6 +60,29 @@ func (db *DB) GetUserByUsername(username string) (*User, error) {
 	return &user, nil
 }
 
+// GetUsersInvitedBy retrieves the users an inviter invited, oldest first
+func (db *DB) GetUsersInvitedBy(inviterTelegramID int64) ([]User, error) {
+	var users []User
+	if err := db.Conn.Where("invited_by_id = ?", inviterTelegramID).Order("created_at").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// WithdrawInvite deletes a user invited by username who never started the
+// bot. Users of other inviters and users who already started are reported as
+// not found.
+func (db *DB) WithdrawInvite(userID, inviterTelegramID int64) error {
+	result := db.Conn.Where("id = ? AND invited_by_id = ? AND telegram_id IS NULL", userID, inviterTelegramID).Delete(&User{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
 // UpdateUserTelegramID updates the user's TelegramID
 func (db *DB) UpdateUserTelegramID(userID int64, telegramID int64) error {
 	return db.Conn.Model(&User{}).Where("id = ?", userID).Update("telegram_id", telegramID).Error
@@ -72,6 +98,103 @@ func (db *DB) UpdateUserExclusiveAccess(userID int64, exclusiveAccess bool) erro
 	return db.Conn.Model(&User{}).Where("id = ?", userID).Update("exclusive_access", exclusiveAccess).Error
 }
 
+// UpdateUserTrust sets the user's trust level: trusted users get a larger
+// invite budget. grantExclusive also opens the exclusive servers; exclusive
+// access is never taken away here, only by UpdateUserExclusiveAccess.
+func (db *DB) UpdateUserTrust(userID int64, trusted, grantExclusive bool) error {
+	updates := map[string]interface{}{"trusted": trusted}
+	if grantExclusive {
+		updates["exclusive_access"] = true
+	}
+	return db.Conn.Model(&User{}).Where("id = ?", userID).Updates(updates).Error
+}
+
+// UpdateUserInviteBudget sets the user's personal invite budget; nil restores the default
+func (db *DB) UpdateUserInviteBudget(userID int64, budget *int) error {
+	return db.Conn.Model(&User{}).Where("id = ?", userID).Update("invite_budget", budget).Error
+}
+
+// UpdateUserAdmin updates whether the user is an admin
+func (db *DB) UpdateUserAdmin(userID int64, isAdmin bool) error {
+	return db.Conn.Model(&User{}).Where("id = ?", userID).Update("is_admin", isAdmin).Error
+}
+
+// PlaceholderUsername is stored for users whose Telegram username is not known.
+// Telegram usernames cannot contain '#', so it never collides with a real one.
+func PlaceholderUsername(telegramID int64) string {
+	return fmt.Sprintf("#%d", telegramID)
+}
+
+// EnsureOwnerAdmin makes the user with the given Telegram ID an admin, creating
+// a placeholder user if the owner has not used the bot yet. The username is
+// filled in by the middleware on the owner's first message, which merges the
+// placeholder into the owner's invite row if they were invited by username.
+func (db *DB) EnsureOwnerAdmin(telegramID int64) error {
+	user, err := db.GetUserByTelegramID(telegramID)
+	if errors.Is(err, ErrUserNotFound) {
+		return db.AddUser(&User{
+			TelegramID:      &telegramID,
+			Username:        PlaceholderUsername(telegramID),
+			IsAdmin:         true,
+			ExclusiveAccess: true,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if user.IsAdmin {
+		return nil
+	}
+	return db.UpdateUserAdmin(user.ID, true)
+}
+
+// MergePlaceholderUser attaches a placeholder user created by EnsureOwnerAdmin
+// to the row of the same person invited by username before they started the
+// bot. The invite row keeps its invite details and takes over the Telegram ID,
+// admin rights and everything recorded for the placeholder, which is deleted.
+func (db *DB) MergePlaceholderUser(placeholderID int64, username string) (*User, error) {
+	var merged User
+	err := db.Conn.Transaction(func(tx *gorm.DB) error {
+		var placeholder User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&placeholder, "id = ?", placeholderID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUserNotFound
+			}
+			return err
+		}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&merged, "username = ? AND telegram_id IS NULL", username).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUserNotFound
+			}
+			return err
+		}
+
+		for _, model := range []interface{}{&Device{}, &IssuedKey{}, &TrafficRecord{}, &QuotaNotice{}, &ExpiryNotice{}} {
+			if err := tx.Model(model).Where("user_id = ?", placeholder.ID).Update("user_id", merged.ID).Error; err != nil {
+				return err
+			}
+		}
+		// The placeholder goes first, as it holds the unique Telegram ID
+		if err := tx.Delete(&placeholder).Error; err != nil {
+			return err
+		}
+
+		merged.TelegramID = placeholder.TelegramID
+		merged.IsAdmin = merged.IsAdmin || placeholder.IsAdmin
+		merged.ExclusiveAccess = merged.ExclusiveAccess || placeholder.ExclusiveAccess
+		if merged.SubscriptionToken == nil {
+			merged.SubscriptionToken = placeholder.SubscriptionToken
+		}
+		return tx.Save(&merged).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &merged, nil
+}
+
 // GetAdminUsers retrieves all users with IsAdmin set to true
 func (db *DB) GetAdminUsers() ([]User, error) {
 	var admins []User
@@ -90,14 +213,65 @@ func (db *DB) IsUserAdmin(userTelegramID int64) (bool, error) {
 	return user.IsAdmin, nil
 }
 
-// DeleteUserByID removes a user from the database by their ID
-func (db *DB) DeleteUserByID(userID int64) error {
-	result := db.Conn.Delete(&User{}, "id = ?", userID)
-	if result.Error != nil {
-		return result.Error
+// CanUseServer reports whether the user may list and get keys for the server.
+// Exclusive servers are reserved for users with exclusive access and admins,
+// and no server is available while the user is suspended or once their
+// access period is over.
+func (u *User) CanUseServer(server *Server) bool {
+	if u.Suspended() || u.AccessExpired() {
+		return false
 	}
-	if result.RowsAffected == 0 {
-		return ErrUserNotFound
-	}
-	return nil
+	return !server.IsExclusive || u.ExclusiveAccess || u.IsAdmin
+}
+
+// AccessExpired reports whether the user's access period is over
+func (u *User) AccessExpired() bool {
+	return u.AccessExpiresAt != nil && !time.Now().Before(*u.AccessExpiresAt)
+}
+
+// Suspended reports whether the user is suspended. A timed suspension ends on
+// its own, even before the bot clears it.
+func (u *User) Suspended() bool {
+	return u.SuspendedAt != nil && (u.SuspendedUntil == nil || time.Now().Before(*u.SuspendedUntil))
+}
+
+// SuspendUser suspends a user with a reason, until a moment or, when until is
+// nil, until lifted by hand
+func (db *DB) SuspendUser(userID int64, reason string, until *time.Time) error {
+	return db.Conn.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"suspended_at":    time.Now(),
+		"suspended_until": until,
+		"suspend_reason":  reason,
+	}).Error
+}
+
+// UnsuspendUser lifts a user's suspension
+func (db *DB) UnsuspendUser(userID int64) error {
+	return db.Conn.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"suspended_at":    nil,
+		"suspended_until": nil,
+		"suspend_reason":  "",
+	}).Error
+}
+
+// UpdateUserAccessExpiry sets the end of the user's access period; nil makes it unlimited
+func (db *DB) UpdateUserAccessExpiry(userID int64, expiresAt *time.Time) error {
+	return db.Conn.Model(&User{}).Where("id = ?", userID).Update("access_expires_at", expiresAt).Error
+}
+
+// DeleteUserByID removes a user and their devices from the database by the user's ID
+func (db *DB) DeleteUserByID(userID int64) error {
+	return db.Conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&Device{}, "user_id = ?", userID).Error; err != nil {
+			return err
+		}
+		result := tx.Delete(&User{}, "id = ?", userID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+		return nil
+	})
 }
@@ -0,0 +1,97 @@
+package qrcode
+
+import (
+	"bytes"
+	"image/png"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomonRemainder(t *testing.T) {
+	// "HELLO WORLD" as a 1-M symbol, the worked example from the standard
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	got := reedSolomonRemainder(data, reedSolomonDivisor(len(want)))
+	if !bytes.Equal(got, want) {
+		t.Errorf("reedSolomonRemainder() = %v, want %v", got, want)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	tests := []struct {
+		version int
+		level   Level
+		want    int
+	}{
+		{1, Medium, 16},
+		{10, Low, 274},
+		{40, Low, 2956},
+		{40, High, 1276},
+	}
+	for _, tt := range tests {
+		if got := numDataCodewords(tt.version, tt.level); got != tt.want {
+			t.Errorf("numDataCodewords(%d, %d) = %d, want %d", tt.version, tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestAlignmentPositions(t *testing.T) {
+	tests := map[int][]int{
+		1:  nil,
+		2:  {6, 18},
+		7:  {6, 22, 38},
+		32: {6, 34, 60, 86, 112, 138},
+		40: {6, 30, 58, 86, 114, 142, 170},
+	}
+	for version, want := range tests {
+		if got := alignmentPositions(version); !reflect.DeepEqual(got, want) {
+			t.Errorf("alignmentPositions(%d) = %v, want %v", version, got, want)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	link := "vless://11111111-2222-3333-4444-555555555555@fi.example.com:443" +
+		"?flow=xtls-rprx-vision&fp=chrome&pbk=publickey123&security=reality&sid=0a1b&sni=example.com&spx=%2F&type=tcp#tg42"
+
+	c, err := Encode(link, Medium)
+	if err != nil {
+		t.Fatalf("Encode returned error: %v", err)
+	}
+	if c.Size != c.version*4+17 {
+		t.Errorf("Size = %d for version %d", c.Size, c.version)
+	}
+
+	// The three finder patterns have a dark centre and a light ring around it
+	for _, corner := range [][2]int{{3, 3}, {c.Size - 4, 3}, {3, c.Size - 4}} {
+		x, y := corner[0], corner[1]
+		if !c.Dark(x, y) || c.Dark(x+2, y) || !c.Dark(x+3, y) {
+			t.Errorf("no finder pattern at (%d, %d)", x, y)
+		}
+	}
+
+	if _, err := Encode(strings.Repeat("x", 3000), Low); err != ErrTooLong {
+		t.Errorf("Encode of 3000 bytes: err = %v, want ErrTooLong", err)
+	}
+}
+
+func TestPNG(t *testing.T) {
+	c, err := Encode("https://example.com/sub/token", Medium)
+	if err != nil {
+		t.Fatalf("Encode returned error: %v", err)
+	}
+	data, err := c.PNG(4, 4)
+	if err != nil {
+		t.Fatalf("PNG returned error: %v", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("result is not a valid PNG: %v", err)
+	}
+	if side := (c.Size + 8) * 4; img.Bounds().Dx() != side || img.Bounds().Dy() != side {
+		t.Errorf("image is %v, want %dx%d", img.Bounds(), side, side)
+	}
+}
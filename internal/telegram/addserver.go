@@ -0,0 +1,557 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+const (
+	CallbackAddServer          = "addsrv_"
+	CallbackAddServerConfirm   = "addsrv_confirm"
+	CallbackAddServerRetry     = "addsrv_retry"
+	CallbackAddServerCancel    = "addsrv_cancel"
+	CallbackAddServerExclYes   = "addsrv_excl_yes"
+	CallbackAddServerExclNo    = "addsrv_excl_no"
+	CallbackAddServerNoInbound = "addsrv_no_inbound"
+)
+
+// addServerWizardTimeout is how long an unfinished /add_server wizard is kept
+const addServerWizardTimeout = 30 * time.Minute
+
+// addServerWizard holds the state of an /add_server conversation with an admin
+type addServerWizard struct {
+	server    database.Server
+	step      int
+	checked   bool
+	updatedAt time.Time
+}
+
+// addServerStep describes one question of the /add_server wizard
+type addServerStep struct {
+	prompt string
+	// skip reports whether the step does not apply to the values entered so far
+	skip func(server *database.Server) bool
+	// set validates the admin's answer and stores it in the server
+	set func(b *Bot, server *database.Server, value string) error
+	// secret steps have the admin's answer deleted from the chat
+	secret bool
+	// keyboard offers quick answers next to the question
+	keyboard *telego.InlineKeyboardMarkup
+}
+
+var addServerSteps = []addServerStep{
+	{
+		prompt: "Введите имя сервера (латиницей, без пробелов, например fi-1):",
+		set: func(b *Bot, server *database.Server, value string) error {
+			if strings.ContainsAny(value, " \t\n") {
+				return errors.New("Имя не должно содержать пробелов.")
+			}
+			servers, err := b.db.GetAllServers()
+			if err != nil {
+				return fmt.Errorf("Не удалось проверить имя: %v", err)
+			}
+			for _, s := range servers {
+				if strings.EqualFold(s.Name, value) {
+					return fmt.Errorf("Сервер с именем %s уже существует.", value)
+				}
+			}
+			server.Name = value
+			return nil
+		},
+	},
+	{
+		prompt: "Введите страну на английском (например Finland):",
+		set: func(b *Bot, server *database.Server, value string) error {
+			if _, ok := countryNameToISO[strings.ToLower(value)]; !ok {
+				return errors.New("Неизвестная страна. Укажите название на английском, например Netherlands.")
+			}
+			server.Country = value
+			return nil
+		},
+	},
+	{
+		prompt: "Введите город (например Helsinki):",
+		set: func(b *Bot, server *database.Server, value string) error {
+			server.City = value
+			return nil
+		},
+	},
+	{
+		prompt: "Введите публичный IP или домен сервера:",
+		set: func(b *Bot, server *database.Server, value string) error {
+			if strings.ContainsAny(value, " \t\n/:") {
+				return errors.New("Укажите только IP или домен, без порта и схемы.")
+			}
+			server.IP = value
+			return nil
+		},
+	},
+	{
+		prompt: "Введите SSH порт:",
+		set: func(b *Bot, server *database.Server, value string) error {
+			port, err := parsePort(value)
+			if err != nil {
+				return fmt.Errorf("Некорректный порт: %s.", err.Error())
+			}
+			server.SSHPort = port
+			return nil
+		},
+	},
+	{
+		prompt: "Введите имя SSH пользователя:",
+		set: func(b *Bot, server *database.Server, value string) error {
+			server.SSHUser = value
+			return nil
+		},
+	},
+	{
+		prompt: "Введите порт панели 3x-ui на сервере (например 2053):",
+		set: func(b *Bot, server *database.Server, value string) error {
+			port, err := parsePort(value)
+			if err != nil {
+				return fmt.Errorf("Некорректный порт: %s.", err.Error())
+			}
+			server.APIPort = port
+			return nil
+		},
+	},
+	{
+		prompt: "Введите логин панели 3x-ui:",
+		set: func(b *Bot, server *database.Server, value string) error {
+			server.Username = value
+			return nil
+		},
+	},
+	{
+		prompt: "Введите пароль панели 3x-ui (сообщение будет удалено):",
+		secret: true,
+		set: func(b *Bot, server *database.Server, value string) error {
+			server.Password = value
+			return nil
+		},
+	},
+	{
+		prompt: "Введите ID существующего inbound или нажмите кнопку, чтобы бот создал новый:",
+		keyboard: tu.InlineKeyboard(
+			tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton("➕ Создать новый inbound").WithCallbackData(CallbackAddServerNoInbound),
+			),
+		),
+		set: func(b *Bot, server *database.Server, value string) error {
+			if value == "" || value == "-" {
+				server.InboundID = nil
+				return nil
+			}
+			id, err := strconv.Atoi(value)
+			if err != nil || id <= 0 {
+				return errors.New("ID inbound должен быть положительным числом.")
+			}
+			server.InboundID = &id
+			return nil
+		},
+	},
+	{
+		prompt: "Введите домен для маскировки REALITY (например www.microsoft.com):",
+		skip: func(server *database.Server) bool {
+			return server.InboundID != nil
+		},
+		set: func(b *Bot, server *database.Server, value string) error {
+			if strings.ContainsAny(value, " \t\n/:") {
+				return errors.New("Укажите только домен, без порта и схемы.")
+			}
+			server.RealityCover = value
+			return nil
+		},
+	},
+	{
+		prompt: "Сервер эксклюзивный (только для пользователей с эксклюзивным доступом)?",
+		keyboard: tu.InlineKeyboard(
+			tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton("Да").WithCallbackData(CallbackAddServerExclYes),
+				tu.InlineKeyboardButton("Нет").WithCallbackData(CallbackAddServerExclNo),
+			),
+		),
+		set: func(b *Bot, server *database.Server, value string) error {
+			switch strings.ToLower(value) {
+			case "да", "yes", "true":
+				server.IsExclusive = true
+			case "нет", "no", "false":
+				server.IsExclusive = false
+			default:
+				return errors.New("Ответьте «да» или «нет».")
+			}
+			return nil
+		},
+	},
+}
+
+// parsePort parses a TCP port number entered by an admin
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, errors.New("порт должен быть числом от 1 до 65535")
+	}
+	return port, nil
+}
+
+// Handle /add_server command
+func (b *Bot) handleAddServer(bot *telego.Bot, update telego.Update) {
+	if update.Message == nil {
+		b.logger.Error("Error handling add server command", slog.String("error", "update.Message == nil"))
+		return
+	}
+	message := update.Message
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	username := message.From.Username
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, "/add_server", "")
+
+	// Check if user is admin
+	isAdmin, err := b.db.IsUserAdmin(userID)
+	if err != nil || !isAdmin {
+		msg := tu.Message(tu.ID(chatID), "У вас нет прав для выполнения этой команды.")
+		_, _ = bot.SendMessage(msg)
+		b.NotifyAdminsOfError(username, chatID, "/add_server", "Нет прав администратора", "Попытка выполнить команду без прав")
+		return
+	}
+
+	b.wizardsMu.Lock()
+	b.wizards[chatID] = &addServerWizard{updatedAt: time.Now()}
+	b.wizardsMu.Unlock()
+
+	_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Добавление сервера. Чтобы прервать, отправьте /cancel."))
+	b.askAddServerStep(chatID, 0)
+}
+
+// hasAddServerWizard reports whether the update is an answer to an active /add_server wizard
+func (b *Bot) hasAddServerWizard(update telego.Update) bool {
+	if update.Message == nil || update.Message.Text == "" || strings.HasPrefix(update.Message.Text, "/") {
+		return false
+	}
+	_, ok := b.addServerWizard(update.Message.Chat.ID)
+	return ok
+}
+
+// addServerWizard returns the active wizard of a chat, dropping it if it timed out
+func (b *Bot) addServerWizard(chatID int64) (*addServerWizard, bool) {
+	b.wizardsMu.Lock()
+	defer b.wizardsMu.Unlock()
+
+	wizard, ok := b.wizards[chatID]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(wizard.updatedAt) > addServerWizardTimeout {
+		delete(b.wizards, chatID)
+		return nil, false
+	}
+	return wizard, true
+}
+
+// Handle /cancel command
+func (b *Bot) handleCancel(bot *telego.Bot, update telego.Update) {
+	chatID := update.Message.Chat.ID
+
+	b.wizardsMu.Lock()
+	_, ok := b.wizards[chatID]
+	delete(b.wizards, chatID)
+	b.wizardsMu.Unlock()
+
+	text := "Нечего отменять."
+	if ok {
+		text = "Добавление сервера отменено."
+	}
+	_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), text))
+}
+
+// handleAddServerInput processes an admin's text answer to the current wizard step
+func (b *Bot) handleAddServerInput(bot *telego.Bot, update telego.Update) {
+	message := update.Message
+	chatID := message.Chat.ID
+
+	wizard, ok := b.addServerWizard(chatID)
+	if !ok {
+		return
+	}
+
+	if step := b.wizardStep(wizard); step < len(addServerSteps) && addServerSteps[step].secret {
+		err := bot.DeleteMessage(&telego.DeleteMessageParams{
+			ChatID:    tu.ID(chatID),
+			MessageID: message.MessageID,
+		})
+		if err != nil {
+			b.logger.Error("Failed to delete message with password", "error", err)
+		}
+	}
+
+	b.advanceAddServerWizard(chatID, wizard, strings.TrimSpace(message.Text))
+}
+
+// wizardStep returns the current step of a wizard
+func (b *Bot) wizardStep(wizard *addServerWizard) int {
+	b.wizardsMu.Lock()
+	defer b.wizardsMu.Unlock()
+	return wizard.step
+}
+
+// addServerCallbackStep reports whether a wizard button belongs to the step
+// the wizard is at. Buttons of earlier questions stay in the chat and must not
+// answer a later one. The summary buttons belong past the last question.
+func addServerCallbackStep(data string, step int) bool {
+	switch data {
+	case CallbackAddServerCancel:
+		return true
+	case CallbackAddServerRetry, CallbackAddServerConfirm:
+		return step >= len(addServerSteps)
+	}
+	if step >= len(addServerSteps) || addServerSteps[step].keyboard == nil {
+		return false
+	}
+	for _, row := range addServerSteps[step].keyboard.InlineKeyboard {
+		for _, button := range row {
+			if button.CallbackData == data {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// advanceAddServerWizard applies an answer to the current step and asks the next question
+func (b *Bot) advanceAddServerWizard(chatID int64, wizard *addServerWizard, value string) {
+	step := b.wizardStep(wizard)
+	if step >= len(addServerSteps) {
+		_, _ = b.bot.SendMessage(tu.Message(tu.ID(chatID), "Подтвердите или отмените добавление сервера кнопками выше."))
+		return
+	}
+
+	// The answer is applied to a copy, as set may query the database while
+	// other updates of the chat are handled concurrently
+	b.wizardsMu.Lock()
+	server := wizard.server
+	b.wizardsMu.Unlock()
+
+	if err := addServerSteps[step].set(b, &server, value); err != nil {
+		_, _ = b.bot.SendMessage(tu.Message(tu.ID(chatID), err.Error()))
+		b.askAddServerStep(chatID, step)
+		return
+	}
+
+	b.wizardsMu.Lock()
+	if b.wizards[chatID] != wizard || wizard.step != step {
+		// The wizard was cancelled or the step was answered in the meantime
+		b.wizardsMu.Unlock()
+		return
+	}
+	wizard.server = server
+	wizard.updatedAt = time.Now()
+	wizard.step++
+	for wizard.step < len(addServerSteps) && addServerSteps[wizard.step].skip != nil && addServerSteps[wizard.step].skip(&wizard.server) {
+		wizard.step++
+	}
+	step = wizard.step
+	b.wizardsMu.Unlock()
+
+	if step < len(addServerSteps) {
+		b.askAddServerStep(chatID, step)
+		return
+	}
+
+	b.checkAddServerWizard(chatID, wizard)
+}
+
+// askAddServerStep sends the question of a wizard step
+func (b *Bot) askAddServerStep(chatID int64, step int) {
+	msg := tu.Message(tu.ID(chatID), addServerSteps[step].prompt)
+	if addServerSteps[step].keyboard != nil {
+		msg = msg.WithReplyMarkup(addServerSteps[step].keyboard)
+	}
+
+	if _, err := b.bot.SendMessage(msg); err != nil {
+		b.logger.Error("Failed to send add_server wizard question", "error", err)
+	}
+}
+
+// checkAddServerWizard tests SSH and panel login with the collected settings
+// and shows the summary with Confirm/Cancel buttons
+func (b *Bot) checkAddServerWizard(chatID int64, wizard *addServerWizard) {
+	b.wizardsMu.Lock()
+	server := wizard.server
+	b.wizardsMu.Unlock()
+	_, _ = b.bot.SendMessage(tu.Message(tu.ID(chatID), "Проверяю SSH и вход в панель..."))
+
+	checkErr := b.sh.CheckServer(&server)
+
+	b.wizardsMu.Lock()
+	wizard.checked = checkErr == nil
+	wizard.updatedAt = time.Now()
+	b.wizardsMu.Unlock()
+
+	inbound := "будет создан"
+	if server.InboundID != nil {
+		inbound = strconv.Itoa(*server.InboundID)
+	}
+	summary := fmt.Sprintf(
+		"Имя: %s\nЛокация: %s\nIP: %s\nSSH: %s@%s:%d\nПорт панели: %d\nЛогин панели: %s\nПароль панели: ***\nInbound: %s\nREALITY: %s\nЭксклюзивный: %t\n\n",
+		server.Name, serverLabel(&server), server.IP, server.SSHUser, server.IP, server.SSHPort,
+		server.APIPort, server.Username, inbound, server.RealityCover, server.IsExclusive,
+	)
+
+	var keyboard *telego.InlineKeyboardMarkup
+	if checkErr != nil {
+		summary += fmt.Sprintf("🔴 Проверка не прошла: %s", checkErr.Error())
+		keyboard = tu.InlineKeyboard(
+			tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton("🔁 Проверить снова").WithCallbackData(CallbackAddServerRetry),
+				tu.InlineKeyboardButton("❌ Отмена").WithCallbackData(CallbackAddServerCancel),
+			),
+		)
+	} else {
+		summary += "🟢 SSH и вход в панель работают."
+		keyboard = tu.InlineKeyboard(
+			tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton("✅ Сохранить").WithCallbackData(CallbackAddServerConfirm),
+				tu.InlineKeyboardButton("❌ Отмена").WithCallbackData(CallbackAddServerCancel),
+			),
+		)
+	}
+
+	msg := tu.Message(tu.ID(chatID), summary).WithReplyMarkup(keyboard)
+	if _, err := b.bot.SendMessage(msg); err != nil {
+		b.logger.Error("Failed to send add_server summary", "error", err)
+	}
+}
+
+// Handle callback queries from the /add_server wizard
+func (b *Bot) handleAddServerCallback(bot *telego.Bot, update telego.Update) {
+	callbackQuery := update.CallbackQuery
+	data := callbackQuery.Data
+	chatID := callbackQuery.Message.GetChat().ID
+	messageID := callbackQuery.Message.GetMessageID()
+	username := callbackQuery.From.Username
+
+	// Answer the callback query to remove the loading animation
+	err := bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: callbackQuery.ID,
+	})
+	if err != nil {
+		b.logger.Error("Failed to answer callback query", "error", err)
+	}
+
+	wizard, ok := b.addServerWizard(chatID)
+	if !ok {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Мастер добавления сервера не активен. Начните заново: /add_server"))
+		return
+	}
+
+	// Drop the buttons so that the same step cannot be answered twice
+	_, _ = bot.EditMessageReplyMarkup(&telego.EditMessageReplyMarkupParams{
+		ChatID:    tu.ID(chatID),
+		MessageID: messageID,
+	})
+
+	// Buttons left over from an earlier question are ignored
+	if !addServerCallbackStep(data, b.wizardStep(wizard)) {
+		b.logger.Info("Ignoring stale add_server button", slog.String("data", data))
+		return
+	}
+
+	switch data {
+	case CallbackAddServerExclYes:
+		b.advanceAddServerWizard(chatID, wizard, "да")
+	case CallbackAddServerExclNo:
+		b.advanceAddServerWizard(chatID, wizard, "нет")
+	case CallbackAddServerNoInbound:
+		b.advanceAddServerWizard(chatID, wizard, "")
+	case CallbackAddServerRetry:
+		b.checkAddServerWizard(chatID, wizard)
+	case CallbackAddServerCancel:
+		b.wizardsMu.Lock()
+		delete(b.wizards, chatID)
+		b.wizardsMu.Unlock()
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Добавление сервера отменено."))
+	case CallbackAddServerConfirm:
+		// Checked and claimed in one critical section, so a double tap on
+		// Confirm saves the server only once
+		b.wizardsMu.Lock()
+		current := b.wizards[chatID] == wizard
+		checked := current && wizard.checked
+		if checked {
+			delete(b.wizards, chatID)
+		}
+		server := wizard.server
+		b.wizardsMu.Unlock()
+
+		if !current {
+			return
+		}
+		if !checked {
+			b.checkAddServerWizard(chatID, wizard)
+			return
+		}
+
+		isAdmin, err := b.db.IsUserAdmin(callbackQuery.From.ID)
+		if err != nil || !isAdmin {
+			_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "У вас нет прав для выполнения этой команды."))
+			return
+		}
+		b.saveNewServer(username, chatID, &server)
+	}
+}
+
+// saveNewServer stores a verified server, connects to it and creates the
+// primary inbound when none was given
+func (b *Bot) saveNewServer(username string, chatID int64, server *database.Server) {
+	// Save server to database
+	if err := b.db.AddServer(server); err != nil {
+		b.logger.Error("Failed to add server", slog.String("error", err.Error()))
+		msg := tu.Message(tu.ID(chatID), "Не удалось добавить сервер в базу данных.")
+		_, _ = b.bot.SendMessage(msg)
+		b.NotifyAdminsOfError(username, chatID, "/add_server", err.Error(), fmt.Sprintf("Не удалось добавить сервер %s в БД", server.Name))
+		return
+	}
+
+	// Connect to the server and set up the x3ui client
+	_, err := b.sh.AddClient(server)
+	if err != nil {
+		b.logger.Error("Failed to connect to server", slog.String("error", err.Error()))
+		msg := tu.Message(tu.ID(chatID), "Не удалось подключиться к серверу.")
+		_, _ = b.bot.SendMessage(msg)
+		b.NotifyAdminsOfError(username, chatID, "/add_server", err.Error(), fmt.Sprintf("Не удалось подключиться к серверу: %s (%s)", server.Name, server.IP))
+		return
+	}
+
+	// If InboundID is nil, create an inbound
+	if server.InboundID == nil {
+		inbound, err := b.sh.CreateInbound(server)
+		if err != nil {
+			b.logger.Error("Failed to create inbound", slog.String("error", err.Error()))
+			msg := tu.Message(tu.ID(chatID), "Не удалось создать inbound.")
+			_, _ = b.bot.SendMessage(msg)
+			b.NotifyAdminsOfError(username, chatID, "/add_server", err.Error(), fmt.Sprintf("Не удалось создать inbound для сервера: %s", server.Name))
+			return
+		}
+		// Update server with new InboundID
+		server.InboundID = &inbound.ID
+		if err := b.db.UpdateServerInboundID(server.ID, inbound.ID); err != nil {
+			b.logger.Error("Failed to update server inbound ID", slog.String("error", err.Error()))
+		}
+	}
+
+	// Notify admins about successful server addition
+	serverInfo := fmt.Sprintf("%s (%s, %s) - IP: %s, Exclusive: %t", server.Name, server.Country, server.City, server.IP, server.IsExclusive)
+	b.NotifyAdminsOfAction(username, chatID, "/add_server", "Успешно добавлен сервер: "+serverInfo)
+
+	msg := tu.Message(tu.ID(chatID), fmt.Sprintf("Сервер успешно добавлен и настроен (ID: %d).", server.ID))
+	_, _ = b.bot.SendMessage(msg)
+}
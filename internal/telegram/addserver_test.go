@@ -0,0 +1,31 @@
+package telegram
+
+import "testing"
+
+func TestAddServerCallbackStep(t *testing.T) {
+	const inboundStep, coverStep, exclusiveStep = 9, 10, 11
+	done := len(addServerSteps)
+
+	tests := []struct {
+		data string
+		step int
+		want bool
+	}{
+		{CallbackAddServerNoInbound, inboundStep, true},
+		{CallbackAddServerNoInbound, coverStep, false},
+		{CallbackAddServerNoInbound, exclusiveStep, false},
+		{CallbackAddServerExclYes, exclusiveStep, true},
+		{CallbackAddServerExclNo, inboundStep, false},
+		{CallbackAddServerExclNo, done, false},
+		{CallbackAddServerConfirm, exclusiveStep, false},
+		{CallbackAddServerConfirm, done, true},
+		{CallbackAddServerRetry, done, true},
+		{CallbackAddServerCancel, 0, true},
+		{CallbackAddServerCancel, done, true},
+	}
+	for _, tt := range tests {
+		if got := addServerCallbackStep(tt.data, tt.step); got != tt.want {
+			t.Errorf("addServerCallbackStep(%q, %d) = %v, want %v", tt.data, tt.step, got, tt.want)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	th "github.com/mymmrac/telego/telegohandler"
 	tu "github.com/mymmrac/telego/telegoutil"
 	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/x3ui"
 )
 
 func (b *Bot) registerAdminCommands() {
@@ -21,129 +22,30 @@ func (b *Bot) registerAdminCommands() {
 	b.bh.Handle(b.handleSendToAll, th.CommandEqual("send_to_all"))
 	b.bh.Handle(b.handleUsers, th.CommandEqual("users"))
 	b.bh.Handle(b.handleDeleteUser, th.CommandEqual("delete_user"))
-}
-
-func (b *Bot) handleAddServer(bot *telego.Bot, update telego.Update) {
-	if update.Message == nil {
-		b.logger.Error("Error handling add server command", slog.String("error", "update.Message == nil"))
-		return
-	}
-	message := update.Message
-	chatID := message.Chat.ID
-	userID := message.From.ID
-	username := message.From.Username
-
-	// Notify admins about command usage
-	argsStr := strings.Join(strings.Fields(message.Text)[1:], " ")
-	b.NotifyAdminsOfCommand(username, chatID, "/add_server", argsStr)
-
-	// Check if user is admin
-	isAdmin, err := b.db.IsUserAdmin(userID)
-	if err != nil || !isAdmin {
-		msg := tu.Message(tu.ID(chatID), "У вас нет прав для выполнения этой команды.")
-		_, _ = bot.SendMessage(msg)
-		b.NotifyAdminsOfError(username, chatID, "/add_server", "Нет прав администратора", "Попытка выполнить команду без прав")
-		return
-	}
-
-	args := strings.Fields(message.Text)
-	if len(args) < 10 {
-		msg := tu.Message(tu.ID(chatID), "Использование: /add_server <Name> <Country> <City> <IP> <SSHPort> <SSHUser> <APIPort> <Username> <Password> [InboundID] [IsExclusive]")
-		_, _ = bot.SendMessage(msg)
-		b.NotifyAdminsOfError(username, chatID, "/add_server", "Недостаточно аргументов", fmt.Sprintf("Передано аргументов: %d, требуется минимум: 10", len(args)))
-		return
-	}
-
-	// Parse arguments
-	name := args[1]
-	country := args[2]
-	city := args[3]
-	ip := args[4]
-	sshPort, err := strconv.Atoi(args[5])
-	if err != nil {
-		b.logger.Error("Invalid SSHPort", slog.String("error", err.Error()))
-		return
-	}
-	sshUser := args[6]
-	apiPort, err := strconv.Atoi(args[7])
-	if err != nil {
-		b.logger.Error("Invalid APIPort", slog.String("error", err.Error()))
-		return
-	}
-	x3uiUsername := args[8]
-	password := args[9]
-	var inboundID *int
-	if len(args) >= 11 {
-		id, err := strconv.Atoi(args[10])
-		if err != nil {
-			b.logger.Error("Invalid InboundID", slog.String("error", err.Error()))
-			return
-		}
-		inboundID = &id
-	}
-	isExclusive := false
-	if len(args) >= 12 {
-		isExclusiveArg := args[11]
-		isExclusive = (isExclusiveArg == "true")
-	}
-
-	// Create Server object
-	server := &database.Server{
-		Name:        name,
-		Country:     country,
-		City:        city,
-		IP:          ip,
-		SSHPort:     sshPort,
-		SSHUser:     sshUser,
-		APIPort:     apiPort,
-		Username:    x3uiUsername,
-		Password:    password,
-		InboundID:   inboundID,
-		IsExclusive: isExclusive,
-	}
-
-	// Save server to database
-	if err := b.db.AddServer(server); err != nil {
-		b.logger.Error("Failed to add server", slog.String("error", err.Error()))
-		msg := tu.Message(tu.ID(chatID), "Не удалось добавить сервер в базу данных.")
-		_, _ = bot.SendMessage(msg)
-		b.NotifyAdminsOfError(username, chatID, "/add_server", err.Error(), fmt.Sprintf("Не удалось добавить сервер %s в БД", name))
-		return
-	}
-
-	// Connect to the server and set up the x3ui client
-	_, err = b.sh.AddClient(server)
-	if err != nil {
-		b.logger.Error("Failed to connect to server", slog.String("error", err.Error()))
-		msg := tu.Message(tu.ID(chatID), "Не удалось подключиться к серверу.")
-		_, _ = bot.SendMessage(msg)
-		b.NotifyAdminsOfError(username, chatID, "/add_server", err.Error(), fmt.Sprintf("Не удалось подключиться к серверу: %s (%s)", name, ip))
-		return
-	}
-
-	// If InboundID is nil, create an inbound
-	if server.InboundID == nil {
-		inbound, err := b.sh.CreateInbound(server)
-		if err != nil {
-			b.logger.Error("Failed to create inbound", slog.String("error", err.Error()))
-			msg := tu.Message(tu.ID(chatID), "Не удалось создать исходящий прокси.")
-			_, _ = bot.SendMessage(msg)
-			b.NotifyAdminsOfError(username, chatID, "/add_server", err.Error(), fmt.Sprintf("Не удалось создать inbound для сервера: %s", name))
-			return
-		}
-		// Update server with new InboundID
-		server.InboundID = &inbound.ID
-		if err := b.db.UpdateServerInboundID(server.ID, inbound.ID); err != nil {
-			b.logger.Error("Failed to update server inbound ID", slog.String("error", err.Error()))
-		}
-	}
-
-	// Notify admins about successful server addition
-	serverInfo := fmt.Sprintf("%s (%s, %s) - IP: %s, Exclusive: %t", name, country, city, ip, isExclusive)
-	b.NotifyAdminsOfAction(username, chatID, "/add_server", "Успешно добавлен сервер: "+serverInfo)
-
-	msg := tu.Message(tu.ID(chatID), "Сервер успешно добавлен и настроен.")
-	_, _ = bot.SendMessage(msg)
+	b.bh.Handle(b.handleRemoveServer, th.CommandEqual("remove_server"))
+	b.bh.Handle(b.handleEditServer, th.CommandEqual("edit_server"))
+	b.bh.Handle(b.handleGrantExclusive, th.CommandEqual("grant_exclusive"))
+	b.bh.Handle(b.handleRevokeExclusive, th.CommandEqual("revoke_exclusive"))
+	b.bh.Handle(b.handleMakeAdmin, th.CommandEqual("make_admin"))
+	b.bh.Handle(b.handleRemoveAdmin, th.CommandEqual("remove_admin"))
+	b.bh.Handle(b.handleDeviceLimit, th.CommandEqual("device_limit"))
+	b.bh.Handle(b.handleTopUp, th.CommandEqual("topup"))
+	b.bh.Handle(b.handleExtend, th.CommandEqual("extend"))
+	b.bh.Handle(b.handleSuspend, th.CommandEqual("suspend"))
+	b.bh.Handle(b.handleUnsuspend, th.CommandEqual("unsuspend"))
+	b.bh.Handle(b.handleSetTrust, th.CommandEqual("set_trust"))
+	b.bh.Handle(b.handleSetInvites, th.CommandEqual("set_invites"))
+	b.bh.Handle(b.handleInviteTree, th.CommandEqual("invite_tree"))
+	b.bh.Handle(b.handleMigrateClients, th.CommandEqual("migrate_clients"))
+	b.bh.Handle(b.handleReconcile, th.CommandEqual("reconcile"))
+
+	b.bh.Handle(b.handleCancel, th.CommandEqual("cancel"))
+	b.bh.Handle(b.handleAddServerInput, th.AnyMessage(), b.hasAddServerWizard)
+
+	b.bh.Handle(b.handleRemoveServerCallback, th.CallbackDataContains(CallbackRemoveServer))
+	b.bh.Handle(b.handleAddServerCallback, th.CallbackDataContains(CallbackAddServer))
+	b.bh.Handle(b.handleReconcileCallback, th.CallbackDataContains(CallbackReconcile))
+	b.bh.Handle(b.handleInviteTreeCallback, th.CallbackDataPrefix(CallbackInviteTree))
 }
 
 func (b *Bot) handleListServers(bot *telego.Bot, update telego.Update) {
@@ -450,8 +352,16 @@ func (b *Bot) handleUsers(bot *telego.Bot, update telego.Update) {
 
 	msgText := []string{fmt.Sprintf("Количество пользователей: %d", len(users))}
 
+	msk := time.FixedZone("MSK", 3*60*60)
 	for _, user := range users {
-		msgText = append(msgText, fmt.Sprintf("%v: @%v invited by: @%v", user.ID, user.Username, user.InvitedByUsername))
+		line := fmt.Sprintf("%v: @%v invited by: @%v", user.ID, user.Username, user.InvitedByUsername)
+		if user.AccessExpiresAt != nil {
+			line += ", доступ " + formatAccessExpiry(&user, msk)
+		}
+		if user.Suspended() {
+			line += ", ⛔️ приостановлен"
+		}
+		msgText = append(msgText, line)
 	}
 
 	msg := tu.Message(tu.ID(chatID), strings.Join(msgText, "\n"))
@@ -496,26 +406,93 @@ func (b *Bot) handleDeleteUser(bot *telego.Bot, update telego.Update) {
 		return
 	}
 
-	// Delete user from database
-	err = b.db.DeleteUserByID(deleteUserID)
+	target, err := b.db.GetUserByID(deleteUserID)
 	if err != nil {
 		msg := ""
 		if errors.Is(err, database.ErrUserNotFound) {
 			msg = fmt.Sprintf("User with ID %d not found.", deleteUserID)
 			b.NotifyAdminsOfError(username, chatID, "/delete_user", err.Error(), fmt.Sprintf("Пользователь с ID %d не найден", deleteUserID))
 		} else {
-			b.logger.Error("Error deleting user", slog.String("error", err.Error()))
-			msg = fmt.Sprintf("Error while deleting user from the database: %v.", err.Error())
-			b.NotifyAdminsOfError(username, chatID, "/delete_user", err.Error(), fmt.Sprintf("Не удалось удалить пользователя с ID %d", deleteUserID))
+			b.logger.Error("Error fetching user", slog.String("error", err.Error()))
+			msg = fmt.Sprintf("Error while fetching user from the database: %v.", err.Error())
+			b.NotifyAdminsOfError(username, chatID, "/delete_user", err.Error(), fmt.Sprintf("Не удалось получить пользователя с ID %d", deleteUserID))
+		}
+		_, _ = bot.SendMessage(tu.Message(message.Chat.ChatID(), msg))
+		return
+	}
+
+	// The owner can never be removed
+	if b.isOwner(target) {
+		msg := tu.Message(tu.ID(chatID), "The bot owner cannot be deleted.")
+		_, _ = bot.SendMessage(msg)
+		return
+	}
+
+	// Revoke the user's clients on the panels before the row is gone
+	results, err := b.sh.RevokeUserClients(target)
+	if err != nil {
+		b.logger.Error("Error revoking user clients", slog.String("error", err.Error()))
+		msg := fmt.Sprintf("Error while revoking keys, the user was not deleted: %v.", err.Error())
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), msg))
+		b.NotifyAdminsOfError(username, chatID, "/delete_user", err.Error(), fmt.Sprintf("Не удалось отозвать ключи пользователя @%s", target.Username))
+		return
+	}
+	for _, result := range results {
+		if result.Status == x3ui.RevokeFailed {
+			// Keep the row, it is the only record left to retry from
+			msg := fmt.Sprintf("Keys could not be removed or queued on every server, the user was not deleted. Try again later.\n\n%s", formatRevokeReport(results))
+			_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), msg))
+			b.NotifyAdminsOfError(username, chatID, "/delete_user", result.Err.Error(), fmt.Sprintf("Не удалось отозвать ключи пользователя @%s на сервере %s", target.Username, result.Server.Name))
+			return
 		}
+	}
+
+	// Delete user from database
+	err = b.db.DeleteUserByID(deleteUserID)
+	if err != nil {
+		b.logger.Error("Error deleting user", slog.String("error", err.Error()))
+		msg := fmt.Sprintf("Error while deleting user from the database: %v.", err.Error())
+		b.NotifyAdminsOfError(username, chatID, "/delete_user", err.Error(), fmt.Sprintf("Не удалось удалить пользователя с ID %d", deleteUserID))
 		_, _ = bot.SendMessage(tu.Message(message.Chat.ChatID(), msg))
 		return
 	}
 
+	b.revokeInviteCodes(target)
+
 	// Notify admins about user deletion
 	b.NotifyAdminsOfAction(username, chatID, "/delete_user", fmt.Sprintf("Удалён пользователь с ID: %d", deleteUserID))
 
-	// Send success message
-	msg := tu.Message(tu.ID(chatID), fmt.Sprintf("User with ID %d has been successfully deleted.", deleteUserID))
+	// Send success message with the per-server revocation report
+	msg := tu.Message(tu.ID(chatID), fmt.Sprintf("User @%s (ID %d) has been successfully deleted.\n\n%s",
+		target.Username, deleteUserID, formatRevokeReport(results)))
 	_, _ = bot.SendMessage(msg)
 }
+
+// formatRevokeReport renders the outcome of RevokeUserClients, one line per server
+func formatRevokeReport(results []x3ui.RevokeResult) string {
+	if len(results) == 0 {
+		return "No servers to revoke keys on."
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Keys:\n")
+	for _, result := range results {
+		sb.WriteString(fmt.Sprintf("%s: ", serverLabel(&result.Server)))
+		switch result.Status {
+		case x3ui.RevokeDone:
+			sb.WriteString(fmt.Sprintf("revoked (%d)", result.Deleted))
+		case x3ui.RevokeNotFound:
+			sb.WriteString("no keys")
+		case x3ui.RevokeQueued:
+			if result.Err != nil {
+				sb.WriteString(fmt.Sprintf("failed, queued for retry: %v", result.Err))
+			} else {
+				sb.WriteString("server offline, queued for retry")
+			}
+		case x3ui.RevokeFailed:
+			sb.WriteString(fmt.Sprintf("failed: %v", result.Err))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
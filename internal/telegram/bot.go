@@ -1,8 +1,10 @@
 package telegram
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/mymmrac/telego"
@@ -10,6 +12,7 @@ import (
 	tu "github.com/mymmrac/telego/telegoutil"
 	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
 	"github.com/supercakecrumb/otvali-xray-bot/internal/x3ui"
+	"github.com/supercakecrumb/otvali-xray-bot/pkg/config"
 )
 
 type Bot struct {
@@ -18,19 +21,45 @@ type Bot struct {
 	db     *database.DB
 	bh     *th.BotHandler
 	sh     *x3ui.ServerHandler
+	cfg    config.Config
+
+	username string // The bot's own username, for t.me links
+
+	wizards   map[int64]*addServerWizard // Active /add_server wizards by chat ID
+	wizardsMu sync.Mutex
+
+	keyRequests   map[string]bool // Key requests in progress by chat and server ID
+	keyRequestsMu sync.Mutex
+
+	ctx    context.Context // Cancelled by Stop, ends the background jobs
+	cancel context.CancelFunc
 }
 
-func NewBot(token string, logger *slog.Logger, db *database.DB, serverHandler *x3ui.ServerHandler) (*Bot, error) {
-	bot, err := telego.NewBot(token)
+func NewBot(cfg config.Config, logger *slog.Logger, db *database.DB, serverHandler *x3ui.ServerHandler) (*Bot, error) {
+	bot, err := telego.NewBot(cfg.TelegramToken)
+	if err != nil {
+		return nil, err
+	}
+	me, err := bot.GetMe()
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Bot{
 		bot:    bot,
 		logger: logger,
 		db:     db,
 		sh:     serverHandler,
+		cfg:    cfg,
+
+		username: me.Username,
+
+		wizards:     make(map[int64]*addServerWizard),
+		keyRequests: make(map[string]bool),
+
+		ctx:    ctx,
+		cancel: cancel,
 	}, nil
 }
 
@@ -62,6 +91,7 @@ func (b *Bot) Start() {
 		th.PanicRecovery(),
 		b.userUsernameMiddleware(),
 		b.userDatabaseMiddleware(),
+		b.userSuspensionMiddleware(),
 	)
 
 	b.registerCommands()
@@ -70,6 +100,8 @@ func (b *Bot) Start() {
 
 	b.registerMessagingHandlers()
 
+	go b.runJobs()
+
 	b.bh.Start()
 }
 
@@ -79,6 +111,9 @@ func (b *Bot) Stop() {
 	// Notify admins about the shutdown
 	b.NotifyAdmins("⚠️ The bot is stopping. Please check the server for details.")
 
+	// Stop the background jobs
+	b.cancel()
+
 	// Stop the bot handler
 	if b.bh != nil {
 		b.bh.Stop()
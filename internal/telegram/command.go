@@ -1,7 +1,11 @@
 package telegram
 
 import (
+	"errors"
+	"log/slog"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mymmrac/telego"
 	th "github.com/mymmrac/telego/telegohandler"
@@ -16,11 +20,25 @@ func (b *Bot) registerCommands() {
 	b.bh.Handle(b.handleInvite, th.CommandEqual("invite"))
 
 	b.bh.Handle(b.handleGetKey, th.CommandEqual("get_key"))
+	b.bh.Handle(b.handleMyKeys, th.CommandEqual("my_keys"))
+	b.bh.Handle(b.handleSubscription, th.CommandEqual("subscription"))
+	b.bh.Handle(b.handleExportConfig, th.CommandEqual("export_config"))
+	b.bh.Handle(b.handleMyUsage, th.CommandEqual("my_usage"))
+	b.bh.Handle(b.handleDevices, th.CommandEqual("devices"))
+	b.bh.Handle(b.handleAddDevice, th.CommandEqual("add_device"))
+	b.bh.Handle(b.handleRenameDevice, th.CommandEqual("rename_device"))
+	b.bh.Handle(b.handleInviteLink, th.CommandEqual("invite_link"))
+	b.bh.Handle(b.handleMyInviteLinks, th.CommandEqual("my_invite_links"))
+	b.bh.Handle(b.handleMyInvites, th.CommandEqual("my_invites"))
 
 	// Handle callback queries from inline keyboards
 	b.bh.Handle(b.handleHelpCallback, th.CallbackDataContains("help_"))
 
 	b.bh.Handle(b.handleGetKeyCallback, th.CallbackDataContains("getkey_"))
+	b.bh.Handle(b.handleShowQRCallback, th.CallbackDataPrefix(CallbackShowQR))
+	b.bh.Handle(b.handleDeviceCallback, th.CallbackDataPrefix(CallbackDevice))
+	b.bh.Handle(b.handleInviteCodeCallback, th.CallbackDataPrefix(CallbackInviteCode))
+	b.bh.Handle(b.handleWithdrawInviteCallback, th.CallbackDataPrefix(CallbackWithdrawInvite))
 }
 
 // Handle /start command
@@ -29,10 +47,16 @@ func (b *Bot) handleStart(bot *telego.Bot, update telego.Update) {
 	username := update.Message.From.Username
 
 	// Notify admins about command usage
-	b.NotifyAdminsOfCommand(username, chatID, "/start", "")
-
-	welcomeMessage := "Добро пожаловать! Используйте /help, чтобы узнать доступные команды.\n\n" +
-		"💬 Для связи с администратором просто напишите сообщение в этом чате."
+	code := startPayload(update.Message)
+	b.NotifyAdminsOfCommand(username, chatID, "/start", code)
+
+	// Only new users get this far with an invite code, see userDatabaseMiddleware
+	if code != "" {
+		if _, err := b.db.GetUserByTelegramID(update.Message.From.ID); errors.Is(err, database.ErrUserNotFound) {
+			b.redeemInvite(update, code)
+			return
+		}
+	}
 
 	msg := tu.Message(
 		tu.ID(chatID),
@@ -46,6 +70,10 @@ func (b *Bot) handleStart(bot *telego.Bot, update telego.Update) {
 	}
 }
 
+// welcomeMessage greets registered users on /start
+const welcomeMessage = "Добро пожаловать! Используйте /help, чтобы узнать доступные команды.\n\n" +
+	"💬 Для связи с администратором просто напишите сообщение в этом чате."
+
 // Handle /invite command
 func (b *Bot) handleInvite(bot *telego.Bot, update telego.Update) {
 	chatID := update.Message.Chat.ID
@@ -60,10 +88,25 @@ func (b *Bot) handleInvite(bot *telego.Bot, update telego.Update) {
 	}
 	b.NotifyAdminsOfCommand(username, chatID, "/invite", argsStr)
 
+	inviter, err := b.db.GetUserByTelegramID(message.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to fetch user", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Произошла ошибка. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/invite", err.Error(), "Не удалось получить пригласившего")
+		return
+	}
+	allowance, err := b.inviteAllowance(inviter)
+	if err != nil {
+		b.logger.Error("Failed to count invites", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Произошла ошибка. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/invite", err.Error(), "Не удалось посчитать приглашения")
+		return
+	}
+
 	if len(args) < 2 {
 		msg := tu.Message(
 			tu.ID(chatID),
-			"Использование: /invite <username>",
+			"Использование: /invite <username> [дни]\nБез числа дней доступ бессрочный.\n\nПригласить человека без имени пользователя можно ссылкой: /invite_link\n\n"+allowance.describe(0),
 		)
 		_, _ = bot.SendMessage(msg)
 		b.NotifyAdminsOfError(username, chatID, "/invite", "Неверные аргументы", "Пользователь не указал username для приглашения")
@@ -72,8 +115,26 @@ func (b *Bot) handleInvite(bot *telego.Bot, update telego.Update) {
 
 	invitedUsername := strings.TrimPrefix(strings.ToLower(args[1]), "@")
 
+	// An optional number of days limits the access period
+	var expiresAt *time.Time
+	if len(args) > 2 {
+		days, err := strconv.Atoi(args[2])
+		if err != nil || days <= 0 {
+			_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Количество дней должно быть положительным числом."))
+			return
+		}
+		until := time.Now().AddDate(0, 0, days)
+		expiresAt = &until
+	}
+
+	if !allowance.Unlimited && allowance.Left() < 1 {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), allowance.exhaustedText()))
+		b.NotifyAdminsOfAction(username, chatID, "/invite", "Лимит приглашений исчерпан, не приглашён @"+invitedUsername)
+		return
+	}
+
 	// Check if the user already exists
-	_, err := b.db.GetUserByUsername(invitedUsername)
+	_, err = b.db.GetUserByUsername(invitedUsername)
 	if err == nil {
 		msg := tu.Message(
 			tu.ID(chatID),
@@ -88,11 +149,18 @@ func (b *Bot) handleInvite(bot *telego.Bot, update telego.Update) {
 	invitedUser := &database.User{
 		Username:          invitedUsername,
 		InvitedByID:       &chatID,
-		InvitedByUsername: message.From.Username,
+		InvitedByUsername: inviter.Username,
 		Invited:           true,
+		AccessExpiresAt:   expiresAt,
 	}
 
-	if err := b.db.AddUser(invitedUser); err != nil {
+	if err := b.db.AddInvitedUser(invitedUser, b.inviteLimit(inviter)); err != nil {
+		if errors.Is(err, database.ErrInviteBudgetExceeded) {
+			// Another invite took the last place since the check above
+			_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), allowance.exhaustedText()))
+			b.NotifyAdminsOfAction(username, chatID, "/invite", "Лимит приглашений исчерпан, не приглашён @"+invitedUsername)
+			return
+		}
 		b.logger.Error("Failed to invite user", "error", err)
 		msg := tu.Message(
 			tu.ID(chatID),
@@ -106,10 +174,12 @@ func (b *Bot) handleInvite(bot *telego.Bot, update telego.Update) {
 	// Notify admins about successful invitation
 	b.NotifyAdminsOfAction(username, chatID, "/invite", "Успешно пригласил пользователя: @"+invitedUsername)
 
-	msg := tu.Message(
-		tu.ID(chatID),
-		"Пользователь @"+invitedUsername+" приглашён и теперь может получить доступ к базовым серверам.",
-	)
+	text := "Пользователь @" + invitedUsername + " приглашён и теперь может получить доступ к базовым серверам."
+	if expiresAt != nil {
+		text += "\nДоступ действует до " + expiresAt.In(time.FixedZone("MSK", 3*60*60)).Format("02.01.2006 15:04") + " МСК."
+	}
+	text += "\n\n" + allowance.describe(1)
+	msg := tu.Message(tu.ID(chatID), text)
 	_, err = bot.SendMessage(msg)
 	if err != nil {
 		b.logger.Error("Failed to send invite message", "error", err)
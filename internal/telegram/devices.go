@@ -0,0 +1,449 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/x3ui"
+)
+
+// Device menu callbacks. Data has the form dev_<action>_<deviceID>, and
+// dev_key_<deviceID>_<serverID> for key requests.
+const (
+	CallbackDevice              = "dev_"
+	CallbackDeviceList          = "dev_list"
+	CallbackDeviceAdd           = "dev_add"
+	CallbackDeviceOpen          = "dev_open_"
+	CallbackDeviceKey           = "dev_key_"
+	CallbackDeviceRevoke        = "dev_revoke_"
+	CallbackDeviceRevokeConfirm = "dev_revokeok_"
+)
+
+// deviceNameMaxLength keeps device names short enough for a button
+const deviceNameMaxLength = 32
+
+// deviceLimit returns how many devices the user may have
+func (b *Bot) deviceLimit(user *database.User) int {
+	if user.DeviceLimit != nil {
+		return *user.DeviceLimit
+	}
+	return b.cfg.DeviceLimit
+}
+
+// parseDeviceName validates a device name typed by a user
+func parseDeviceName(name string) (string, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return "", errors.New("Укажите название устройства, например: телефон.")
+	}
+	if utf8.RuneCountInString(name) > deviceNameMaxLength {
+		return "", fmt.Errorf("Название слишком длинное, максимум %d символа.", deviceNameMaxLength)
+	}
+	return name, nil
+}
+
+// devicesMenu builds the /devices message
+func (b *Bot) devicesMenu(user *database.User) (string, *telego.InlineKeyboardMarkup, error) {
+	devices, err := b.db.GetDevicesByUser(user.ID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	limit := b.deviceLimit(user)
+	var sb strings.Builder
+	if len(devices) == 0 {
+		sb.WriteString("У вас пока нет устройств.\n\n")
+	} else {
+		sb.WriteString(fmt.Sprintf("Ваши устройства (%d из %d):\n\n", len(devices), limit))
+	}
+	sb.WriteString("У каждого устройства свой ключ: если телефон потеряется, достаточно отозвать только его.\n\n" +
+		"Добавить устройство: /add_device <название>\n" +
+		"Переименовать: /rename_device <номер> <название>")
+
+	var rows [][]telego.InlineKeyboardButton
+	for _, device := range devices {
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("📱 %d. %s", device.ID, device.Name)).
+				WithCallbackData(fmt.Sprintf("%s%d", CallbackDeviceOpen, device.ID)),
+		))
+	}
+	if len(devices) < limit {
+		rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton("➕ Добавить устройство").WithCallbackData(CallbackDeviceAdd)))
+	}
+	rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton("🏠 Домой").WithCallbackData(CallbackHelpBack)))
+
+	return sb.String(), tu.InlineKeyboard(rows...), nil
+}
+
+// deviceMenu builds the message of a single device with a key button per server
+func (b *Bot) deviceMenu(user *database.User, device *database.Device) (string, *telego.InlineKeyboardMarkup, error) {
+	servers, err := b.db.GetServersForUser(user)
+	if err != nil {
+		return "", nil, err
+	}
+
+	msk := time.FixedZone("MSK", 3*60*60)
+	text := fmt.Sprintf("📱 Устройство «%s» (№%d)\nДобавлено: %s\n\nВыберите сервер, чтобы получить ключ для этого устройства.",
+		device.Name, device.ID, device.CreatedAt.In(msk).Format("02.01.2006"))
+
+	var rows [][]telego.InlineKeyboardButton
+	for _, server := range servers {
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(serverLabel(&server)).
+				WithCallbackData(fmt.Sprintf("%s%d_%d", CallbackDeviceKey, device.ID, server.ID)),
+		))
+	}
+	rows = append(rows,
+		tu.InlineKeyboardRow(tu.InlineKeyboardButton("🗑 Отозвать устройство").WithCallbackData(fmt.Sprintf("%s%d", CallbackDeviceRevoke, device.ID))),
+		tu.InlineKeyboardRow(tu.InlineKeyboardButton("⬅️ К устройствам").WithCallbackData(CallbackDeviceList)),
+	)
+	return text, tu.InlineKeyboard(rows...), nil
+}
+
+// deviceKeyKeyboard is the keyboard of a device key message
+func deviceKeyKeyboard(serverID, deviceID int64) *telego.InlineKeyboardMarkup {
+	return tu.InlineKeyboard(
+		tu.InlineKeyboardRow(showDeviceQRButton(serverID, deviceID)),
+		tu.InlineKeyboardRow(tu.InlineKeyboardButton("⬅️ К устройству").WithCallbackData(fmt.Sprintf("%s%d", CallbackDeviceOpen, deviceID))),
+		tu.InlineKeyboardRow(tu.InlineKeyboardButton("🏠 Домой").WithCallbackData(CallbackHelpBack)),
+	)
+}
+
+// Handle /devices command
+func (b *Bot) handleDevices(bot *telego.Bot, update telego.Update) {
+	chatID := update.Message.Chat.ID
+	username := update.Message.From.Username
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, "/devices", "")
+
+	user, err := b.db.GetUserByTelegramID(update.Message.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to fetch user", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Произошла ошибка. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/devices", err.Error(), "Не удалось получить пользователя")
+		return
+	}
+
+	text, keyboard, err := b.devicesMenu(user)
+	if err != nil {
+		b.logger.Error("Failed to build devices menu", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось получить список устройств. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/devices", err.Error(), "Не удалось получить устройства")
+		return
+	}
+
+	if _, err := bot.SendMessage(tu.Message(tu.ID(chatID), text).WithReplyMarkup(keyboard)); err != nil {
+		b.logger.Error("Failed to send devices message", "error", err)
+	}
+}
+
+// Handle /add_device command
+func (b *Bot) handleAddDevice(bot *telego.Bot, update telego.Update) {
+	chatID := update.Message.Chat.ID
+	username := update.Message.From.Username
+	_, argsStr, _ := strings.Cut(update.Message.Text, " ")
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, "/add_device", argsStr)
+
+	name, err := parseDeviceName(argsStr)
+	if err != nil {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), err.Error()+"\n\nИспользование: /add_device <название>"))
+		return
+	}
+
+	user, err := b.db.GetUserByTelegramID(update.Message.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to fetch user", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Произошла ошибка. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/add_device", err.Error(), "Не удалось получить пользователя")
+		return
+	}
+
+	device := &database.Device{UserID: user.ID, Name: name}
+	limit := b.deviceLimit(user)
+	if err := b.db.AddDevice(device, limit); err != nil {
+		if errors.Is(err, database.ErrDeviceLimitReached) {
+			count := limit
+			if devices, err := b.db.GetDevicesByUser(user.ID); err == nil {
+				count = len(devices)
+			}
+			_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), fmt.Sprintf(
+				"У вас уже %d из %d устройств. Отзовите ненужное в /devices или попросите администратора увеличить лимит.", count, limit)))
+			return
+		}
+		b.logger.Error("Failed to add device", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось добавить устройство. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/add_device", err.Error(), "Не удалось сохранить устройство")
+		return
+	}
+
+	b.NotifyAdminsOfAction(username, chatID, "/add_device", fmt.Sprintf("Добавлено устройство «%s» (№%d)", device.Name, device.ID))
+
+	text, keyboard, err := b.deviceMenu(user, device)
+	if err != nil {
+		b.logger.Error("Failed to build device menu", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Устройство добавлено. Получить ключ для него: /devices"))
+		return
+	}
+	if _, err := bot.SendMessage(tu.Message(tu.ID(chatID), text).WithReplyMarkup(keyboard)); err != nil {
+		b.logger.Error("Failed to send device message", "error", err)
+	}
+}
+
+// Handle /rename_device command
+func (b *Bot) handleRenameDevice(bot *telego.Bot, update telego.Update) {
+	chatID := update.Message.Chat.ID
+	username := update.Message.From.Username
+	args := strings.Fields(update.Message.Text)
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, "/rename_device", strings.Join(args[1:], " "))
+
+	const usage = "Использование: /rename_device <номер> <название>\nНомера устройств есть в /devices"
+	if len(args) < 3 {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), usage))
+		return
+	}
+	deviceID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), usage))
+		return
+	}
+	name, err := parseDeviceName(strings.Join(args[2:], " "))
+	if err != nil {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), err.Error()))
+		return
+	}
+
+	user, err := b.db.GetUserByTelegramID(update.Message.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to fetch user", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Произошла ошибка. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/rename_device", err.Error(), "Не удалось получить пользователя")
+		return
+	}
+
+	device, err := b.db.GetDevice(user.ID, deviceID)
+	if err != nil {
+		if errors.Is(err, database.ErrDeviceNotFound) {
+			_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), fmt.Sprintf("Устройство №%d не найдено.", deviceID)))
+			return
+		}
+		b.logger.Error("Failed to fetch device", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Произошла ошибка. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/rename_device", err.Error(), "Не удалось получить устройство")
+		return
+	}
+
+	// The panel client email is derived from the device ID, so only our name changes
+	if err := b.db.RenameDevice(device.ID, name); err != nil {
+		b.logger.Error("Failed to rename device", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось переименовать устройство. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/rename_device", err.Error(), "Не удалось переименовать устройство")
+		return
+	}
+
+	_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), fmt.Sprintf("Устройство «%s» переименовано в «%s».", device.Name, name)))
+}
+
+// Handle the buttons of the /devices menu
+func (b *Bot) handleDeviceCallback(bot *telego.Bot, update telego.Update) {
+	callbackQuery := update.CallbackQuery
+	data := callbackQuery.Data
+	chatID := callbackQuery.Message.GetChat().ID
+	messageID := callbackQuery.Message.GetMessageID()
+
+	user, err := b.db.GetUserByTelegramID(callbackQuery.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to fetch user", slog.String("error", err.Error()))
+		b.answerCallbackAlert(callbackQuery.ID, "Произошла ошибка. Попробуйте позже.")
+		return
+	}
+
+	switch {
+	case data == CallbackDeviceList:
+		text, keyboard, err := b.devicesMenu(user)
+		if err != nil {
+			b.logger.Error("Failed to build devices menu", slog.String("error", err.Error()))
+			b.answerCallbackAlert(callbackQuery.ID, "Не удалось получить список устройств.")
+			return
+		}
+		b.editDeviceMessage(callbackQuery.ID, chatID, messageID, text, keyboard)
+		return
+
+	case data == CallbackDeviceAdd:
+		b.answerCallbackAlert(callbackQuery.ID, "Отправьте команду /add_device <название>, например: /add_device телефон")
+		return
+
+	case strings.HasPrefix(data, CallbackDeviceKey):
+		var deviceID, serverID int64
+		if _, err := fmt.Sscanf(strings.TrimPrefix(data, CallbackDeviceKey), "%d_%d", &deviceID, &serverID); err != nil {
+			b.logger.Error("Failed to parse device callback", slog.String("data", data), slog.String("error", err.Error()))
+			b.answerCallbackAlert(callbackQuery.ID, "Произошла ошибка. Попробуйте позже.")
+			return
+		}
+		b.handleDeviceKeyRequest(update, user, deviceID, serverID)
+		return
+	}
+
+	var action string
+	for _, prefix := range []string{CallbackDeviceOpen, CallbackDeviceRevoke, CallbackDeviceRevokeConfirm} {
+		if strings.HasPrefix(data, prefix) {
+			action = prefix
+		}
+	}
+	deviceID, err := strconv.ParseInt(strings.TrimPrefix(data, action), 10, 64)
+	if action == "" || err != nil {
+		b.logger.Error("Failed to parse device callback", slog.String("data", data))
+		b.answerCallbackAlert(callbackQuery.ID, "Произошла ошибка. Попробуйте позже.")
+		return
+	}
+
+	device, err := b.db.GetDevice(user.ID, deviceID)
+	if err != nil {
+		if !errors.Is(err, database.ErrDeviceNotFound) {
+			b.logger.Error("Failed to fetch device", slog.String("error", err.Error()))
+		}
+		b.answerCallbackAlert(callbackQuery.ID, "Устройство не найдено или уже отозвано.")
+		return
+	}
+
+	switch action {
+	case CallbackDeviceOpen:
+		text, keyboard, err := b.deviceMenu(user, device)
+		if err != nil {
+			b.logger.Error("Failed to build device menu", slog.String("error", err.Error()))
+			b.answerCallbackAlert(callbackQuery.ID, "Произошла ошибка. Попробуйте позже.")
+			return
+		}
+		b.editDeviceMessage(callbackQuery.ID, chatID, messageID, text, keyboard)
+
+	case CallbackDeviceRevoke:
+		text := fmt.Sprintf("Отозвать устройство «%s»? Его ключи перестанут работать на всех серверах.", device.Name)
+		keyboard := tu.InlineKeyboard(
+			tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton("✅ Отозвать").WithCallbackData(fmt.Sprintf("%s%d", CallbackDeviceRevokeConfirm, device.ID)),
+				tu.InlineKeyboardButton("⬅️ Отмена").WithCallbackData(fmt.Sprintf("%s%d", CallbackDeviceOpen, device.ID)),
+			),
+		)
+		b.editDeviceMessage(callbackQuery.ID, chatID, messageID, text, keyboard)
+
+	case CallbackDeviceRevokeConfirm:
+		b.revokeDevice(update, user, device)
+	}
+}
+
+// handleDeviceKeyRequest checks access to the server and issues the device key
+func (b *Bot) handleDeviceKeyRequest(update telego.Update, user *database.User, deviceID, serverID int64) {
+	callbackQuery := update.CallbackQuery
+	chatID := callbackQuery.Message.GetChat().ID
+	username := callbackQuery.From.Username
+
+	device, err := b.db.GetDevice(user.ID, deviceID)
+	if err != nil {
+		b.answerCallbackAlert(callbackQuery.ID, "Устройство не найдено или уже отозвано.")
+		return
+	}
+
+	// Same access check as for the main key: the callback may be stale or forged
+	server, err := b.db.GetServerByID(serverID)
+	if err != nil || !user.CanUseServer(server) {
+		b.answerCallbackAlert(callbackQuery.ID, "Этот сервер вам недоступен.")
+		b.NotifyAdminsOfError(username, chatID, "device_key", "Отказано в доступе", fmt.Sprintf("Запрос ключа устройства №%d для сервера ID %d отклонён", deviceID, serverID))
+		return
+	}
+
+	requestKey := fmt.Sprintf("%d:%d:%d", chatID, server.ID, device.ID)
+	if !b.startKeyRequest(requestKey) {
+		err := b.bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: callbackQuery.ID,
+			Text:            "Ключ уже генерируется, подождите немного.",
+		})
+		if err != nil {
+			b.logger.Error("Failed to answer callback query", "error", err)
+		}
+		return
+	}
+
+	go func() {
+		defer b.finishKeyRequest(requestKey)
+		b.generateKeyProcess(server, user, device, update)
+	}()
+}
+
+// revokeDevice removes the device's clients from every server and reports
+// the result in place of the menu
+func (b *Bot) revokeDevice(update telego.Update, user *database.User, device *database.Device) {
+	callbackQuery := update.CallbackQuery
+	chatID := callbackQuery.Message.GetChat().ID
+	messageID := callbackQuery.Message.GetMessageID()
+	username := callbackQuery.From.Username
+
+	results, err := b.sh.RevokeDeviceClients(user, device)
+	if err != nil {
+		b.logger.Error("Failed to revoke device clients", slog.String("error", err.Error()))
+		b.answerCallbackAlert(callbackQuery.ID, "Не удалось отозвать устройство. Попробуйте позже.")
+		b.NotifyAdminsOfError(username, chatID, "device_revoke", err.Error(), fmt.Sprintf("Не удалось отозвать устройство №%d", device.ID))
+		return
+	}
+
+	queued := false
+	for _, result := range results {
+		switch result.Status {
+		case x3ui.RevokeFailed:
+			// Keep the device so the user can try again
+			b.answerCallbackAlert(callbackQuery.ID, "Не удалось удалить ключ на одном из серверов. Попробуйте позже.")
+			b.NotifyAdminsOfError(username, chatID, "device_revoke", result.Err.Error(),
+				fmt.Sprintf("Не удалось удалить ключ устройства №%d на сервере %s", device.ID, result.Server.Name))
+			return
+		case x3ui.RevokeQueued:
+			queued = true
+		}
+	}
+
+	if err := b.db.RevokeDevice(device.ID); err != nil {
+		b.logger.Error("Failed to revoke device", slog.String("error", err.Error()))
+		b.answerCallbackAlert(callbackQuery.ID, "Произошла ошибка. Попробуйте позже.")
+		b.NotifyAdminsOfError(username, chatID, "device_revoke", err.Error(), fmt.Sprintf("Ключи удалены, но устройство №%d не отмечено отозванным", device.ID))
+		return
+	}
+
+	b.NotifyAdminsOfAction(username, chatID, "device_revoke", fmt.Sprintf("Отозвано устройство «%s» (№%d)\n%s", device.Name, device.ID, formatRevokeReport(results)))
+
+	text := fmt.Sprintf("Устройство «%s» отозвано, его ключи больше не работают.", device.Name)
+	if queued {
+		text += "\n\nЧасть серверов сейчас недоступна: ключи на них удалятся при повторной попытке."
+	}
+	keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(tu.InlineKeyboardButton("⬅️ К устройствам").WithCallbackData(CallbackDeviceList)))
+	b.editDeviceMessage(callbackQuery.ID, chatID, messageID, text, keyboard)
+}
+
+// editDeviceMessage replaces the menu message and answers the callback query
+func (b *Bot) editDeviceMessage(callbackQueryID string, chatID int64, messageID int, text string, keyboard *telego.InlineKeyboardMarkup) {
+	_, err := b.bot.EditMessageText(&telego.EditMessageTextParams{
+		ChatID:      tu.ID(chatID),
+		MessageID:   messageID,
+		Text:        text,
+		ReplyMarkup: keyboard,
+	})
+	if err != nil {
+		b.logger.Error("Failed to edit message", "error", err)
+	}
+
+	err = b.bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: callbackQueryID,
+	})
+	if err != nil {
+		b.logger.Error("Failed to answer callback query", "error", err)
+	}
+}
@@ -0,0 +1,74 @@
+package telegram
+
+import (
+	"bytes"
+	"log/slog"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/x3ui"
+)
+
+// Handle /export_config command
+func (b *Bot) handleExportConfig(bot *telego.Bot, update telego.Update) {
+	chatID := update.Message.Chat.ID
+	username := update.Message.From.Username
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, "/export_config", "")
+
+	user, err := b.db.GetUserByTelegramID(update.Message.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to fetch user", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Произошла ошибка. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/export_config", err.Error(), "Не удалось получить пользователя")
+		return
+	}
+
+	progress, err := bot.SendMessage(tu.Message(tu.ID(chatID), "Собираю конфигурацию..."))
+	if err != nil {
+		b.logger.Error("Failed to send progress message", "error", err)
+	}
+	defer func() {
+		if progress != nil {
+			_ = bot.DeleteMessage(tu.Delete(tu.ID(chatID), progress.MessageID))
+		}
+	}()
+
+	outbounds, err := b.sh.ExportOutbounds(user)
+	if err != nil {
+		b.logger.Error("Failed to export outbounds", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось собрать конфигурацию. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/export_config", err.Error(), "Не удалось собрать ключи для экспорта")
+		return
+	}
+	if len(outbounds) == 0 {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Сейчас нет доступных серверов. Попробуйте позже."))
+		return
+	}
+
+	singBox, err := x3ui.SingBoxConfig(outbounds)
+	if err != nil {
+		b.logger.Error("Failed to render sing-box config", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось собрать конфигурацию. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/export_config", err.Error(), "Не удалось сформировать конфиг sing-box")
+		return
+	}
+
+	documents := []struct {
+		name    string
+		data    []byte
+		caption string
+	}{
+		{"otvali-sing-box.json", singBox, "Конфигурация для sing-box (1.11 и новее): импортируйте файл как профиль."},
+		{"otvali-clash-meta.yaml", x3ui.ClashMetaConfig(outbounds), "Профиль для Clash Meta / Mihomo: импортируйте файл как конфигурацию."},
+	}
+	for _, doc := range documents {
+		params := tu.Document(tu.ID(chatID), tu.File(tu.NameReader(bytes.NewReader(doc.data), doc.name))).
+			WithCaption(doc.caption)
+		if _, err := bot.SendDocument(params); err != nil {
+			b.logger.Error("Failed to send config document", slog.String("file", doc.name), slog.String("error", err.Error()))
+			b.NotifyAdminsOfError(username, chatID, "/export_config", err.Error(), "Не удалось отправить файл "+doc.name)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package telegram
 
 import (
+	"log/slog"
+
 	"github.com/mymmrac/telego"
 	tu "github.com/mymmrac/telego/telegoutil"
 )
@@ -14,6 +16,7 @@ const (
 	CallbackHelpVPNIOS     = "help_vpn_ios"
 	CallbackHelpVPNMacOS   = "help_vpn_macos"
 	CallbackHelpHowItWorks = "help_how_it_works"
+	CallbackHelpUsage      = "help_usage"
 	CallbackHelpBack       = "help_back"
 )
 
@@ -23,7 +26,15 @@ var (
 		"/start - начать работу с ботом\n" +
 		"/help - получить помощь\n" +
 		"/invite - пригласить пользователя\n" +
-		"/get_key - получить ключ для доступа к VPN\n\n" +
+		"/invite_link - ссылка-приглашение\n" +
+		"/my_invite_links - ваши ссылки-приглашения\n" +
+		"/my_invites - кого вы пригласили\n" +
+		"/get_key - получить ключ для доступа к VPN\n" +
+		"/my_keys - список выданных вам ключей\n" +
+		"/devices - отдельные ключи для каждого устройства\n" +
+		"/my_usage - трафик и состояние ваших ключей\n" +
+		"/subscription - ссылка-подписка на все серверы\n" +
+		"/export_config - конфигурация для sing-box и Clash Meta\n\n" +
 		"💬 Вы можете написать любое сообщение (без команды), и оно будет отправлено администраторам.\n\n" +
 		"Выберите один из вариантов ниже:"
 
@@ -31,6 +42,10 @@ var (
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton("🔑 Получить ключ 🔑").WithCallbackData(CallbackGetKey),
 		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("📱 Мои устройства").WithCallbackData(CallbackDeviceList),
+			tu.InlineKeyboardButton("📊 Мой трафик").WithCallbackData(CallbackHelpUsage),
+		),
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton("⚙️ Настройка VPN").WithCallbackData(CallbackHelpVPNSetup),
 			tu.InlineKeyboardButton("ℹ️ Как это работает").WithCallbackData(CallbackHelpHowItWorks),
@@ -115,6 +130,17 @@ func (b *Bot) handleHelpCallback(bot *telego.Bot, update telego.Update) {
 	case "help_how_it_works":
 		text = howItWorksText
 		keyboard = helpBackKeyboard
+	case CallbackHelpUsage:
+		user, err := b.db.GetUserByTelegramID(callbackQuery.From.ID)
+		if err == nil {
+			text, err = b.usageReport(user)
+		}
+		if err != nil {
+			b.logger.Error("Failed to build usage report", slog.String("error", err.Error()))
+			b.answerCallbackAlert(callbackQuery.ID, "Не удалось получить статистику. Попробуйте позже.")
+			return
+		}
+		keyboard = helpBackKeyboard
 	case "help_back":
 		text = helpMessage
 		keyboard = helpKeyboard
@@ -25,7 +25,8 @@ var (
 
 3. <b>Использование ключа:</b>
    - Получите ключ через команду /get_key или кнопку в меню бота.
-   - Импортируйте полученный ключ в настройки Hiddify.`
+   - Импортируйте полученный ключ в настройки Hiddify.
+   - Или нажмите кнопку «Hiddify» под ключом: профиль со всеми серверами добавится сам.`
 
 	InstructionHiddifyAndroid = `<b>Установка Hiddify на Android:</b>
 
@@ -37,7 +38,8 @@ var (
 
 3. <b>Использование ключа:</b>
    - Получите ключ через команду /get_key или кнопку в меню бота.
-   - Импортируйте полученный ключ в настройки Hiddify (обычно это меню “Import Key” или аналогичное).`
+   - Импортируйте полученный ключ в настройки Hiddify (обычно это меню “Import Key” или аналогичное).
+   - Или нажмите кнопку «Hiddify» под ключом: профиль со всеми серверами добавится сам.`
 
 	InstructionHiddifyIOS = `<b>Установка VPN на iOS:</b>
 
@@ -50,7 +52,8 @@ var (
 
 3. <b>Использование ключа:</b>
 	  - Получите ключ через команду /get_key или кнопку в меню бота
-	  - Импортируйте полученный ключ в настройки приложения (обычно через пункт "Import" или "Import from clipboard")`
+	  - Импортируйте полученный ключ в настройки приложения (обычно через пункт "Import" или "Import from clipboard")
+	  - Или нажмите под ключом кнопку «Happ» или «Streisand»: профиль со всеми серверами добавится сам`
 
 	InstructionHiddifyMacOS = `<b>Установка Hiddify на macOS:</b>
 
@@ -66,7 +69,8 @@ var (
 
 3. <b>Использование ключа:</b>
    - Получите ключ через команду /get_key или кнопку в меню бота.
-   - Откройте настройки Hiddify и импортируйте полученный ключ.`
+   - Откройте настройки Hiddify и импортируйте полученный ключ.
+   - Или нажмите кнопку «Hiddify» под ключом: профиль со всеми серверами добавится сам.`
 
 	howItWorksText = `<b>Как это работает?</b>
 
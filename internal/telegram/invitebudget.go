@@ -0,0 +1,100 @@
+package telegram
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// Trust levels as admins name them in /set_trust
+const (
+	TrustNew       = "new"
+	TrustTrusted   = "trusted"
+	TrustExclusive = "exclusive"
+)
+
+// trustLevel returns the user's trust level. Exclusive access is the highest
+// level, so it also decides which servers the user sees.
+func trustLevel(user *database.User) string {
+	switch {
+	case user.ExclusiveAccess:
+		return TrustExclusive
+	case user.Trusted:
+		return TrustTrusted
+	default:
+		return TrustNew
+	}
+}
+
+// inviteAllowance is how many invites a user may still send
+type inviteAllowance struct {
+	Budget    int
+	Used      int
+	Days      int  // Length of the rolling period
+	Unlimited bool // Admins are not limited
+}
+
+// Left returns the number of invites left
+func (a inviteAllowance) Left() int {
+	if a.Used >= a.Budget {
+		return 0
+	}
+	return a.Budget - a.Used
+}
+
+// describe tells the user about their remaining invites after spending n more
+func (a inviteAllowance) describe(n int) string {
+	if a.Unlimited {
+		return "Количество приглашений у вас не ограничено."
+	}
+	left := a.Left() - n
+	if left < 0 {
+		left = 0
+	}
+	return fmt.Sprintf("Осталось приглашений: %d из %d. Использованные приглашения возвращаются через %d дн.", left, a.Budget, a.Days)
+}
+
+// exhaustedText tells the user they have no invites left
+func (a inviteAllowance) exhaustedText() string {
+	return fmt.Sprintf("Вы уже использовали все приглашения (%d за %d дн.). Использованные приглашения возвращаются со временем, а увеличить лимит может администратор.",
+		a.Budget, a.Days)
+}
+
+// inviteBudget returns how many invites the user may send per period
+func (b *Bot) inviteBudget(user *database.User) int {
+	if user.InviteBudget != nil {
+		return *user.InviteBudget
+	}
+	switch trustLevel(user) {
+	case TrustExclusive:
+		return b.cfg.InviteBudgetExclusive
+	case TrustTrusted:
+		return b.cfg.InviteBudgetTrusted
+	default:
+		return b.cfg.InviteBudgetNew
+	}
+}
+
+// inviteLimit returns the budget the database enforces when the user invites
+// someone, nil for admins
+func (b *Bot) inviteLimit(user *database.User) *database.InviteBudget {
+	if user.IsAdmin {
+		return nil
+	}
+	return &database.InviteBudget{Limit: b.inviteBudget(user), Since: time.Now().AddDate(0, 0, -b.cfg.InviteBudgetDays)}
+}
+
+// inviteAllowance counts the invites the user has spent in the current period
+func (b *Bot) inviteAllowance(user *database.User) (inviteAllowance, error) {
+	allowance := inviteAllowance{Budget: b.inviteBudget(user), Days: b.cfg.InviteBudgetDays, Unlimited: user.IsAdmin}
+	if allowance.Unlimited || user.TelegramID == nil {
+		return allowance, nil
+	}
+	used, err := b.db.CountInvitesSince(*user.TelegramID, time.Now().AddDate(0, 0, -b.cfg.InviteBudgetDays))
+	if err != nil {
+		return allowance, err
+	}
+	allowance.Used = used
+	return allowance, nil
+}
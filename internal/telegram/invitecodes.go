@@ -0,0 +1,303 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// Invite code callbacks. Data has the form icode_revoke_<codeID>.
+const (
+	CallbackInviteCode       = "icode_"
+	CallbackInviteCodeRevoke = "icode_revoke_"
+)
+
+// Invite code defaults and limits
+const (
+	inviteCodeDefaultUses = 1
+	inviteCodeDefaultTTL  = 7 * 24 * time.Hour
+	inviteCodeMaxUses     = 50
+)
+
+// inviteLink returns the deep link that redeems a code
+func (b *Bot) inviteLink(code string) string {
+	return fmt.Sprintf("https://t.me/%s?start=%s", b.username, code)
+}
+
+// startPayload returns the parameter of a /start command, as sent by a
+// t.me/<bot>?start=<payload> link
+func startPayload(message *telego.Message) string {
+	if message == nil {
+		return ""
+	}
+	args := strings.Fields(message.Text)
+	if len(args) != 2 || (args[0] != "/start" && !strings.HasPrefix(args[0], "/start@")) {
+		return ""
+	}
+	return args[1]
+}
+
+// parseInviteCodeArgs parses the arguments of /invite_link in any order: a
+// number of uses, a validity such as 3d, and a target @username
+func parseInviteCodeArgs(args []string, now time.Time) (uses int, expiresAt time.Time, target string, err error) {
+	uses = inviteCodeDefaultUses
+	expiresAt = now.Add(inviteCodeDefaultTTL)
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@") {
+			target = strings.ToLower(strings.TrimPrefix(arg, "@"))
+			continue
+		}
+		if n, convErr := strconv.Atoi(arg); convErr == nil {
+			if n < 1 || n > inviteCodeMaxUses {
+				return 0, time.Time{}, "", fmt.Errorf("Число использований должно быть от 1 до %d.", inviteCodeMaxUses)
+			}
+			uses = n
+			continue
+		}
+		until, ok := parseUntil(arg, now)
+		if !ok {
+			return 0, time.Time{}, "", fmt.Errorf("Не понимаю «%s».", arg)
+		}
+		expiresAt = until
+	}
+	if target != "" {
+		// A personal invite is for one person
+		uses = 1
+	}
+	return uses, expiresAt, target, nil
+}
+
+// describeInviteCode is one line about a code for its inviter
+func describeInviteCode(code *database.InviteCode, loc *time.Location) string {
+	line := fmt.Sprintf("использовано %d из %d, действует до %s", code.Uses, code.MaxUses, code.ExpiresAt.In(loc).Format("02.01.2006 15:04"))
+	if code.TargetUsername != "" {
+		line += ", только для @" + code.TargetUsername
+	}
+	return line
+}
+
+// Handle /invite_link command
+func (b *Bot) handleInviteLink(bot *telego.Bot, update telego.Update) {
+	chatID := update.Message.Chat.ID
+	username := update.Message.From.Username
+	args := strings.Fields(update.Message.Text)[1:]
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, "/invite_link", strings.Join(args, " "))
+
+	uses, expiresAt, target, err := parseInviteCodeArgs(args, time.Now())
+	if err != nil {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), err.Error()+
+			"\n\nИспользование: /invite_link [число использований] [срок, например 3d] [@username]"))
+		return
+	}
+
+	user, err := b.db.GetUserByTelegramID(update.Message.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to fetch user", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Произошла ошибка. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/invite_link", err.Error(), "Не удалось получить пользователя")
+		return
+	}
+
+	allowance, err := b.inviteAllowance(user)
+	if err != nil {
+		b.logger.Error("Failed to count invites", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Произошла ошибка. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/invite_link", err.Error(), "Не удалось посчитать приглашения")
+		return
+	}
+	if !allowance.Unlimited && allowance.Left() < uses {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), fmt.Sprintf(
+			"Ссылка на %d использований не помещается в ваш лимит. %s\n\nНеиспользованные места в отозванных и истёкших ссылках возвращаются.",
+			uses, allowance.describe(0))))
+		return
+	}
+
+	code := &database.InviteCode{
+		CreatedByTelegramID: update.Message.From.ID,
+		CreatedByUsername:   user.Username,
+		TargetUsername:      target,
+		MaxUses:             uses,
+		ExpiresAt:           expiresAt,
+	}
+	if err := b.db.AddInviteCode(code, b.inviteLimit(user)); err != nil {
+		if errors.Is(err, database.ErrInviteBudgetExceeded) {
+			_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), fmt.Sprintf(
+				"Ссылка на %d использований не помещается в ваш лимит: его заняли другие приглашения.", uses)))
+			return
+		}
+		b.logger.Error("Failed to add invite code", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось создать приглашение. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/invite_link", err.Error(), "Не удалось сохранить код приглашения")
+		return
+	}
+
+	msk := time.FixedZone("MSK", 3*60*60)
+	b.NotifyAdminsOfAction(username, chatID, "/invite_link", "Создано приглашение: "+describeInviteCode(code, msk))
+
+	link := b.inviteLink(code.Code)
+	text := fmt.Sprintf("Ссылка-приглашение (%s):\n\n%s\n\nПерешлите её другу: по ней он сможет начать пользоваться ботом, даже если у него нет имени пользователя. Ваши приглашения: /my_invite_links\n\n%s",
+		describeInviteCode(code, msk), link, allowance.describe(uses))
+	keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton("📤 Поделиться").WithURL("https://t.me/share/url?url=" + url.QueryEscape(link)),
+	))
+	if _, err := bot.SendMessage(tu.Message(tu.ID(chatID), text).WithReplyMarkup(keyboard)); err != nil {
+		b.logger.Error("Failed to send invite link", "error", err)
+	}
+}
+
+// inviteCodesMenu builds the /my_invite_links message
+func (b *Bot) inviteCodesMenu(telegramID int64) (string, *telego.InlineKeyboardMarkup, error) {
+	codes, err := b.db.GetUsableInviteCodes(telegramID)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(codes) == 0 {
+		return "У вас нет действующих ссылок-приглашений. Создать: /invite_link", nil, nil
+	}
+
+	msk := time.FixedZone("MSK", 3*60*60)
+	var sb strings.Builder
+	sb.WriteString("Ваши действующие ссылки-приглашения:\n")
+	var rows [][]telego.InlineKeyboardButton
+	for i, code := range codes {
+		sb.WriteString(fmt.Sprintf("\n%d. %s\n%s\n", i+1, b.inviteLink(code.Code), describeInviteCode(&code, msk)))
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("🗑 Отозвать №%d", i+1)).
+				WithCallbackData(fmt.Sprintf("%s%d", CallbackInviteCodeRevoke, code.ID)),
+		))
+	}
+	return sb.String(), tu.InlineKeyboard(rows...), nil
+}
+
+// Handle /my_invite_links command
+func (b *Bot) handleMyInviteLinks(bot *telego.Bot, update telego.Update) {
+	chatID := update.Message.Chat.ID
+	username := update.Message.From.Username
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, "/my_invite_links", "")
+
+	text, keyboard, err := b.inviteCodesMenu(update.Message.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to build invite codes menu", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось получить приглашения. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/my_invite_links", err.Error(), "Не удалось получить коды приглашений")
+		return
+	}
+
+	msg := tu.Message(tu.ID(chatID), text).WithLinkPreviewOptions(&telego.LinkPreviewOptions{IsDisabled: true})
+	if keyboard != nil {
+		msg = msg.WithReplyMarkup(keyboard)
+	}
+	if _, err := bot.SendMessage(msg); err != nil {
+		b.logger.Error("Failed to send invite codes message", "error", err)
+	}
+}
+
+// Handle the revoke buttons of /my_invite_links
+func (b *Bot) handleInviteCodeCallback(bot *telego.Bot, update telego.Update) {
+	callbackQuery := update.CallbackQuery
+	chatID := callbackQuery.Message.GetChat().ID
+	username := callbackQuery.From.Username
+
+	codeID, err := strconv.ParseInt(strings.TrimPrefix(callbackQuery.Data, CallbackInviteCodeRevoke), 10, 64)
+	if !strings.HasPrefix(callbackQuery.Data, CallbackInviteCodeRevoke) || err != nil {
+		b.logger.Error("Failed to parse invite code callback", slog.String("data", callbackQuery.Data))
+		return
+	}
+
+	if err := b.db.RevokeInviteCode(codeID, callbackQuery.From.ID); err != nil {
+		if !errors.Is(err, database.ErrInviteNotFound) {
+			b.logger.Error("Failed to revoke invite code", slog.String("error", err.Error()))
+		}
+		b.answerCallbackAlert(callbackQuery.ID, "Приглашение не найдено или уже отозвано.")
+		return
+	}
+	b.NotifyAdminsOfAction(username, chatID, "invite_link_revoke", fmt.Sprintf("Отозвано приглашение ID %d", codeID))
+
+	text, keyboard, err := b.inviteCodesMenu(callbackQuery.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to build invite codes menu", slog.String("error", err.Error()))
+		text, keyboard = "Приглашение отозвано.", nil
+	}
+	_, err = bot.EditMessageText(&telego.EditMessageTextParams{
+		ChatID:             tu.ID(chatID),
+		MessageID:          callbackQuery.Message.GetMessageID(),
+		Text:               text,
+		ReplyMarkup:        keyboard,
+		LinkPreviewOptions: &telego.LinkPreviewOptions{IsDisabled: true},
+	})
+	if err != nil {
+		b.logger.Error("Failed to edit message", "error", err)
+	}
+	err = bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: callbackQuery.ID,
+		Text:            "Приглашение отозвано.",
+	})
+	if err != nil {
+		b.logger.Error("Failed to answer callback query", "error", err)
+	}
+}
+
+// revokeInviteCodes revokes the outstanding invite codes of a user who is
+// suspended or deleted, so their links stop registering new users
+func (b *Bot) revokeInviteCodes(user *database.User) {
+	if user.TelegramID == nil {
+		return
+	}
+	if err := b.db.RevokeUserInviteCodes(*user.TelegramID); err != nil {
+		b.logger.Error("Failed to revoke invite codes", slog.String("username", user.Username), slog.String("error", err.Error()))
+	}
+}
+
+// redeemInvite registers a new user from an invite link
+func (b *Bot) redeemInvite(update telego.Update, code string) {
+	message := update.Message
+	chatID := message.Chat.ID
+	username := message.From.Username
+
+	user, invite, err := b.db.RedeemInviteCode(code, message.From.ID, username)
+	if err != nil {
+		text := "Не удалось принять приглашение. Попробуйте позже."
+		switch {
+		case errors.Is(err, database.ErrInviteNotFound):
+			text = "Приглашение не найдено или отозвано."
+		case errors.Is(err, database.ErrInviteExpired):
+			text = "Срок действия приглашения истёк. Попросите новую ссылку."
+		case errors.Is(err, database.ErrInviteUsedUp):
+			text = "Это приглашение уже использовано. Попросите новую ссылку."
+		case errors.Is(err, database.ErrInviteWrongUser):
+			text = "Это приглашение предназначено другому пользователю."
+		case errors.Is(err, database.ErrAlreadyRegistered):
+			// A repeated tap on the link, the first one registered the user
+			text = welcomeMessage
+		default:
+			b.logger.Error("Failed to redeem invite code", slog.String("error", err.Error()))
+			b.NotifyAdminsOfError(username, chatID, "/start", err.Error(), "Не удалось принять приглашение по ссылке")
+		}
+		_, _ = b.bot.SendMessage(tu.Message(tu.ID(chatID), text))
+		return
+	}
+
+	b.NotifyAdminsOfAction(username, chatID, "/start", fmt.Sprintf("Принято приглашение от @%s, создан пользователь @%s (ID: %d)", invite.CreatedByUsername, user.Username, user.ID))
+	if _, err := b.bot.SendMessage(tu.Message(tu.ID(invite.CreatedByTelegramID),
+		fmt.Sprintf("🎉 @%s принял ваше приглашение.", user.Username))); err != nil {
+		b.logger.Error("Failed to notify inviter", slog.String("error", err.Error()))
+	}
+
+	welcome := fmt.Sprintf("Добро пожаловать! Вас пригласил @%s.\n\nПолучить ключ: /get_key\nВсе команды: /help\n\n"+
+		"💬 Для связи с администратором просто напишите сообщение в этом чате.", invite.CreatedByUsername)
+	if _, err := b.bot.SendMessage(tu.Message(tu.ID(chatID), welcome)); err != nil {
+		b.logger.Error("Failed to send start message", "error", err)
+	}
+}
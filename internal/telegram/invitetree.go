@@ -0,0 +1,373 @@
+package telegram
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/x3ui"
+)
+
+// Invite tree callbacks. Data has the form itree_<action>_<rootUserID>; the
+// confirmations add _<branchDigest> of the users the admin confirmed.
+const (
+	CallbackInviteTree               = "itree_"
+	CallbackInviteTreeSuspend        = "itree_suspend_"
+	CallbackInviteTreeSuspendConfirm = "itree_suspendok_"
+	CallbackInviteTreeDelete         = "itree_delete_"
+	CallbackInviteTreeDeleteConfirm  = "itree_deleteok_"
+	CallbackInviteTreeCancel         = "itree_cancel_"
+)
+
+// inviteTreeMaxMessage is the longest tree sent as a message; larger trees
+// are sent as a document
+const inviteTreeMaxMessage = 3500
+
+// branchNode is a user in an invite branch with their depth below the root
+type branchNode struct {
+	User  database.User
+	Depth int
+}
+
+// inviteBranch returns the root and everyone they invited, directly or not,
+// depth first. Invitations point at the inviter's Telegram ID.
+func inviteBranch(root *database.User, users []database.User) []branchNode {
+	children := make(map[int64][]database.User)
+	for _, user := range users {
+		if user.InvitedByID != nil {
+			children[*user.InvitedByID] = append(children[*user.InvitedByID], user)
+		}
+	}
+	for _, list := range children {
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	}
+
+	var branch []branchNode
+	seen := make(map[int64]bool)
+	var walk func(user database.User, depth int)
+	walk = func(user database.User, depth int) {
+		if seen[user.ID] {
+			return
+		}
+		seen[user.ID] = true
+		branch = append(branch, branchNode{User: user, Depth: depth})
+		if user.TelegramID == nil {
+			return
+		}
+		for _, child := range children[*user.TelegramID] {
+			walk(child, depth+1)
+		}
+	}
+	walk(*root, 0)
+	return branch
+}
+
+// renderInviteBranch draws a branch as an indented list
+func renderInviteBranch(branch []branchNode) string {
+	var sb strings.Builder
+	for _, node := range branch {
+		user := node.User
+		sb.WriteString(strings.Repeat("    ", node.Depth))
+		if node.Depth > 0 {
+			sb.WriteString("└ ")
+		}
+		sb.WriteString(fmt.Sprintf("@%s (ID: %d)", user.Username, user.ID))
+		switch {
+		case user.IsAdmin:
+			sb.WriteString(" 🛡")
+		case user.Suspended():
+			sb.WriteString(" ⛔️")
+		case user.AccessExpired():
+			sb.WriteString(" ⌛️")
+		}
+		if user.TelegramID == nil {
+			sb.WriteString(" — ещё не запускал бота")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// cascadeTargets splits a branch into the users a cascade action applies to
+// and the admins it skips
+func cascadeTargets(branch []branchNode) (targets []database.User, skipped int) {
+	for _, node := range branch {
+		if node.User.IsAdmin {
+			skipped++
+			continue
+		}
+		targets = append(targets, node.User)
+	}
+	return targets, skipped
+}
+
+// branchDigest identifies the set of users a cascade action applies to, so a
+// confirmation can tell whether the branch changed since it was shown
+func branchDigest(targets []database.User) string {
+	ids := make([]int64, len(targets))
+	for i := range targets {
+		ids[i] = targets[i].ID
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	h := fnv.New32a()
+	for _, id := range ids {
+		_, _ = h.Write([]byte(strconv.FormatInt(id, 10) + ","))
+	}
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// inviteTreeKeyboard offers the cascade actions for a branch
+func inviteTreeKeyboard(rootID int64, count int) *telego.InlineKeyboardMarkup {
+	return tu.InlineKeyboard(tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton(fmt.Sprintf("⛔️ Приостановить ветку (%d)", count)).
+			WithCallbackData(fmt.Sprintf("%s%d", CallbackInviteTreeSuspend, rootID)),
+		tu.InlineKeyboardButton(fmt.Sprintf("🗑 Удалить ветку (%d)", count)).
+			WithCallbackData(fmt.Sprintf("%s%d", CallbackInviteTreeDelete, rootID)),
+	))
+}
+
+// Handle /invite_tree command
+func (b *Bot) handleInviteTree(bot *telego.Bot, update telego.Update) {
+	root := b.adminUserCommand(bot, update, "/invite_tree")
+	if root == nil {
+		return
+	}
+	chatID := update.Message.Chat.ID
+	username := update.Message.From.Username
+
+	users, err := b.db.GetAllUsers()
+	if err != nil {
+		b.logger.Error("Failed to fetch users", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Ошибка при получении пользователей."))
+		b.NotifyAdminsOfError(username, chatID, "/invite_tree", err.Error(), "Не удалось получить пользователей")
+		return
+	}
+
+	branch := inviteBranch(root, users)
+	tree := renderInviteBranch(branch)
+	targets, skipped := cascadeTargets(branch)
+
+	header := fmt.Sprintf("Ветка приглашений @%s: %d польз.", root.Username, len(branch))
+	if root.InvitedByUsername != "" {
+		header += fmt.Sprintf(", сам приглашён @%s", root.InvitedByUsername)
+	}
+	header += "\n🛡 админ, ⛔️ приостановлен, ⌛️ доступ истёк\n\n"
+
+	var keyboard *telego.InlineKeyboardMarkup
+	footer := ""
+	if len(targets) > 0 {
+		keyboard = inviteTreeKeyboard(root.ID, len(targets))
+		if skipped > 0 {
+			footer = fmt.Sprintf("\nАдминистраторы (%d) в массовых действиях не участвуют.", skipped)
+		}
+	}
+
+	if len(header)+len(tree)+len(footer) <= inviteTreeMaxMessage {
+		msg := tu.Message(tu.ID(chatID), header+tree+footer)
+		if keyboard != nil {
+			msg = msg.WithReplyMarkup(keyboard)
+		}
+		if _, err := bot.SendMessage(msg); err != nil {
+			b.logger.Error("Failed to send invite tree", "error", err)
+		}
+		return
+	}
+
+	doc := tu.Document(tu.ID(chatID), tu.File(tu.NameReader(bytes.NewReader([]byte(header+tree)), fmt.Sprintf("invite-tree-%s.txt", root.Username)))).
+		WithCaption(fmt.Sprintf("Ветка приглашений @%s: %d польз.", root.Username, len(branch)))
+	if keyboard != nil {
+		doc = doc.WithReplyMarkup(keyboard)
+	}
+	if _, err := bot.SendDocument(doc); err != nil {
+		b.logger.Error("Failed to send invite tree document", slog.String("error", err.Error()))
+		b.NotifyAdminsOfError(username, chatID, "/invite_tree", err.Error(), "Не удалось отправить дерево приглашений")
+	}
+}
+
+// Handle the cascade buttons of /invite_tree
+func (b *Bot) handleInviteTreeCallback(bot *telego.Bot, update telego.Update) {
+	callbackQuery := update.CallbackQuery
+	data := callbackQuery.Data
+	chatID := callbackQuery.Message.GetChat().ID
+	username := callbackQuery.From.Username
+
+	isAdmin, err := b.db.IsUserAdmin(callbackQuery.From.ID)
+	if err != nil || !isAdmin {
+		b.answerCallbackAlert(callbackQuery.ID, "У вас нет прав для выполнения этой команды.")
+		return
+	}
+
+	var action string
+	for _, prefix := range []string{CallbackInviteTreeSuspend, CallbackInviteTreeSuspendConfirm, CallbackInviteTreeDelete, CallbackInviteTreeDeleteConfirm, CallbackInviteTreeCancel} {
+		if strings.HasPrefix(data, prefix) {
+			action = prefix
+		}
+	}
+	rootArg, digest, _ := strings.Cut(strings.TrimPrefix(data, action), "_")
+	rootID, err := strconv.ParseInt(rootArg, 10, 64)
+	if action == "" || err != nil {
+		b.logger.Error("Failed to parse invite tree callback", slog.String("data", data))
+		return
+	}
+
+	root, err := b.db.GetUserByID(rootID)
+	if err != nil {
+		b.answerCallbackAlert(callbackQuery.ID, "Пользователь не найден.")
+		return
+	}
+	users, err := b.db.GetAllUsers()
+	if err != nil {
+		b.logger.Error("Failed to fetch users", slog.String("error", err.Error()))
+		b.answerCallbackAlert(callbackQuery.ID, "Ошибка при получении пользователей.")
+		return
+	}
+	// The branch is rebuilt on every step, so the counts are current
+	targets, skipped := cascadeTargets(inviteBranch(root, users))
+
+	if (action == CallbackInviteTreeSuspendConfirm || action == CallbackInviteTreeDeleteConfirm) && digest != branchDigest(targets) {
+		b.answerCallbackAlert(callbackQuery.ID, fmt.Sprintf("Ветка изменилась после подтверждения, теперь в ней %d польз. Ничего не сделано, подтвердите ещё раз.", len(targets)))
+		b.setCallbackKeyboard(callbackQuery, inviteTreeKeyboard(root.ID, len(targets)))
+		return
+	}
+
+	switch action {
+	case CallbackInviteTreeCancel:
+		b.setCallbackKeyboard(callbackQuery, inviteTreeKeyboard(root.ID, len(targets)))
+
+	case CallbackInviteTreeSuspend, CallbackInviteTreeDelete:
+		confirm, verb := CallbackInviteTreeSuspendConfirm, "приостановить"
+		if action == CallbackInviteTreeDelete {
+			confirm, verb = CallbackInviteTreeDeleteConfirm, "удалить вместе с ключами"
+		}
+		text := fmt.Sprintf("Точно %s ветку @%s? Будет затронуто пользователей: %d.", verb, root.Username, len(targets))
+		if skipped > 0 {
+			text += fmt.Sprintf(" Администраторы (%d) будут пропущены.", skipped)
+		}
+		b.answerCallbackAlert(callbackQuery.ID, text)
+		b.setCallbackKeyboard(callbackQuery, tu.InlineKeyboard(tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("✅ Да, %s (%d)", verb, len(targets))).WithCallbackData(fmt.Sprintf("%s%d_%s", confirm, root.ID, branchDigest(targets))),
+			tu.InlineKeyboardButton("⬅️ Отмена").WithCallbackData(fmt.Sprintf("%s%d", CallbackInviteTreeCancel, root.ID)),
+		)))
+
+	case CallbackInviteTreeSuspendConfirm:
+		b.setCallbackKeyboard(callbackQuery, nil)
+		report := b.suspendBranch(root, targets)
+		b.NotifyAdminsOfAction(username, chatID, "invite_tree_suspend", fmt.Sprintf("Ветка @%s приостановлена\n%s", root.Username, report))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), report))
+
+	case CallbackInviteTreeDeleteConfirm:
+		b.setCallbackKeyboard(callbackQuery, nil)
+		report := b.deleteBranch(targets)
+		b.NotifyAdminsOfAction(username, chatID, "invite_tree_delete", fmt.Sprintf("Ветка @%s удалена\n%s", root.Username, report))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), report))
+	}
+}
+
+// setCallbackKeyboard replaces the keyboard of the message a button was on
+func (b *Bot) setCallbackKeyboard(callbackQuery *telego.CallbackQuery, keyboard *telego.InlineKeyboardMarkup) {
+	_, err := b.bot.EditMessageReplyMarkup(&telego.EditMessageReplyMarkupParams{
+		ChatID:      tu.ID(callbackQuery.Message.GetChat().ID),
+		MessageID:   callbackQuery.Message.GetMessageID(),
+		ReplyMarkup: keyboard,
+	})
+	if err != nil {
+		b.logger.Error("Failed to edit reply markup", "error", err)
+	}
+}
+
+// suspendBranch suspends the users of a branch indefinitely and disables
+// their clients. Timed suspensions become indefinite and keep their reason.
+func (b *Bot) suspendBranch(root *database.User, targets []database.User) string {
+	var suspended []database.User
+	failed := 0
+	for _, user := range targets {
+		if user.Suspended() && user.SuspendedUntil == nil {
+			continue
+		}
+		reason := "массовая приостановка ветки @" + root.Username
+		if user.Suspended() && user.SuspendReason != "" {
+			reason = user.SuspendReason
+		}
+		if err := b.db.SuspendUser(user.ID, reason, nil); err != nil {
+			b.logger.Error("Failed to suspend user", slog.String("username", user.Username), slog.String("error", err.Error()))
+			failed++
+			continue
+		}
+		b.revokeInviteCodes(&user)
+		user, err := b.db.GetUserByID(user.ID)
+		if err != nil {
+			failed++
+			continue
+		}
+		suspended = append(suspended, *user)
+	}
+
+	// Disable all clients in one pass; offline servers follow when they are back
+	if _, err := b.sh.SyncClients(suspended); err != nil {
+		b.logger.Error("Failed to sync clients", slog.String("error", err.Error()))
+	}
+	for i := range suspended {
+		if suspended[i].TelegramID != nil {
+			_, _ = b.bot.SendMessage(tu.Message(tu.ID(*suspended[i].TelegramID), suspensionText(&suspended[i])))
+		}
+	}
+
+	report := fmt.Sprintf("Приостановлено: %d из %d.", len(suspended), len(targets))
+	if failed > 0 {
+		report += fmt.Sprintf(" Ошибок: %d, подробности в логах.", failed)
+	}
+	return report
+}
+
+// deleteBranch revokes the clients of the users of a branch and deletes them,
+// deepest users first
+func (b *Bot) deleteBranch(targets []database.User) string {
+	deleted, failed, queued := 0, 0, false
+	for i := len(targets) - 1; i >= 0; i-- {
+		user := targets[i]
+		results, err := b.sh.RevokeUserClients(&user)
+		if err != nil {
+			b.logger.Error("Failed to revoke user clients", slog.String("username", user.Username), slog.String("error", err.Error()))
+			failed++
+			continue
+		}
+		revokeFailed := false
+		for _, result := range results {
+			switch result.Status {
+			case x3ui.RevokeFailed:
+				revokeFailed = true
+			case x3ui.RevokeQueued:
+				queued = true
+			}
+		}
+		if revokeFailed {
+			// Keep the user so the branch can be deleted again
+			failed++
+			continue
+		}
+		if err := b.db.DeleteUserByID(user.ID); err != nil {
+			b.logger.Error("Failed to delete user", slog.String("username", user.Username), slog.String("error", err.Error()))
+			failed++
+			continue
+		}
+		b.revokeInviteCodes(&user)
+		deleted++
+	}
+
+	report := fmt.Sprintf("Удалено: %d из %d.", deleted, len(targets))
+	if failed > 0 {
+		report += fmt.Sprintf(" Не удалось: %d, их можно удалить повторно.", failed)
+	}
+	if queued {
+		report += " Часть серверов недоступна: ключи на них удалятся при повторной попытке."
+	}
+	return report
+}
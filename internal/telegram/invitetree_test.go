@@ -0,0 +1,99 @@
+package telegram
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+func testInviteUsers() []database.User {
+	tg := func(id int64) *int64 { return &id }
+	suspendedAt := time.Now()
+	return []database.User{
+		{ID: 1, Username: "alice", TelegramID: tg(100)},
+		{ID: 2, Username: "bob", TelegramID: tg(200), InvitedByID: tg(100), IsAdmin: true},
+		{ID: 4, Username: "dave", TelegramID: tg(400), InvitedByID: tg(200), SuspendedAt: &suspendedAt},
+		{ID: 3, Username: "carol", InvitedByID: tg(100)},
+		{ID: 5, Username: "eve", TelegramID: tg(500), InvitedByID: tg(999)},
+		// An invite cycle must not loop
+		{ID: 6, Username: "frank", TelegramID: tg(600), InvitedByID: tg(700)},
+		{ID: 7, Username: "gina", TelegramID: tg(700), InvitedByID: tg(600)},
+	}
+}
+
+// branchUsers returns the usernames and depths of a branch
+func branchUsers(branch []branchNode) []string {
+	var got []string
+	for _, node := range branch {
+		got = append(got, fmt.Sprintf("%s:%d", node.User.Username, node.Depth))
+	}
+	return got
+}
+
+func TestInviteBranch(t *testing.T) {
+	users := testInviteUsers()
+	tests := []struct {
+		root int
+		want []string
+	}{
+		{0, []string{"alice:0", "bob:1", "dave:2", "carol:1"}},
+		{1, []string{"bob:0", "dave:1"}},
+		{3, []string{"carol:0"}},
+		{5, []string{"frank:0", "gina:1"}},
+	}
+	for _, tt := range tests {
+		root := users[tt.root]
+		if got := branchUsers(inviteBranch(&root, users)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("inviteBranch(%s) = %v, want %v", root.Username, got, tt.want)
+		}
+	}
+}
+
+func TestRenderInviteBranch(t *testing.T) {
+	users := testInviteUsers()
+	want := "@alice (ID: 1)\n" +
+		"    └ @bob (ID: 2) 🛡\n" +
+		"        └ @dave (ID: 4) ⛔️\n" +
+		"    └ @carol (ID: 3) — ещё не запускал бота\n"
+	if got := renderInviteBranch(inviteBranch(&users[0], users)); got != want {
+		t.Errorf("renderInviteBranch() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCascadeTargets(t *testing.T) {
+	users := testInviteUsers()
+	tests := []struct {
+		root        int
+		want        []string
+		wantSkipped int
+	}{
+		{0, []string{"alice", "dave", "carol"}, 1},
+		{1, []string{"dave"}, 1},
+		{3, []string{"carol"}, 0},
+	}
+	for _, tt := range tests {
+		root := users[tt.root]
+		targets, skipped := cascadeTargets(inviteBranch(&root, users))
+		var got []string
+		for _, user := range targets {
+			got = append(got, user.Username)
+		}
+		if !reflect.DeepEqual(got, tt.want) || skipped != tt.wantSkipped {
+			t.Errorf("cascadeTargets(%s) = %v, %d, want %v, %d", root.Username, got, skipped, tt.want, tt.wantSkipped)
+		}
+	}
+}
+
+func TestBranchDigest(t *testing.T) {
+	users := testInviteUsers()
+	ab := branchDigest([]database.User{users[0], users[1]})
+	if ba := branchDigest([]database.User{users[1], users[0]}); ab != ba {
+		t.Errorf("branchDigest depends on order: %s != %s", ab, ba)
+	}
+	if abc := branchDigest([]database.User{users[0], users[1], users[3]}); ab == abc {
+		t.Errorf("branchDigest did not change when a user was added: %s", ab)
+	}
+}
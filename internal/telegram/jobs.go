@@ -0,0 +1,204 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/x3ui"
+)
+
+// jobInterval is how often the background jobs run
+const jobInterval = 5 * time.Minute
+
+// Traffic warning levels, in percent of the limit
+var quotaWarningLevels = []int{100, 80}
+
+// Access expiry reminders, in days before the end, smallest first
+var expiryReminderDays = []int{1, 3}
+
+// runJobs runs the bot's periodic jobs until Stop is called
+func (b *Bot) runJobs() {
+	ticker := time.NewTicker(jobInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		b.resetMonthlyTraffic()
+		b.liftSuspensions()
+		b.checkAccessExpiry()
+		b.checkQuotas()
+	}
+}
+
+// resetMonthlyTraffic zeroes the users' traffic counters on every server once
+// a month. Offline servers are reset when they come back.
+func (b *Bot) resetMonthlyTraffic() {
+	servers, err := b.db.GetAllServers()
+	if err != nil {
+		b.logger.Error("Failed to fetch servers", slog.String("error", err.Error()))
+		return
+	}
+
+	now := time.Now()
+	monthStart := x3ui.QuotaPeriodStart(now)
+	var users []database.User
+	for _, server := range servers {
+		if server.TrafficResetAt != nil && !server.TrafficResetAt.Before(monthStart) {
+			continue
+		}
+		// A server seen for the first time keeps its counters until next month
+		if server.TrafficResetAt == nil {
+			if err := b.db.UpdateServerTrafficReset(server.ID, now); err != nil {
+				b.logger.Error("Failed to update traffic reset time", slog.String("error", err.Error()))
+			}
+			continue
+		}
+		if !b.sh.IsServerOnline(server.ID) {
+			continue
+		}
+
+		if users == nil {
+			if users, err = b.db.GetAllUsers(); err != nil {
+				b.logger.Error("Failed to fetch users", slog.String("error", err.Error()))
+				return
+			}
+		}
+		reset, err := b.sh.ResetUsersTraffic(&server, users)
+		if err != nil {
+			b.logger.Error("Failed to reset traffic", slog.String("server", server.Name), slog.String("error", err.Error()))
+			continue
+		}
+		if err := b.db.UpdateServerTrafficReset(server.ID, now); err != nil {
+			b.logger.Error("Failed to update traffic reset time", slog.String("error", err.Error()))
+		}
+		// The panel turns reset clients back on; disable the blocked ones again right away
+		if _, err := b.sh.SyncServerClients(&server, users); err != nil {
+			b.logger.Error("Failed to sync clients", slog.String("server", server.Name), slog.String("error", err.Error()))
+		}
+		b.logger.Info("Monthly traffic reset", slog.String("server", server.Name), slog.Int("clients", reset))
+	}
+}
+
+// checkQuotas applies the users' plans to the panels and warns users who are
+// close to or over their traffic limit
+func (b *Bot) checkQuotas() {
+	users, err := b.db.GetAllUsers()
+	if err != nil {
+		b.logger.Error("Failed to fetch users", slog.String("error", err.Error()))
+		return
+	}
+	usage, err := b.sh.SyncClients(users)
+	if err != nil {
+		b.logger.Error("Failed to sync clients", slog.String("error", err.Error()))
+		return
+	}
+
+	period := x3ui.QuotaPeriod(time.Now())
+	for _, u := range usage {
+		level := 0
+		for _, l := range quotaWarningLevels {
+			if u.Used*100 >= u.Limit*int64(l) {
+				level = l
+				break
+			}
+		}
+		if level == 0 || u.User.TelegramID == nil {
+			continue
+		}
+
+		isNew, err := b.db.AddQuotaNotice(&database.QuotaNotice{
+			UserID:   u.User.ID,
+			ServerID: u.Server.ID,
+			Email:    u.Email,
+			Period:   period,
+			Quota:    u.Limit,
+			Level:    level,
+		})
+		if err != nil {
+			b.logger.Error("Failed to record quota notice", slog.String("error", err.Error()))
+			continue
+		}
+		if !isNew {
+			continue
+		}
+
+		text := fmt.Sprintf("⚠️ Вы израсходовали %d%% месячного трафика на сервере %s: %s из %s.\n\nСчётчик обнулится 1-го числа. Статистика: /my_usage",
+			level, serverLabel(&u.Server), formatBytes(u.Used), formatBytes(u.Limit))
+		if level >= 100 {
+			text = fmt.Sprintf("⛔️ Месячный трафик на сервере %s закончился (%s), ключ остановлен до 1-го числа.\n\nЕсли доступ нужен раньше, напишите сюда сообщение администратору.",
+				serverLabel(&u.Server), formatBytes(u.Limit))
+			b.NotifyAdminsOfAction(u.User.Username, *u.User.TelegramID, "quota_exceeded",
+				fmt.Sprintf("Трафик исчерпан на сервере %s (%s, клиент %s). Добавить: /topup %d <ГБ>", u.Server.Name, formatBytes(u.Limit), u.Email, u.User.ID))
+		}
+		if _, err := b.bot.SendMessage(tu.Message(tu.ID(*u.User.TelegramID), text)); err != nil {
+			b.logger.Error("Failed to send quota warning", slog.String("username", u.User.Username), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// checkAccessExpiry reminds users that their access period is about to end
+// and tells them when it has ended. The clients themselves are disabled by
+// checkQuotas, which brings them in line with the users' plans.
+func (b *Bot) checkAccessExpiry() {
+	users, err := b.db.GetAllUsers()
+	if err != nil {
+		b.logger.Error("Failed to fetch users", slog.String("error", err.Error()))
+		return
+	}
+
+	msk := time.FixedZone("MSK", 3*60*60)
+	now := time.Now()
+	for _, user := range users {
+		if user.AccessExpiresAt == nil || user.TelegramID == nil {
+			continue
+		}
+		left := user.AccessExpiresAt.Sub(now)
+		daysLeft := -1
+		if left <= 0 {
+			daysLeft = 0
+		} else {
+			for _, days := range expiryReminderDays {
+				if left <= time.Duration(days)*24*time.Hour {
+					daysLeft = days
+					break
+				}
+			}
+		}
+		if daysLeft < 0 {
+			continue
+		}
+
+		isNew, err := b.db.AddExpiryNotice(&database.ExpiryNotice{
+			UserID:    user.ID,
+			ExpiresAt: *user.AccessExpiresAt,
+			DaysLeft:  daysLeft,
+		})
+		if err != nil {
+			b.logger.Error("Failed to record expiry notice", slog.String("error", err.Error()))
+			continue
+		}
+		if !isNew {
+			continue
+		}
+
+		until := user.AccessExpiresAt.In(msk).Format("02.01.2006 15:04")
+		text := fmt.Sprintf("⏳ Ваш доступ к VPN закончится %s МСК (осталось меньше %d дн.).\n\nЧтобы продлить его, напишите администратору или тому, кто вас пригласил.",
+			until, daysLeft)
+		if daysLeft == 0 {
+			text = "⛔️ Срок вашего доступа к VPN закончился, ключи отключены.\n\nЧтобы продлить доступ, напишите администратору или тому, кто вас пригласил."
+			b.NotifyAdminsOfAction(user.Username, *user.TelegramID, "access_expired",
+				fmt.Sprintf("Доступ закончился %s МСК. Продлить: /extend %d <дни>", until, user.ID))
+		}
+		if _, err := b.bot.SendMessage(tu.Message(tu.ID(*user.TelegramID), text)); err != nil {
+			b.logger.Error("Failed to send expiry reminder", slog.String("username", user.Username), slog.String("error", err.Error()))
+		}
+	}
+}
@@ -2,6 +2,7 @@ package telegram
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strings"
@@ -9,8 +10,15 @@ import (
 
 	"github.com/mymmrac/telego"
 	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
 )
 
+// errAccessExpired is returned when a user whose access period is over asks for keys
+var errAccessExpired = errors.New("access expired")
+
+// accessExpiredText is shown instead of the server list once access has ended
+const accessExpiredText = "Срок вашего доступа закончился, получить ключ нельзя.\n\nЧтобы продлить доступ, напишите администратору или тому, кто вас пригласил."
+
 var backHomeKeyboard = tu.InlineKeyboard(
 	tu.InlineKeyboardRow(
 		tu.InlineKeyboardButton("🏠 Домой").WithCallbackData("help_back"),
@@ -27,6 +35,10 @@ func (b *Bot) handleGetKey(bot *telego.Bot, update telego.Update) {
 
 	// Fetch the list of servers and their user counts
 	serverButtons, err := b.getServerButtons(chatID)
+	if errors.Is(err, errAccessExpired) {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), accessExpiredText).WithReplyMarkup(backHomeKeyboard))
+		return
+	}
 	if err != nil {
 		b.logger.Error("Failed to get server buttons", "error", err)
 		_, _ = bot.SendMessage(tu.Message(
@@ -52,12 +64,106 @@ func (b *Bot) handleGetKey(bot *telego.Bot, update telego.Update) {
 	}
 }
 
+// Handle /my_keys command
+func (b *Bot) handleMyKeys(bot *telego.Bot, update telego.Update) {
+	chatID := update.Message.Chat.ID
+	username := update.Message.From.Username
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, "/my_keys", "")
+
+	user, err := b.db.GetUserByTelegramID(update.Message.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to fetch user", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Произошла ошибка. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/my_keys", err.Error(), "Не удалось получить пользователя")
+		return
+	}
+
+	keys, err := b.db.GetIssuedKeysByUser(user.ID)
+	if err != nil {
+		b.logger.Error("Failed to fetch issued keys", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось получить список ключей. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/my_keys", err.Error(), "Не удалось получить выданные ключи")
+		return
+	}
+
+	if len(keys) == 0 {
+		msg := tu.Message(tu.ID(chatID), "У вас пока нет ключей. Получить ключ: /get_key").WithReplyMarkup(backHomeKeyboard)
+		_, _ = bot.SendMessage(msg)
+		return
+	}
+
+	// Keys of revoked devices are shown without the device name
+	deviceNames := make(map[int64]string)
+	devices, err := b.db.GetDevicesByUser(user.ID)
+	if err != nil {
+		b.logger.Error("Failed to fetch devices", slog.String("error", err.Error()))
+	}
+	for _, device := range devices {
+		deviceNames[device.ID] = device.Name
+	}
+
+	msk := time.FixedZone("MSK", 3*60*60)
+	servers := make(map[int64]*database.Server)
+	var sb strings.Builder
+	sb.WriteString("Ваши ключи:\n\n")
+	for _, key := range keys {
+		server, ok := servers[key.ServerID]
+		if !ok {
+			server, err = b.db.GetServerByID(key.ServerID)
+			if err != nil {
+				server = nil
+			}
+			servers[key.ServerID] = server
+		}
+
+		label := "Удалённый сервер"
+		if server != nil {
+			label = serverLabel(server)
+		}
+		if key.DeviceID != nil {
+			if name, ok := deviceNames[*key.DeviceID]; ok {
+				label += fmt.Sprintf(" · 📱 %s", name)
+			} else {
+				label += " · 📱 отозванное устройство"
+			}
+		}
+
+		if key.Status == database.KeyStatusActive {
+			sb.WriteString(fmt.Sprintf("🟢 %s\nВыдан: %s\n\n", label, key.CreatedAt.In(msk).Format("02.01.2006")))
+		} else {
+			revoked := "—"
+			if key.RevokedAt != nil {
+				revoked = key.RevokedAt.In(msk).Format("02.01.2006")
+			}
+			sb.WriteString(fmt.Sprintf("🔴 %s\nВыдан: %s, отозван: %s\n\n", label, key.CreatedAt.In(msk).Format("02.01.2006"), revoked))
+		}
+	}
+	sb.WriteString("Показать ключ целиком: /get_key")
+
+	msg := tu.Message(tu.ID(chatID), sb.String()).WithReplyMarkup(backHomeKeyboard)
+	if _, err := bot.SendMessage(msg); err != nil {
+		b.logger.Error("Failed to send my_keys message", "error", err)
+		b.NotifyAdminsOfError(username, chatID, "/my_keys", err.Error(), "Не удалось отправить список ключей")
+	}
+}
+
 // Fetch server buttons with online and total user counts
 func (b *Bot) getServerButtons(chatID int64) ([][]telego.InlineKeyboardButton, error) {
 	// Build buttons
 	var buttons [][]telego.InlineKeyboardButton
-	// Fetch servers from the database
-	servers, err := b.db.GetAllServers()
+	user, err := b.db.GetUserByTelegramID(chatID)
+	if err != nil {
+		b.logger.Error("Failed to fetch user", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("failed to fetch user: %w", err)
+	}
+	if user.AccessExpired() {
+		return nil, errAccessExpired
+	}
+
+	// Fetch the servers this user may use from the database
+	servers, err := b.db.GetServersForUser(user)
 	if err != nil {
 		b.logger.Error("Failed to fetch servers", slog.String("error", err.Error()))
 		msg := tu.Message(tu.ID(chatID), "Не удалось получить список серверов.")
@@ -70,7 +176,7 @@ func (b *Bot) getServerButtons(chatID int64) ([][]telego.InlineKeyboardButton, e
 		// TODO: Count online users for this inbound
 
 		// Create button text and callback data
-		buttonText := fmt.Sprintf("%s %s, %s", countryToFlag(server.Country), server.Country, server.City)
+		buttonText := serverLabel(&server)
 		callbackData := fmt.Sprintf("getkey_%d", server.ID)
 
 		// Create the button
@@ -105,6 +211,10 @@ func (b *Bot) handleGetKeyCallback(bot *telego.Bot, update telego.Update) {
 	// Check if callback data matches "getkey_" exactly
 	if data == "getkey_" {
 		serverButtons, err := b.getServerButtons(chatID)
+		if errors.Is(err, errAccessExpired) {
+			b.answerCallbackAlert(callbackQuery.ID, accessExpiredText)
+			return
+		}
 		if err != nil {
 			b.logger.Error("Failed to get server buttons", "error", err)
 			_, _ = bot.SendMessage(tu.Message(
@@ -139,15 +249,84 @@ func (b *Bot) handleGetKeyCallback(bot *telego.Bot, update telego.Update) {
 		return
 	}
 
+	// Re-check access: the callback may be stale or forged
+	server, err := b.db.GetServerByID(int64(serverID))
+	if err != nil && !errors.Is(err, database.ErrServerNotFound) {
+		b.logger.Error("error getting server from db", slog.String("error", err.Error()))
+		b.answerCallbackAlert(callbackQuery.ID, "Произошла ошибка. Попробуйте позже.")
+		b.NotifyAdminsOfError(username, chatID, "get_key_callback", err.Error(), fmt.Sprintf("Не удалось получить сервер из БД, ID: %d", serverID))
+		return
+	}
+	user, userErr := b.db.GetUserByTelegramID(callbackQuery.From.ID)
+	if err != nil || userErr != nil || !user.CanUseServer(server) {
+		b.answerCallbackAlert(callbackQuery.ID, "Этот сервер вам недоступен.")
+		reason := "сервер недоступен пользователю"
+		if err != nil {
+			reason = "сервер не найден"
+		} else if userErr != nil {
+			reason = "пользователь не найден: " + userErr.Error()
+		}
+		b.NotifyAdminsOfError(username, chatID, "get_key_callback", "Отказано в доступе", fmt.Sprintf("Запрос ключа для сервера ID %d отклонён: %s (callback: %s)", serverID, reason, data))
+		return
+	}
+
+	// Ignore repeat taps while the key for this server is being generated
+	requestKey := fmt.Sprintf("%d:%d", chatID, server.ID)
+	if !b.startKeyRequest(requestKey) {
+		err := bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+			CallbackQueryID: callbackQuery.ID,
+			Text:            "Ключ уже генерируется, подождите немного.",
+		})
+		if err != nil {
+			b.logger.Error("Failed to answer callback query", "error", err)
+		}
+		return
+	}
+
 	// Notify admins about server selection
 	b.NotifyAdminsOfAction(username, chatID, "server_selected", fmt.Sprintf("Пользователь выбрал сервер ID: %d для получения ключа", serverID))
 
 	// Start generating the key
-	go b.generateKeyProcess(serverID, update)
+	go func() {
+		defer b.finishKeyRequest(requestKey)
+		b.generateKeyProcess(server, user, nil, update)
+	}()
 }
 
-// Generate key process with animated dots and message updates
-func (b *Bot) generateKeyProcess(serverID int, update telego.Update) {
+// startKeyRequest marks a key request as in progress. It returns false if the
+// same request is already running.
+func (b *Bot) startKeyRequest(requestKey string) bool {
+	b.keyRequestsMu.Lock()
+	defer b.keyRequestsMu.Unlock()
+	if b.keyRequests[requestKey] {
+		return false
+	}
+	b.keyRequests[requestKey] = true
+	return true
+}
+
+// finishKeyRequest marks a key request as done
+func (b *Bot) finishKeyRequest(requestKey string) {
+	b.keyRequestsMu.Lock()
+	delete(b.keyRequests, requestKey)
+	b.keyRequestsMu.Unlock()
+}
+
+// answerCallbackAlert answers a callback query with a popup alert
+func (b *Bot) answerCallbackAlert(callbackQueryID string, text string) {
+	err := b.bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: callbackQueryID,
+		Text:            text,
+		ShowAlert:       true,
+	})
+	if err != nil {
+		b.logger.Error("Failed to answer callback query", "error", err)
+	}
+}
+
+// Generate key process with animated dots and message updates. The key is the
+// user's main key, or the device's key when device is not nil.
+func (b *Bot) generateKeyProcess(server *database.Server, user *database.User, device *database.Device, update telego.Update) {
 	chatID := update.CallbackQuery.Message.GetChat().ID
 	messageID := update.CallbackQuery.Message.GetMessageID()
 	username := update.CallbackQuery.Message.GetChat().Username
@@ -166,46 +345,59 @@ func (b *Bot) generateKeyProcess(serverID int, update telego.Update) {
 		errorMsg := fmt.Sprintf("Произошла ошибка при генерации ключа: %v", err)
 		keyMsg.Text = errorMsg
 		_, _ = b.bot.EditMessageText(keyMsg)
-		b.NotifyAdminsOfError(username, chatID, "key_generation", err.Error(), fmt.Sprintf("Не удалось начать анимацию генерации ключа для сервера ID: %d", serverID))
+		b.NotifyAdminsOfError(username, chatID, "key_generation", err.Error(), fmt.Sprintf("Не удалось начать анимацию генерации ключа для сервера ID: %d", server.ID))
 		return
 	}
 
 	defer cancel()
 
-	server, err := b.db.GetServerByID(int64(serverID))
-	if err != nil {
-		b.logger.Error("error getting server from db", slog.String("error", err.Error()))
-		cancel() // Stop the animation
-		errorMsg := fmt.Sprintf("Произошла ошибка при генерации ключа: %v", err)
-		keyMsg.Text = errorMsg
-		_, _ = b.bot.EditMessageText(keyMsg)
-		b.NotifyAdminsOfError(username, chatID, "key_generation", err.Error(), fmt.Sprintf("Не удалось получить сервер из БД, ID: %d", serverID))
-		return
+	serverName := serverLabel(server)
+	notifyName := serverName
+	if device != nil {
+		notifyName = fmt.Sprintf("%s (устройство «%s»)", serverName, device.Name)
 	}
 
-	serverName := fmt.Sprintf("%s %s, %s", countryToFlag(server.Country), server.Country, server.City)
-
 	// Proceed to generate the key
-	key, err := b.sh.GetUserKey(server, username, chatID)
+	var key string
+	if device != nil {
+		key, err = b.sh.GetDeviceKey(server, user, device)
+	} else {
+		key, err = b.sh.GetUserKey(server, user)
+	}
 	if err != nil {
 		cancel() // Stop the animation
 		errorMsg := fmt.Sprintf("Произошла ошибка при генерации ключа: %v", err)
 		keyMsg.Text = errorMsg
 		_, _ = b.bot.EditMessageText(keyMsg)
-		b.NotifyAdminsOfKeyRequest(username, chatID, serverName, false, err.Error())
+		b.NotifyAdminsOfKeyRequest(username, chatID, notifyName, false, err.Error())
 		return
 	}
 
 	cancel() // Stop the animation
 
 	// Edit the message to show the generated key in monospace
-	keyText := fmt.Sprintf("Твой ключ от сервера %v:```%s```Скопируй его и вставь в Hiddify чтобы начать пользоваться", escapeMarkdownV2(serverName), key)
-	keyMsg.Text = keyText
+	qrCaption := "Ключ от сервера " + serverName
+	if device != nil {
+		keyMsg.Text = fmt.Sprintf("Ключ устройства «%s» от сервера %v:```%s```", escapeMarkdownV2(device.Name), escapeMarkdownV2(serverName), key) +
+			escapeMarkdownV2("Вставь его в Hiddify на этом устройстве. Ключ работает только на нём: с другими устройствами он может перестать подключаться.")
+		keyMsg.ReplyMarkup = deviceKeyKeyboard(server.ID, device.ID)
+		qrCaption = fmt.Sprintf("Ключ устройства «%s», сервер %s", device.Name, serverName)
+	} else {
+		keyText := fmt.Sprintf("Твой ключ от сервера %v:```%s```Скопируй его и вставь в Hiddify чтобы начать пользоваться", escapeMarkdownV2(serverName), key)
+		subURL, err := b.subscriptionURL(user)
+		if err != nil {
+			b.logger.Error("Failed to get subscription URL", slog.String("error", err.Error()))
+		} else if subURL != "" {
+			keyText += fmt.Sprintf("\n\nИли добавь подписку сразу на все серверы, она обновляется сама:```%s```", subURL) +
+				escapeMarkdownV2("Кнопки с названиями приложений ниже добавят её в одно касание.")
+		}
+		keyMsg.Text = keyText
+		keyMsg.ReplyMarkup = b.keyKeyboard(server.ID, user, subURL)
+	}
 	keyMsg.ParseMode = telego.ModeMarkdownV2
-	keyMsg.ReplyMarkup = backHomeKeyboard
 
 	// Notify admins about successful key generation
-	b.NotifyAdminsOfKeyRequest(username, chatID, serverName, true, "")
+	b.NotifyAdminsOfKeyRequest(username, chatID, notifyName, true, "")
 
 	_, err = b.bot.EditMessageText(keyMsg)
 	if err != nil {
@@ -213,6 +405,12 @@ func (b *Bot) generateKeyProcess(serverID int, update telego.Update) {
 		b.NotifyAdminsOfError(username, chatID, "key_generation", err.Error(), "Не удалось отправить ключ пользователю (ключ сгенерирован успешно)")
 		return
 	}
+
+	// The same key as a QR code, for setting up another device
+	if err := b.sendQRPhoto(chatID, key, qrCaption); err != nil {
+		b.logger.Error("Failed to send QR code", slog.String("error", err.Error()))
+		b.NotifyAdminsOfError(username, chatID, "key_generation", err.Error(), "Не удалось отправить QR-код ключа")
+	}
 }
 
 func (b *Bot) sendMessageWithAnimatedDots(chatID int64, messageID int, loadingText string) (*telego.EditMessageTextParams, context.CancelFunc, error) {
@@ -15,6 +15,16 @@ func (b *Bot) userUsernameMiddleware() th.Middleware {
 	return func(bot *telego.Bot, update telego.Update, next th.Handler) {
 		b.logger.Debug("Ensuring that user has username")
 		if update.Message != nil && update.Message.From != nil && update.Message.From.Username == "" {
+			// Users without a username can join with an invite link and use
+			// the bot once they are registered
+			if startPayload(update.Message) != "" {
+				next(bot, update)
+				return
+			}
+			if _, err := b.db.GetUserByTelegramID(update.Message.From.ID); err == nil {
+				next(bot, update)
+				return
+			}
 			bot.SendMessage(markdownMessage(update.Message.Chat.ChatID(), noUsernameResponse))
 			return
 		}
@@ -55,8 +65,21 @@ func (b *Bot) userDatabaseMiddleware() th.Middleware {
 		user, err := b.db.GetUserByTelegramID(telegramID)
 		if err == nil {
 			// User found by TelegramID
-			// Update username if changed
-			if user.Username != username {
+			// Update username if changed; users without one keep their placeholder
+			if username != "" && user.Username != username {
+				// A placeholder user who was also invited by username is
+				// merged into the invite row instead of clashing with it
+				if user.Username == database.PlaceholderUsername(telegramID) {
+					_, err := b.db.MergePlaceholderUser(user.ID, username)
+					if err == nil {
+						b.logger.Info("Merged placeholder user into invited user", slog.String("username", username))
+						next(bot, update)
+						return
+					}
+					if !errors.Is(err, database.ErrUserNotFound) {
+						b.logger.Error("Failed to merge placeholder user", slog.String("error", err.Error()))
+					}
+				}
 				if err := b.db.UpdateUserUsername(user.ID, username); err != nil {
 					b.logger.Error("Failed to update username", slog.String("error", err.Error()))
 				}
@@ -93,6 +116,12 @@ func (b *Bot) userDatabaseMiddleware() th.Middleware {
 			return
 		}
 
+		// New users redeem their invite code in handleStart
+		if startPayload(update.Message) != "" {
+			next(bot, update)
+			return
+		}
+
 		// User not found, send message that they must be invited first
 		msg := tu.Message(
 			tu.ID(chatID),
@@ -101,3 +130,37 @@ func (b *Bot) userDatabaseMiddleware() th.Middleware {
 		_, _ = bot.SendMessage(msg)
 	}
 }
+
+// Middleware to keep suspended users away from the bot's commands. Plain text
+// still reaches the admins, so a suspended user can ask what happened.
+func (b *Bot) userSuspensionMiddleware() th.Middleware {
+	return func(bot *telego.Bot, update telego.Update, next th.Handler) {
+		var fromUser *telego.User
+		if update.Message != nil {
+			if !strings.HasPrefix(update.Message.Text, "/") {
+				next(bot, update)
+				return
+			}
+			fromUser = update.Message.From
+		} else if update.CallbackQuery != nil {
+			fromUser = &update.CallbackQuery.From
+		}
+		if fromUser == nil {
+			next(bot, update)
+			return
+		}
+
+		user, err := b.db.GetUserByTelegramID(fromUser.ID)
+		if err != nil || !user.Suspended() || user.IsAdmin {
+			next(bot, update)
+			return
+		}
+
+		b.logger.Debug("Blocked update from suspended user", slog.String("username", user.Username))
+		if update.CallbackQuery != nil {
+			b.answerCallbackAlert(update.CallbackQuery.ID, "Ваш доступ приостановлен.")
+			return
+		}
+		_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), suspensionText(user)))
+	}
+}
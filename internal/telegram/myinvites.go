@@ -0,0 +1,153 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// CallbackWithdrawInvite withdraws an unused invite. Data has the form
+// myinv_withdraw_<userID>.
+const CallbackWithdrawInvite = "myinv_withdraw_"
+
+// describeInvitee is one line about an invited user for their inviter
+func describeInvitee(user *database.User, hasKey, online bool, lastSeen time.Time, loc *time.Location) string {
+	switch {
+	case user.TelegramID == nil:
+		return "ещё не запускал бота"
+	case user.Suspended():
+		return "доступ приостановлен"
+	case !hasKey:
+		return "запустил бота, ключа пока нет"
+	case online:
+		return "есть ключ, сейчас онлайн"
+	case !lastSeen.IsZero():
+		return "есть ключ, последний раз онлайн " + lastSeen.In(loc).Format("02.01.2006")
+	default:
+		return "есть ключ, но ещё ни разу не подключался"
+	}
+}
+
+// myInvitesMenu builds the /my_invites message
+func (b *Bot) myInvitesMenu(telegramID int64) (string, *telego.InlineKeyboardMarkup, error) {
+	invitees, err := b.db.GetUsersInvitedBy(telegramID)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(invitees) == 0 {
+		return "Вы ещё никого не пригласили. Пригласить: /invite или /invite_link", nil, nil
+	}
+
+	ids := make([]int64, len(invitees))
+	for i := range invitees {
+		ids[i] = invitees[i].ID
+	}
+	withKeys, err := b.db.GetUserIDsWithActiveKeys(ids)
+	if err != nil {
+		return "", nil, err
+	}
+	lastSeen, err := b.db.GetLastTrafficAt(ids)
+	if err != nil {
+		return "", nil, err
+	}
+	online := b.sh.OnlineUsers(invitees)
+
+	msk := time.FixedZone("MSK", 3*60*60)
+	var sb strings.Builder
+	sb.WriteString("Приглашённые вами:\n")
+	var rows [][]telego.InlineKeyboardButton
+	for i := range invitees {
+		user := &invitees[i]
+		sb.WriteString(fmt.Sprintf("\n%d. @%s — %s", i+1, user.Username,
+			describeInvitee(user, withKeys[user.ID], online[user.ID], lastSeen[user.ID], msk)))
+		if user.TelegramID == nil {
+			rows = append(rows, tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton(fmt.Sprintf("🗑 Отозвать приглашение @%s", user.Username)).
+					WithCallbackData(fmt.Sprintf("%s%d", CallbackWithdrawInvite, user.ID)),
+			))
+		}
+	}
+	sb.WriteString("\n\nНеиспользованное приглашение можно отозвать, оно вернётся в ваш лимит. Ссылки-приглашения: /my_invite_links")
+
+	var keyboard *telego.InlineKeyboardMarkup
+	if len(rows) > 0 {
+		keyboard = tu.InlineKeyboard(rows...)
+	}
+	return sb.String(), keyboard, nil
+}
+
+// Handle /my_invites command
+func (b *Bot) handleMyInvites(bot *telego.Bot, update telego.Update) {
+	chatID := update.Message.Chat.ID
+	username := update.Message.From.Username
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, "/my_invites", "")
+
+	text, keyboard, err := b.myInvitesMenu(update.Message.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to build invites menu", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось получить приглашения. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/my_invites", err.Error(), "Не удалось получить приглашённых пользователей")
+		return
+	}
+
+	msg := tu.Message(tu.ID(chatID), text)
+	if keyboard != nil {
+		msg = msg.WithReplyMarkup(keyboard)
+	}
+	if _, err := bot.SendMessage(msg); err != nil {
+		b.logger.Error("Failed to send invites message", "error", err)
+	}
+}
+
+// Handle the withdraw buttons of /my_invites
+func (b *Bot) handleWithdrawInviteCallback(bot *telego.Bot, update telego.Update) {
+	callbackQuery := update.CallbackQuery
+	chatID := callbackQuery.Message.GetChat().ID
+	username := callbackQuery.From.Username
+
+	userID, err := strconv.ParseInt(strings.TrimPrefix(callbackQuery.Data, CallbackWithdrawInvite), 10, 64)
+	if err != nil {
+		b.logger.Error("Failed to parse withdraw invite callback", slog.String("data", callbackQuery.Data))
+		return
+	}
+
+	if err := b.db.WithdrawInvite(userID, callbackQuery.From.ID); err != nil {
+		if !errors.Is(err, database.ErrInviteNotFound) {
+			b.logger.Error("Failed to withdraw invite", slog.String("error", err.Error()))
+		}
+		b.answerCallbackAlert(callbackQuery.ID, "Приглашение не найдено или уже использовано.")
+		return
+	}
+	b.NotifyAdminsOfAction(username, chatID, "invite_withdraw", fmt.Sprintf("Отозвано приглашение пользователя с ID %d", userID))
+
+	text, keyboard, err := b.myInvitesMenu(callbackQuery.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to build invites menu", slog.String("error", err.Error()))
+		text, keyboard = "Приглашение отозвано.", nil
+	}
+	_, err = bot.EditMessageText(&telego.EditMessageTextParams{
+		ChatID:      tu.ID(chatID),
+		MessageID:   callbackQuery.Message.GetMessageID(),
+		Text:        text,
+		ReplyMarkup: keyboard,
+	})
+	if err != nil {
+		b.logger.Error("Failed to edit message", "error", err)
+	}
+	err = bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: callbackQuery.ID,
+		Text:            "Приглашение отозвано.",
+	})
+	if err != nil {
+		b.logger.Error("Failed to answer callback query", "error", err)
+	}
+}
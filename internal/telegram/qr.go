@@ -0,0 +1,145 @@
+package telegram
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/qrcode"
+)
+
+// Data of "Show QR" buttons has the form showqr_<serverID> for the main key
+// and showqr_<serverID>_<deviceID> for a device key
+const (
+	CallbackShowQR             = "showqr_"
+	CallbackShowQRSubscription = "showqr_sub"
+)
+
+// QR codes are rendered large enough to scan from another phone's screen
+const (
+	qrScale  = 8
+	qrBorder = 4
+)
+
+// showQRButton returns the "Show QR" button for a server key
+func showQRButton(serverID int64) telego.InlineKeyboardButton {
+	return tu.InlineKeyboardButton("📷 Показать QR").WithCallbackData(fmt.Sprintf("%s%d", CallbackShowQR, serverID))
+}
+
+// showDeviceQRButton returns the "Show QR" button for a device key
+func showDeviceQRButton(serverID, deviceID int64) telego.InlineKeyboardButton {
+	return tu.InlineKeyboardButton("📷 Показать QR").WithCallbackData(fmt.Sprintf("%s%d_%d", CallbackShowQR, serverID, deviceID))
+}
+
+// keyKeyboard is the keyboard of a key message. The subscription QR button is
+// only shown when the message carries a subscription URL.
+func (b *Bot) keyKeyboard(serverID int64, user *database.User, subscriptionURL string) *telego.InlineKeyboardMarkup {
+	qrRow := tu.InlineKeyboardRow(showQRButton(serverID))
+	if subscriptionURL != "" {
+		qrRow = append(qrRow, tu.InlineKeyboardButton("📷 QR подписки").WithCallbackData(CallbackShowQRSubscription))
+	}
+	rows := [][]telego.InlineKeyboardButton{qrRow}
+	rows = append(rows, b.importButtonRows(user)...)
+	rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton("🏠 Домой").WithCallbackData(CallbackHelpBack)))
+	return tu.InlineKeyboard(rows...)
+}
+
+// sendQRPhoto sends text encoded as a QR code
+func (b *Bot) sendQRPhoto(chatID int64, text, caption string) error {
+	code, err := qrcode.Encode(text, qrcode.Medium)
+	if err != nil {
+		return err
+	}
+	img, err := code.PNG(qrScale, qrBorder)
+	if err != nil {
+		return err
+	}
+
+	photo := tu.Photo(tu.ID(chatID), tu.File(tu.NameReader(bytes.NewReader(img), "qr.png"))).
+		WithCaption(caption)
+	_, err = b.bot.SendPhoto(photo)
+	return err
+}
+
+// Handle "Show QR" buttons of key and subscription messages
+func (b *Bot) handleShowQRCallback(bot *telego.Bot, update telego.Update) {
+	callbackQuery := update.CallbackQuery
+	data := callbackQuery.Data
+	chatID := callbackQuery.Message.GetChat().ID
+	username := callbackQuery.From.Username
+
+	user, err := b.db.GetUserByTelegramID(callbackQuery.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to fetch user", slog.String("error", err.Error()))
+		b.answerCallbackAlert(callbackQuery.ID, "Произошла ошибка. Попробуйте позже.")
+		return
+	}
+
+	var text, caption string
+	if data == CallbackShowQRSubscription {
+		text, err = b.subscriptionURL(user)
+		if err != nil || text == "" {
+			b.answerCallbackAlert(callbackQuery.ID, "Подписка сейчас недоступна.")
+			return
+		}
+		caption = "Подписка со всеми серверами"
+	} else {
+		serverPart, devicePart, isDevice := strings.Cut(strings.TrimPrefix(data, CallbackShowQR), "_")
+		serverID, err := strconv.ParseInt(serverPart, 10, 64)
+		var deviceID int64
+		if err == nil && isDevice {
+			deviceID, err = strconv.ParseInt(devicePart, 10, 64)
+		}
+		if err != nil {
+			b.logger.Error("Failed to parse QR callback", slog.String("data", data))
+			b.answerCallbackAlert(callbackQuery.ID, "Произошла ошибка. Попробуйте позже.")
+			return
+		}
+		var device *database.Device
+		if isDevice {
+			device, err = b.db.GetDevice(user.ID, deviceID)
+			if err != nil {
+				b.answerCallbackAlert(callbackQuery.ID, "Устройство не найдено или уже отозвано.")
+				return
+			}
+		}
+		// Same access check as for issuing the key
+		server, err := b.db.GetServerByID(serverID)
+		if err != nil || !user.CanUseServer(server) {
+			b.answerCallbackAlert(callbackQuery.ID, "Этот сервер вам недоступен.")
+			return
+		}
+		if device != nil {
+			text, err = b.sh.GetDeviceKey(server, user, device)
+		} else {
+			text, err = b.sh.GetUserKey(server, user)
+		}
+		if err != nil {
+			b.logger.Error("Failed to get user key", slog.String("error", err.Error()))
+			b.answerCallbackAlert(callbackQuery.ID, "Не удалось получить ключ. Попробуйте позже.")
+			b.NotifyAdminsOfError(username, chatID, "show_qr", err.Error(), fmt.Sprintf("Не удалось получить ключ для QR, сервер ID: %d", serverID))
+			return
+		}
+		caption = "Ключ от сервера " + serverLabel(server)
+		if device != nil {
+			caption = fmt.Sprintf("Ключ устройства «%s», сервер %s", device.Name, serverLabel(server))
+		}
+	}
+
+	err = bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: callbackQuery.ID,
+	})
+	if err != nil {
+		b.logger.Error("Failed to answer callback query", "error", err)
+	}
+
+	if err := b.sendQRPhoto(chatID, text, caption); err != nil {
+		b.logger.Error("Failed to send QR code", slog.String("error", err.Error()))
+		b.NotifyAdminsOfError(username, chatID, "show_qr", err.Error(), "Не удалось отправить QR-код")
+	}
+}
@@ -0,0 +1,273 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/x3ui"
+)
+
+const (
+	CallbackReconcile        = "reconcile_"
+	CallbackReconcileOrphans = "reconcile_orphans_"
+	CallbackReconcileMissing = "reconcile_missing_"
+	CallbackReconcileEnable  = "reconcile_enable_"
+)
+
+// reconcileListLimit caps how many emails of one kind are listed, to keep the
+// report within Telegram's message size
+const reconcileListLimit = 30
+
+// Handle /reconcile command
+func (b *Bot) handleReconcile(bot *telego.Bot, update telego.Update) {
+	if update.Message == nil {
+		b.logger.Error("Error handling reconcile command", slog.String("error", "update.Message == nil"))
+		return
+	}
+
+	message := update.Message
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	username := message.From.Username
+	args := strings.Fields(message.Text)
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, "/reconcile", strings.Join(args[1:], " "))
+
+	// Check if user is admin
+	isAdmin, err := b.db.IsUserAdmin(userID)
+	if err != nil || !isAdmin {
+		msg := tu.Message(tu.ID(chatID), "У вас нет прав для выполнения этой команды.")
+		_, _ = bot.SendMessage(msg)
+		return
+	}
+
+	var servers []database.Server
+	if len(args) > 1 {
+		serverID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Использование: /reconcile [ServerID]"))
+			return
+		}
+		server, err := b.db.GetServerByID(serverID)
+		if err != nil {
+			if errors.Is(err, database.ErrServerNotFound) {
+				_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), fmt.Sprintf("Сервер с ID %d не найден.", serverID)))
+				return
+			}
+			b.logger.Error("Failed to fetch server", slog.String("error", err.Error()))
+			_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Ошибка при получении данных сервера."))
+			return
+		}
+		servers = append(servers, *server)
+	} else {
+		servers, err = b.db.GetAllServers()
+		if err != nil {
+			b.logger.Error("Failed to fetch servers", slog.String("error", err.Error()))
+			_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось получить список серверов."))
+			b.NotifyAdminsOfError(username, chatID, "/reconcile", err.Error(), "Не удалось получить список серверов из БД")
+			return
+		}
+	}
+
+	if len(servers) == 0 {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Нет добавленных серверов."))
+		return
+	}
+
+	// One message per server, so each gets its own fix buttons
+	for i := range servers {
+		text, keyboard := b.reconcileServerMessage(&servers[i])
+		msg := tu.Message(tu.ID(chatID), text)
+		if keyboard != nil {
+			msg = msg.WithReplyMarkup(keyboard)
+		}
+		if _, err := bot.SendMessage(msg); err != nil {
+			b.logger.Error("Failed to send reconcile report", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// reconcileReport compares one server with the database
+func (b *Bot) reconcileReport(server *database.Server) (*x3ui.ReconcileReport, error) {
+	users, err := b.db.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := b.db.GetActiveIssuedKeysByServer(server.ID)
+	if err != nil {
+		return nil, err
+	}
+	return b.sh.ReconcileServer(server, users, keys)
+}
+
+// reconcileServerMessage renders the reconcile report of a server together with
+// buttons for the fixes that apply
+func (b *Bot) reconcileServerMessage(server *database.Server) (string, *telego.InlineKeyboardMarkup) {
+	header := fmt.Sprintf("%s (ID: %d)\n", serverLabel(server), server.ID)
+
+	report, err := b.reconcileReport(server)
+	if err != nil {
+		b.logger.Warn("Failed to reconcile server", slog.String("server", server.Name), slog.String("error", err.Error()))
+		return header + fmt.Sprintf("🔴 Не удалось сверить: %s", err.Error()), nil
+	}
+	if report.Clean() {
+		return header + "🟢 Расхождений нет", nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString(header)
+	writeList := func(title string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		shown := items
+		if len(shown) > reconcileListLimit {
+			shown = shown[:reconcileListLimit]
+		}
+		sb.WriteString(fmt.Sprintf("\n%s (%d): %s", title, len(items), strings.Join(shown, ", ")))
+		if len(items) > len(shown) {
+			sb.WriteString(fmt.Sprintf(" и ещё %d", len(items)-len(shown)))
+		}
+		sb.WriteString("\n")
+	}
+	missing := make([]string, 0, len(report.Missing))
+	for _, key := range report.Missing {
+		missing = append(missing, fmt.Sprintf("%s (user ID %d)", key.Email, key.UserID))
+	}
+
+	writeList("👻 Клиенты без пользователя", report.Orphans)
+	writeList("🔍 Ключи из базы, которых нет на панели", missing)
+	writeList("⛔️ Отключённые клиенты пользователей", report.Disabled)
+	writeList("📉 Остановлены панелью (лимит трафика или срок)", report.Depleted)
+	writeList("🏷 Старые клиенты по username, запустите /migrate_clients", report.Legacy)
+
+	var rows [][]telego.InlineKeyboardButton
+	if len(report.Orphans) > 0 {
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("🗑 Удалить клиентов без пользователя").WithCallbackData(fmt.Sprintf("%s%d", CallbackReconcileOrphans, server.ID)),
+		))
+	}
+	if len(report.Missing) > 0 {
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("📝 Отметить отсутствующие ключи отозванными").WithCallbackData(fmt.Sprintf("%s%d", CallbackReconcileMissing, server.ID)),
+		))
+	}
+	if len(report.Disabled) > 0 {
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("✅ Включить отключённых").WithCallbackData(fmt.Sprintf("%s%d", CallbackReconcileEnable, server.ID)),
+		))
+	}
+	if len(rows) == 0 {
+		return sb.String(), nil
+	}
+	return sb.String(), tu.InlineKeyboard(rows...)
+}
+
+// Handle the fix buttons of /reconcile. The report is rebuilt before a fix is
+// applied, so a stale message never acts on clients that changed since.
+func (b *Bot) handleReconcileCallback(bot *telego.Bot, update telego.Update) {
+	callbackQuery := update.CallbackQuery
+	data := callbackQuery.Data
+	chatID := callbackQuery.Message.GetChat().ID
+	messageID := callbackQuery.Message.GetMessageID()
+	username := callbackQuery.From.Username
+
+	// Answer the callback query to remove the loading animation
+	err := bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: callbackQuery.ID,
+	})
+	if err != nil {
+		b.logger.Error("Failed to answer callback query", "error", err)
+	}
+
+	isAdmin, err := b.db.IsUserAdmin(callbackQuery.From.ID)
+	if err != nil || !isAdmin {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "У вас нет прав для выполнения этой команды."))
+		return
+	}
+
+	var action string
+	for _, prefix := range []string{CallbackReconcileOrphans, CallbackReconcileMissing, CallbackReconcileEnable} {
+		if strings.HasPrefix(data, prefix) {
+			action = prefix
+			break
+		}
+	}
+	if action == "" {
+		return
+	}
+	serverID, err := strconv.ParseInt(strings.TrimPrefix(data, action), 10, 64)
+	if err != nil {
+		b.logger.Error("Failed to parse server ID", "error", err)
+		return
+	}
+
+	server, err := b.db.GetServerByID(serverID)
+	if err != nil {
+		b.logger.Error("Failed to fetch server", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), fmt.Sprintf("Сервер с ID %d не найден.", serverID)))
+		return
+	}
+
+	report, err := b.reconcileReport(server)
+	if err != nil {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), fmt.Sprintf("🔴 Не удалось сверить: %s", err.Error())))
+		return
+	}
+
+	inList := func(list []string) func(x3client.InboundClient) bool {
+		set := make(map[string]bool, len(list))
+		for _, email := range list {
+			set[email] = true
+		}
+		return func(client x3client.InboundClient) bool { return set[client.Email] }
+	}
+
+	var result string
+	switch action {
+	case CallbackReconcileOrphans:
+		deleted, err := b.sh.DeleteClients(server, inList(report.Orphans))
+		result = fmt.Sprintf("🗑 Удалено клиентов: %d", deleted)
+		if err != nil {
+			result += fmt.Sprintf(", ошибка: %s", err.Error())
+		}
+	case CallbackReconcileMissing:
+		marked := 0
+		for _, key := range report.Missing {
+			if err := b.db.RevokeIssuedKeys(server.ID, key.Email); err != nil {
+				b.logger.Error("Failed to mark issued key revoked", slog.String("error", err.Error()))
+				continue
+			}
+			marked++
+		}
+		result = fmt.Sprintf("📝 Отмечено отозванными: %d", marked)
+	case CallbackReconcileEnable:
+		enabled, err := b.sh.SetClientsEnabled(server, inList(report.Disabled), true)
+		result = fmt.Sprintf("✅ Включено клиентов: %d", enabled)
+		if err != nil {
+			result += fmt.Sprintf(", ошибка: %s", err.Error())
+		}
+	}
+
+	b.NotifyAdminsOfAction(username, chatID, "/reconcile", fmt.Sprintf("Сервер '%s': %s", server.Name, result))
+
+	// Show the result followed by the fresh report
+	text, keyboard := b.reconcileServerMessage(server)
+	_, err = bot.EditMessageText(&telego.EditMessageTextParams{
+		ChatID:      tu.ID(chatID),
+		MessageID:   messageID,
+		Text:        result + "\n\n" + text,
+		ReplyMarkup: keyboard,
+	})
+	if err != nil {
+		b.logger.Error("Failed to edit message", "error", err)
+	}
+}
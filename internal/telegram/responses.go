@@ -6,6 +6,6 @@ var CommandResponses = map[string]string{
 	"/help":  "Here are the available commands:\n/start - Start the bot\n/help - Show this help message",
 }
 
-var noUsernameResponse = "Ты не можешь пользоваться ботом пока у тебя нет имени пользователя. [Как это сделать](https://tinyurl.com/4hjse9w4)"
+var noUsernameResponse = "Ты не можешь пользоваться ботом пока у тебя нет имени пользователя. [Как это сделать](https://tinyurl.com/4hjse9w4)\n\nИли попроси у того, кто тебя приглашает, ссылку-приглашение."
 
-var youMustBeInvitedResponse = "Сначала тебя должен пригласить один из пользователей этого бота."
+var youMustBeInvitedResponse = "Сначала тебя должен пригласить один из пользователей этого бота: по имени пользователя или ссылкой-приглашением."
@@ -0,0 +1,554 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/x3ui"
+)
+
+const (
+	CallbackRemoveServer       = "rmserver_"
+	CallbackRemoveServerKeep   = "rmserver_keep_"
+	CallbackRemoveServerPurge  = "rmserver_purge_"
+	CallbackRemoveServerCancel = "rmserver_cancel"
+)
+
+// editableServerFields lists the fields accepted by /edit_server. Fields marked
+// as connection settings are verified against the server before they are saved.
+var editableServerFields = []struct {
+	name       string
+	connection bool
+}{
+	{"name", false},
+	{"country", false},
+	{"city", false},
+	{"reality_cover", false},
+	{"ip", true},
+	{"ssh_port", true},
+	{"ssh_user", true},
+	{"api_port", true},
+	{"username", true},
+	{"password", true},
+	{"inbound_id", true},
+}
+
+// serverLabel returns the human readable name of a server used in user messages
+func serverLabel(server *database.Server) string {
+	return fmt.Sprintf("%s %s, %s", countryToFlag(server.Country), server.Country, server.City)
+}
+
+// Handle /remove_server command
+func (b *Bot) handleRemoveServer(bot *telego.Bot, update telego.Update) {
+	if update.Message == nil {
+		b.logger.Error("Error handling remove_server command", slog.String("error", "update.Message == nil"))
+		return
+	}
+
+	message := update.Message
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	username := message.From.Username
+
+	// Notify admins about command usage
+	argsStr := strings.Join(strings.Fields(message.Text)[1:], " ")
+	b.NotifyAdminsOfCommand(username, chatID, "/remove_server", argsStr)
+
+	// Check if user is admin
+	isAdmin, err := b.db.IsUserAdmin(userID)
+	if err != nil || !isAdmin {
+		msg := tu.Message(tu.ID(chatID), "У вас нет прав для выполнения этой команды.")
+		_, _ = bot.SendMessage(msg)
+		return
+	}
+
+	args := strings.Fields(message.Text)
+	if len(args) < 2 {
+		msg := tu.Message(tu.ID(chatID), "Использование: /remove_server <ServerID>")
+		_, _ = bot.SendMessage(msg)
+		return
+	}
+
+	serverID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		msg := tu.Message(tu.ID(chatID), "ID сервера должен быть числом.")
+		_, _ = bot.SendMessage(msg)
+		return
+	}
+
+	server, err := b.db.GetServerByID(serverID)
+	if err != nil {
+		if errors.Is(err, database.ErrServerNotFound) {
+			msg := tu.Message(tu.ID(chatID), fmt.Sprintf("Сервер с ID %d не найден.", serverID))
+			_, _ = bot.SendMessage(msg)
+			return
+		}
+		b.logger.Error("Failed to fetch server", slog.String("error", err.Error()))
+		msg := tu.Message(tu.ID(chatID), "Ошибка при получении данных сервера.")
+		_, _ = bot.SendMessage(msg)
+		return
+	}
+
+	keyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("🗑 Удалить сервер").WithCallbackData(fmt.Sprintf("%s%d", CallbackRemoveServerKeep, server.ID)),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("🧹 Удалить сервер и клиентов бота").WithCallbackData(fmt.Sprintf("%s%d", CallbackRemoveServerPurge, server.ID)),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("❌ Отмена").WithCallbackData(CallbackRemoveServerCancel),
+		),
+	)
+
+	text := fmt.Sprintf(
+		"Удалить сервер '%s' (ID: %d, %s, IP: %s)?\n\n"+
+			"Соединение с сервером будет закрыто, запись удалена из базы, а пользователи с ключами от этого сервера получат уведомление.\n"+
+			"Во втором варианте бот также удалит с панели созданных им клиентов.",
+		server.Name, server.ID, serverLabel(server), server.IP,
+	)
+
+	msg := tu.Message(tu.ID(chatID), text).WithReplyMarkup(keyboard)
+	_, _ = bot.SendMessage(msg)
+}
+
+// Handle callback queries from /remove_server confirmation
+func (b *Bot) handleRemoveServerCallback(bot *telego.Bot, update telego.Update) {
+	callbackQuery := update.CallbackQuery
+	data := callbackQuery.Data
+	chatID := callbackQuery.Message.GetChat().ID
+	messageID := callbackQuery.Message.GetMessageID()
+	username := callbackQuery.From.Username
+
+	// Answer the callback query to remove the loading animation
+	err := bot.AnswerCallbackQuery(&telego.AnswerCallbackQueryParams{
+		CallbackQueryID: callbackQuery.ID,
+	})
+	if err != nil {
+		b.logger.Error("Failed to answer callback query", "error", err)
+	}
+
+	isAdmin, err := b.db.IsUserAdmin(callbackQuery.From.ID)
+	if err != nil || !isAdmin {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "У вас нет прав для выполнения этой команды."))
+		return
+	}
+
+	editText := func(text string) {
+		_, err := bot.EditMessageText(&telego.EditMessageTextParams{
+			ChatID:    tu.ID(chatID),
+			MessageID: messageID,
+			Text:      text,
+		})
+		if err != nil {
+			b.logger.Error("Failed to edit message", "error", err)
+		}
+	}
+
+	var serverID int64
+	var purge bool
+	switch {
+	case data == CallbackRemoveServerCancel:
+		editText("Удаление сервера отменено.")
+		return
+	case strings.HasPrefix(data, CallbackRemoveServerKeep):
+		serverID, err = strconv.ParseInt(strings.TrimPrefix(data, CallbackRemoveServerKeep), 10, 64)
+	case strings.HasPrefix(data, CallbackRemoveServerPurge):
+		serverID, err = strconv.ParseInt(strings.TrimPrefix(data, CallbackRemoveServerPurge), 10, 64)
+		purge = true
+	default:
+		return
+	}
+	if err != nil {
+		b.logger.Error("Failed to parse server ID", "error", err)
+		return
+	}
+
+	server, err := b.db.GetServerByID(serverID)
+	if err != nil {
+		if errors.Is(err, database.ErrServerNotFound) {
+			editText(fmt.Sprintf("Сервер с ID %d уже удалён.", serverID))
+			return
+		}
+		b.logger.Error("Failed to fetch server", slog.String("error", err.Error()))
+		editText("Ошибка при получении данных сервера.")
+		return
+	}
+
+	editText(fmt.Sprintf("Удаляю сервер '%s'...", server.Name))
+
+	report, removed := b.removeServer(server, purge)
+
+	if removed {
+		b.NotifyAdminsOfAction(username, chatID, "/remove_server", fmt.Sprintf("Удалён сервер '%s' (ID: %d)", server.Name, server.ID))
+	}
+	editText(report)
+}
+
+// removeServer tears down a server: optionally deletes the clients the bot
+// created on it, closes its connections, deletes it from the database and
+// notifies the users who had a key on it. It returns a report for the admin
+// and whether the server was removed.
+func (b *Bot) removeServer(server *database.Server, purge bool) (string, bool) {
+	var report []string
+	report = append(report, fmt.Sprintf("Сервер '%s' (ID: %d):", server.Name, server.ID))
+
+	users, err := b.db.GetAllUsers()
+	if err != nil {
+		b.logger.Error("Failed to fetch users", slog.String("error", err.Error()))
+	}
+	usersByID := make(map[int64]database.User, len(users))
+	for _, user := range users {
+		usersByID[user.ID] = user
+	}
+	owners := x3ui.NewClientOwners(users)
+	isBotClient := func(client x3client.InboundClient) bool {
+		_, ok := owners.Owner(client)
+		return ok
+	}
+
+	// Find the users who have a key on this server while the panel is still
+	// reachable, falling back to the keys the bot recorded when it is not
+	var affected []database.User
+	seen := make(map[int64]bool)
+	addAffected := func(user database.User) {
+		if !seen[user.ID] {
+			seen[user.ID] = true
+			affected = append(affected, user)
+		}
+	}
+	clients, err := b.sh.ListClients(server)
+	if err != nil {
+		b.logger.Warn("Failed to list server clients", slog.String("server", server.Name), slog.String("error", err.Error()))
+		keys, keysErr := b.db.GetActiveIssuedKeysByServer(server.ID)
+		if keysErr != nil {
+			b.logger.Error("Failed to fetch issued keys", slog.String("error", keysErr.Error()))
+			report = append(report, "⚠️ Панель недоступна, пользователей с ключами определить не удалось")
+		} else {
+			report = append(report, "⚠️ Панель недоступна, пользователи с ключами определены по базе бота")
+		}
+		for _, key := range keys {
+			if user, ok := usersByID[key.UserID]; ok {
+				addAffected(user)
+			}
+		}
+	} else {
+		for _, client := range clients {
+			if user, ok := owners.Owner(client); ok {
+				addAffected(*user)
+			}
+		}
+	}
+
+	if purge {
+		deleted, err := b.sh.DeleteClients(server, isBotClient)
+		if err != nil {
+			// Keep the server, or the remaining clients would stay on a panel the bot no longer knows
+			b.logger.Error("Failed to purge server clients", slog.String("server", server.Name), slog.String("error", err.Error()))
+			report = append(report,
+				fmt.Sprintf("🔴 Удалено клиентов: %d, ошибка: %s", deleted, err.Error()),
+				fmt.Sprintf("Сервер не удалён. Повторите /remove_server %d, когда панель будет доступна.", server.ID))
+			return strings.Join(report, "\n"), false
+		}
+		report = append(report, fmt.Sprintf("🟢 Удалено клиентов: %d", deleted))
+	}
+
+	b.sh.RemoveServer(server.ID)
+	report = append(report, "🟢 Соединения закрыты")
+
+	if err := b.db.DeleteServerByID(server.ID); err != nil && !errors.Is(err, database.ErrServerNotFound) {
+		b.logger.Error("Failed to delete server", slog.String("error", err.Error()))
+		report = append(report, fmt.Sprintf("🔴 Не удалось удалить сервер из базы: %s", err.Error()))
+		return strings.Join(report, "\n"), false
+	}
+	report = append(report, "🟢 Сервер удалён из базы")
+
+	if err := b.db.RevokeIssuedKeysByServer(server.ID); err != nil {
+		b.logger.Error("Failed to mark issued keys revoked", slog.String("error", err.Error()))
+	}
+	if err := b.db.DeletePendingRevocationsByServer(server.ID); err != nil {
+		b.logger.Error("Failed to delete pending revocations", slog.String("error", err.Error()))
+	}
+	if err := b.db.DeleteBlockedClientsByServer(server.ID); err != nil {
+		b.logger.Error("Failed to delete blocked clients", slog.String("error", err.Error()))
+	}
+	if err := b.db.DeleteTrafficCountersByServer(server.ID); err != nil {
+		b.logger.Error("Failed to delete traffic counters", slog.String("error", err.Error()))
+	}
+
+	notified := 0
+	text := fmt.Sprintf("📍 Локация %s больше недоступна. Получите ключ от другого сервера: /get_key", serverLabel(server))
+	for _, user := range affected {
+		if user.TelegramID == nil {
+			continue
+		}
+		if _, err := b.bot.SendMessage(tu.Message(tu.ID(*user.TelegramID), text)); err != nil {
+			b.logger.Error("Failed to notify user about removed server",
+				slog.String("username", user.Username),
+				slog.String("error", err.Error()))
+			continue
+		}
+		notified++
+	}
+	report = append(report, fmt.Sprintf("🟢 Уведомлено пользователей: %d из %d", notified, len(affected)))
+
+	return strings.Join(report, "\n"), true
+}
+
+// Handle /edit_server command
+func (b *Bot) handleEditServer(bot *telego.Bot, update telego.Update) {
+	if update.Message == nil {
+		b.logger.Error("Error handling edit_server command", slog.String("error", "update.Message == nil"))
+		return
+	}
+
+	message := update.Message
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	username := message.From.Username
+	args := strings.Fields(message.Text)
+	field := ""
+	if len(args) >= 3 {
+		field = strings.ToLower(args[2])
+	}
+
+	// Never echo a new panel password to the other admins
+	argsStr := strings.Join(args[1:], " ")
+	if field == "password" {
+		argsStr = strings.Join(args[1:3], " ") + " ***"
+	}
+	b.NotifyAdminsOfCommand(username, chatID, "/edit_server", argsStr)
+
+	// Check if user is admin
+	isAdmin, err := b.db.IsUserAdmin(userID)
+	if err != nil || !isAdmin {
+		msg := tu.Message(tu.ID(chatID), "У вас нет прав для выполнения этой команды.")
+		_, _ = bot.SendMessage(msg)
+		return
+	}
+
+	if len(args) < 4 {
+		fields := make([]string, 0, len(editableServerFields))
+		for _, field := range editableServerFields {
+			fields = append(fields, field.name)
+		}
+		msg := tu.Message(tu.ID(chatID), "Использование: /edit_server <ServerID> <field> <value>\n\nПоля: "+strings.Join(fields, ", "))
+		_, _ = bot.SendMessage(msg)
+		return
+	}
+
+	// Remove the panel password from the chat history as soon as it is read
+	if field == "password" {
+		err := bot.DeleteMessage(&telego.DeleteMessageParams{
+			ChatID:    tu.ID(chatID),
+			MessageID: message.MessageID,
+		})
+		if err != nil {
+			b.logger.Error("Failed to delete message with password", "error", err)
+		}
+	}
+
+	serverID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		msg := tu.Message(tu.ID(chatID), "ID сервера должен быть числом.")
+		_, _ = bot.SendMessage(msg)
+		return
+	}
+
+	server, err := b.db.GetServerByID(serverID)
+	if err != nil {
+		if errors.Is(err, database.ErrServerNotFound) {
+			msg := tu.Message(tu.ID(chatID), fmt.Sprintf("Сервер с ID %d не найден.", serverID))
+			_, _ = bot.SendMessage(msg)
+			return
+		}
+		b.logger.Error("Failed to fetch server", slog.String("error", err.Error()))
+		msg := tu.Message(tu.ID(chatID), "Ошибка при получении данных сервера.")
+		_, _ = bot.SendMessage(msg)
+		return
+	}
+
+	// Take the value as typed: a password may contain repeated or edge spaces
+	value := rawArgs(message.Text, 3)
+	if field != "password" {
+		value = strings.TrimSpace(value)
+	}
+
+	updated := *server
+	connection, err := setServerField(&updated, field, value)
+	if err != nil {
+		msg := tu.Message(tu.ID(chatID), fmt.Sprintf("Не удалось изменить поле %s: %s.", field, err.Error()))
+		_, _ = bot.SendMessage(msg)
+		return
+	}
+
+	if connection {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), fmt.Sprintf("Проверяю подключение к '%s' с новыми настройками...", server.Name)))
+		if err := b.sh.CheckServer(&updated); err != nil {
+			b.logger.Error("New server settings do not connect", slog.String("server", server.Name), slog.String("error", err.Error()))
+			msg := tu.Message(tu.ID(chatID), fmt.Sprintf("🔴 Не удалось подключиться с новыми настройками, изменения не сохранены.\nОшибка: %s", err.Error()))
+			_, _ = bot.SendMessage(msg)
+			b.NotifyAdminsOfError(username, chatID, "/edit_server", err.Error(), fmt.Sprintf("Проверка новых настроек сервера '%s' (поле %s) не прошла", server.Name, field))
+			return
+		}
+	}
+
+	if err := b.db.UpdateServer(&updated); err != nil {
+		b.logger.Error("Failed to update server", slog.String("error", err.Error()))
+		msg := tu.Message(tu.ID(chatID), "Ошибка при сохранении настроек сервера.")
+		_, _ = bot.SendMessage(msg)
+		b.NotifyAdminsOfError(username, chatID, "/edit_server", err.Error(), fmt.Sprintf("Не удалось сохранить сервер '%s'", server.Name))
+		return
+	}
+
+	result := fmt.Sprintf("🟢 Поле %s сервера '%s' обновлено.", field, updated.Name)
+	if connection {
+		if err := b.sh.ReloadServer(&updated); err != nil {
+			result += fmt.Sprintf("\n🔴 Переподключение не удалось, бот продолжит попытки в фоне: %s", err.Error())
+		} else {
+			result += "\n🟢 Соединение с сервером пересоздано."
+		}
+	}
+
+	b.NotifyAdminsOfAction(username, chatID, "/edit_server", fmt.Sprintf("Изменено поле %s сервера '%s' (ID: %d)", field, updated.Name, updated.ID))
+
+	_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), result))
+}
+
+// rawArgs returns the text after the first n whitespace-separated fields and
+// the single separator that follows them, without collapsing any whitespace
+func rawArgs(text string, n int) string {
+	rest := text
+	for i := 0; i < n; i++ {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			return ""
+		}
+		rest = rest[end:]
+	}
+	_, size := utf8.DecodeRuneInString(rest)
+	return rest[size:]
+}
+
+// setServerField parses value and assigns it to the named field of server. It
+// reports whether the field is a connection setting.
+func setServerField(server *database.Server, field, value string) (bool, error) {
+	connection := false
+	known := false
+	for _, f := range editableServerFields {
+		if f.name == field {
+			known = true
+			connection = f.connection
+			break
+		}
+	}
+	if !known {
+		return false, fmt.Errorf("неизвестное поле %s", field)
+	}
+
+	switch field {
+	case "name":
+		server.Name = value
+	case "country":
+		server.Country = value
+	case "city":
+		server.City = value
+	case "reality_cover":
+		server.RealityCover = value
+	case "ip":
+		server.IP = value
+	case "ssh_port":
+		port, err := parsePort(value)
+		if err != nil {
+			return false, err
+		}
+		server.SSHPort = port
+	case "ssh_user":
+		server.SSHUser = value
+	case "api_port":
+		port, err := parsePort(value)
+		if err != nil {
+			return false, err
+		}
+		server.APIPort = port
+	case "username":
+		server.Username = value
+	case "password":
+		server.Password = value
+	case "inbound_id":
+		// The inbound itself is looked up on the panel by CheckServer
+		id, err := strconv.Atoi(value)
+		if err != nil || id <= 0 {
+			return false, errors.New("ID inbound должен быть положительным числом")
+		}
+		server.InboundID = &id
+	}
+
+	return connection, nil
+}
+
+// Handle /migrate_clients command
+func (b *Bot) handleMigrateClients(bot *telego.Bot, update telego.Update) {
+	if update.Message == nil {
+		b.logger.Error("Error handling migrate_clients command", slog.String("error", "update.Message == nil"))
+		return
+	}
+
+	chatID := update.Message.Chat.ID
+	userID := update.Message.From.ID
+	username := update.Message.From.Username
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, "/migrate_clients", "")
+
+	// Check if user is admin
+	isAdmin, err := b.db.IsUserAdmin(userID)
+	if err != nil || !isAdmin {
+		msg := tu.Message(tu.ID(chatID), "У вас нет прав для выполнения этой команды.")
+		_, _ = bot.SendMessage(msg)
+		return
+	}
+
+	users, err := b.db.GetAllUsers()
+	if err != nil {
+		b.logger.Error("Failed to fetch users", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось получить список пользователей."))
+		b.NotifyAdminsOfError(username, chatID, "/migrate_clients", err.Error(), "Не удалось получить пользователей из БД")
+		return
+	}
+
+	results, err := b.sh.MigrateClients(users)
+	if err != nil {
+		b.logger.Error("Failed to migrate clients", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось получить список серверов."))
+		b.NotifyAdminsOfError(username, chatID, "/migrate_clients", err.Error(), "Не удалось получить серверы из БД")
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Миграция клиентов на постоянные идентификаторы:\n\n")
+	for _, result := range results {
+		sb.WriteString(serverLabel(&result.Server))
+		if result.Err != nil {
+			sb.WriteString(fmt.Sprintf(": 🔴 ошибка после %d переименований: %s\n", result.Relinked, result.Err.Error()))
+			continue
+		}
+		sb.WriteString(fmt.Sprintf(": 🟢 переименовано %d\n", result.Relinked))
+		if len(result.Duplicates) > 0 {
+			sb.WriteString(fmt.Sprintf("⚠️ Лишние клиенты (не тронуты): %s\n", strings.Join(result.Duplicates, ", ")))
+		}
+	}
+
+	b.NotifyAdminsOfAction(username, chatID, "/migrate_clients", "Выполнена миграция клиентов")
+	_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), sb.String()))
+}
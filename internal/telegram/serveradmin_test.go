@@ -0,0 +1,21 @@
+package telegram
+
+import "testing"
+
+func TestRawArgs(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"/edit_server 1 password  p a\tss ", " p a\tss "},
+		{"/edit_server 1 password secret", "secret"},
+		{"/edit_server  1   name fi-2", "fi-2"},
+		{"/edit_server 1 password", ""},
+		{"/edit_server 1", ""},
+	}
+	for _, tt := range tests {
+		if got := rawArgs(tt.text, 3); got != tt.want {
+			t.Errorf("rawArgs(%q, 3) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
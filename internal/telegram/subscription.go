@@ -0,0 +1,119 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/web"
+)
+
+// subscriptionURL returns the user's subscription URL, or "" when the
+// subscription server is not configured
+func (b *Bot) subscriptionURL(user *database.User) (string, error) {
+	if b.cfg.PublicBaseURL == "" {
+		return "", nil
+	}
+	token, err := b.db.EnsureSubscriptionToken(user)
+	if err != nil {
+		return "", err
+	}
+	return web.SubscriptionURL(b.cfg, token), nil
+}
+
+// importButtonsPerRow keeps app names readable on narrow screens
+const importButtonsPerRow = 3
+
+// importButtonRows returns buttons that open the user's subscription in each
+// supported app, or nothing when the subscription server is not configured
+func (b *Bot) importButtonRows(user *database.User) [][]telego.InlineKeyboardButton {
+	if b.cfg.PublicBaseURL == "" {
+		return nil
+	}
+	token, err := b.db.EnsureSubscriptionToken(user)
+	if err != nil {
+		b.logger.Error("Failed to prepare subscription token", slog.String("error", err.Error()))
+		return nil
+	}
+
+	var rows [][]telego.InlineKeyboardButton
+	var row []telego.InlineKeyboardButton
+	for _, app := range web.ImportApps {
+		row = append(row, tu.InlineKeyboardButton("📲 "+app.Name).WithURL(web.ImportURL(b.cfg, app, token)))
+		if len(row) == importButtonsPerRow {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Handle /subscription command
+func (b *Bot) handleSubscription(bot *telego.Bot, update telego.Update) {
+	chatID := update.Message.Chat.ID
+	username := update.Message.From.Username
+	args := strings.Fields(update.Message.Text)
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, "/subscription", strings.Join(args[1:], " "))
+
+	if b.cfg.PublicBaseURL == "" {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Подписки пока недоступны. Получить ключ от отдельного сервера: /get_key"))
+		return
+	}
+
+	user, err := b.db.GetUserByTelegramID(update.Message.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to fetch user", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Произошла ошибка. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/subscription", err.Error(), "Не удалось получить пользователя")
+		return
+	}
+
+	// A leaked link is replaced with "/subscription reset"
+	reset := len(args) > 1 && args[1] == "reset"
+	if reset {
+		_, err = b.db.ResetSubscriptionToken(user)
+	} else {
+		_, err = b.db.EnsureSubscriptionToken(user)
+	}
+	if err != nil {
+		b.logger.Error("Failed to prepare subscription token", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось создать подписку. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/subscription", err.Error(), "Не удалось создать токен подписки")
+		return
+	}
+	url := web.SubscriptionURL(b.cfg, *user.SubscriptionToken)
+
+	text := fmt.Sprintf("Ваша подписка со всеми доступными серверами:```%s```", url) +
+		escapeMarkdownV2("Добавьте её в Hiddify как профиль по ссылке или нажмите кнопку своего приложения ниже: приложение само подтянет новые серверы. "+
+			"Не делитесь ссылкой; если она попала к посторонним, получите новую командой /subscription reset")
+	if reset {
+		text = escapeMarkdownV2("Старая ссылка больше не работает. ") + text
+	}
+
+	rows := [][]telego.InlineKeyboardButton{
+		tu.InlineKeyboardRow(tu.InlineKeyboardButton("📷 Показать QR").WithCallbackData(CallbackShowQRSubscription)),
+	}
+	rows = append(rows, b.importButtonRows(user)...)
+	rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton("🏠 Домой").WithCallbackData(CallbackHelpBack)))
+	keyboard := tu.InlineKeyboard(rows...)
+	msg := tu.Message(tu.ID(chatID), text).
+		WithParseMode(telego.ModeMarkdownV2).
+		WithReplyMarkup(keyboard)
+	if _, err := bot.SendMessage(msg); err != nil {
+		b.logger.Error("Failed to send subscription message", "error", err)
+		b.NotifyAdminsOfError(username, chatID, "/subscription", err.Error(), "Не удалось отправить ссылку на подписку")
+		return
+	}
+
+	if err := b.sendQRPhoto(chatID, url, "Подписка со всеми серверами"); err != nil {
+		b.logger.Error("Failed to send QR code", slog.String("error", err.Error()))
+	}
+}
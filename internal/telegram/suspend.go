@@ -0,0 +1,131 @@
+package telegram
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// suspensionText describes a user's suspension to them
+func suspensionText(user *database.User) string {
+	text := "⛔️ Ваш доступ к VPN приостановлен"
+	if user.SuspendedUntil != nil {
+		text += " до " + user.SuspendedUntil.In(time.FixedZone("MSK", 3*60*60)).Format("02.01.2006 15:04") + " МСК"
+	}
+	text += "."
+	if user.SuspendReason != "" {
+		text += "\nПричина: " + user.SuspendReason
+	}
+	return text + "\n\nЕсли хотите что-то уточнить, отправьте сообщение без команды, и его получат администраторы."
+}
+
+// Handle /suspend command
+func (b *Bot) handleSuspend(bot *telego.Bot, update telego.Update) {
+	target := b.adminUserCommand(bot, update, "/suspend")
+	if target == nil {
+		return
+	}
+	chatID := update.Message.Chat.ID
+
+	if target.IsAdmin {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Администратора нельзя приостановить, сначала снимите права: /remove_admin"))
+		return
+	}
+
+	// The last argument is the end of the suspension if it parses as one
+	args := strings.Fields(update.Message.Text)[2:]
+	var until *time.Time
+	if len(args) > 0 {
+		if t, ok := parseUntil(args[len(args)-1], time.Now()); ok {
+			until = &t
+			args = args[:len(args)-1]
+		}
+	}
+	reason := strings.Join(args, " ")
+
+	done := "Пользователь приостановлен"
+	if until != nil {
+		done += " до " + until.In(time.FixedZone("MSK", 3*60*60)).Format("02.01.2006 15:04") + " МСК"
+	}
+	if reason != "" {
+		done += " (" + reason + ")"
+	}
+
+	suspended := *target
+	now := time.Now()
+	suspended.SuspendedAt, suspended.SuspendedUntil, suspended.SuspendReason = &now, until, reason
+	b.setUserFlag(update, "/suspend", target,
+		func() error {
+			if err := b.db.SuspendUser(target.ID, reason, until); err != nil {
+				return err
+			}
+			b.revokeInviteCodes(target)
+			// Disable the clients right away; offline servers follow when they are back
+			_, err := b.sh.SyncClients([]database.User{suspended})
+			return err
+		},
+		done,
+		suspensionText(&suspended),
+	)
+}
+
+// Handle /unsuspend command
+func (b *Bot) handleUnsuspend(bot *telego.Bot, update telego.Update) {
+	target := b.adminUserCommand(bot, update, "/unsuspend")
+	if target == nil {
+		return
+	}
+
+	if target.SuspendedAt == nil {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), fmt.Sprintf("@%s не приостановлен.", target.Username)))
+		return
+	}
+
+	b.setUserFlag(update, "/unsuspend", target,
+		func() error { return b.unsuspend(target) },
+		"Приостановка снята",
+		"✅ Ваш доступ к VPN восстановлен.",
+	)
+}
+
+// unsuspend lifts a user's suspension and turns their clients back on
+func (b *Bot) unsuspend(user *database.User) error {
+	if err := b.db.UnsuspendUser(user.ID); err != nil {
+		return err
+	}
+	lifted := *user
+	lifted.SuspendedAt, lifted.SuspendedUntil, lifted.SuspendReason = nil, nil, ""
+	_, err := b.sh.SyncClients([]database.User{lifted})
+	return err
+}
+
+// liftSuspensions ends the timed suspensions that are over
+func (b *Bot) liftSuspensions() {
+	users, err := b.db.GetAllUsers()
+	if err != nil {
+		b.logger.Error("Failed to fetch users", slog.String("error", err.Error()))
+		return
+	}
+
+	for _, user := range users {
+		if user.SuspendedAt == nil || user.Suspended() {
+			continue
+		}
+		if err := b.unsuspend(&user); err != nil {
+			b.logger.Error("Failed to lift suspension", slog.String("username", user.Username), slog.String("error", err.Error()))
+			continue
+		}
+		b.logger.Info("Suspension ended", slog.String("username", user.Username))
+		b.NotifyAdmins(fmt.Sprintf("✅ Приостановка @%s (ID: %d) закончилась, доступ восстановлен.", user.Username, user.ID))
+		if user.TelegramID != nil {
+			if _, err := b.bot.SendMessage(tu.Message(tu.ID(*user.TelegramID), "✅ Срок приостановки закончился, ваш доступ к VPN восстановлен.")); err != nil {
+				b.logger.Error("Failed to notify user", slog.String("username", user.Username), slog.String("error", err.Error()))
+			}
+		}
+	}
+}
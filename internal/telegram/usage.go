@@ -0,0 +1,143 @@
+package telegram
+
+import (
+	"fmt"
+	"html"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// usageReport builds the /my_usage message in HTML
+func (b *Bot) usageReport(user *database.User) (string, error) {
+	msk := time.FixedZone("MSK", 3*60*60)
+	if user.AccessExpired() {
+		return "Доступ: " + formatAccessExpiry(user, msk) + "\n\nКлючи отключены. Чтобы продлить доступ, напишите администратору или тому, кто вас пригласил.", nil
+	}
+
+	usage, err := b.sh.GetUserUsage(user)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().In(msk)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, msk)
+	totals, err := b.db.GetUserTrafficSince(user.ID, monthStart)
+	if err != nil {
+		return "", err
+	}
+	month := make(map[int64]int64, len(totals))
+	for _, total := range totals {
+		month[total.ServerID] = total.Up + total.Down
+	}
+	// The panel's counters start over every month, so the all-time total
+	// comes from the recorded history
+	allTime, err := b.db.GetUserTrafficSince(user.ID, time.Time{})
+	if err != nil {
+		return "", err
+	}
+	total := make(map[int64]database.TrafficTotal, len(allTime))
+	for _, t := range allTime {
+		total[t.ServerID] = t
+	}
+
+	if len(usage) == 0 {
+		return "Вам пока не доступен ни один сервер.", nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<b>Ваш трафик и ключи</b>\n")
+	sb.WriteString("Доступ: " + formatAccessExpiry(user, msk) + "\n\n")
+	for _, su := range usage {
+		sb.WriteString("<b>" + html.EscapeString(serverLabel(&su.Server)) + "</b>")
+		switch {
+		case su.Err != nil:
+			sb.WriteString(" — ⚪️ сервер недоступен\n")
+			if used, ok := month[su.Server.ID]; ok {
+				sb.WriteString(fmt.Sprintf("За этот месяц: %s\n", formatBytes(used)))
+			}
+			sb.WriteString("\n")
+			continue
+		case !su.HasKey:
+			sb.WriteString(" — ключа пока нет, получить: /get_key\n\n")
+			continue
+		case su.Online:
+			sb.WriteString(" — 🟢 подключены\n")
+		default:
+			sb.WriteString(" — ⚫️ не подключены\n")
+		}
+
+		sb.WriteString(fmt.Sprintf("Всего: ↑ %s ↓ %s\n", formatBytes(total[su.Server.ID].Up), formatBytes(total[su.Server.ID].Down)))
+		sb.WriteString(fmt.Sprintf("За этот месяц: %s\n", formatBytes(month[su.Server.ID])))
+		if su.Total > 0 {
+			sb.WriteString(fmt.Sprintf("Лимит: %s из %s\n", formatBytes(su.Up+su.Down), formatBytes(su.Total)))
+		} else {
+			sb.WriteString("Лимит: без ограничений\n")
+		}
+		sb.WriteString("Срок действия: " + formatExpiry(su.ExpiryTime, msk) + "\n\n")
+	}
+	sb.WriteString("Всего и за месяц считается с момента, когда бот начал собирать статистику.")
+	return sb.String(), nil
+}
+
+// formatAccessExpiry describes the end of the user's access period
+func formatAccessExpiry(user *database.User, loc *time.Location) string {
+	switch {
+	case user.AccessExpiresAt == nil:
+		return "бессрочно"
+	case user.AccessExpired():
+		return "закончился " + user.AccessExpiresAt.In(loc).Format("02.01.2006 15:04")
+	default:
+		return "до " + user.AccessExpiresAt.In(loc).Format("02.01.2006 15:04")
+	}
+}
+
+// formatExpiry formats a 3x-ui expiry time. Positive values are Unix
+// milliseconds; negative ones are a duration that starts on first use.
+func formatExpiry(expiryTime int64, loc *time.Location) string {
+	switch {
+	case expiryTime > 0:
+		return "до " + time.UnixMilli(expiryTime).In(loc).Format("02.01.2006")
+	case expiryTime < 0:
+		return fmt.Sprintf("%d дн. с первого подключения", -expiryTime/int64(24*time.Hour/time.Millisecond))
+	default:
+		return "бессрочно"
+	}
+}
+
+// Handle /my_usage command
+func (b *Bot) handleMyUsage(bot *telego.Bot, update telego.Update) {
+	chatID := update.Message.Chat.ID
+	username := update.Message.From.Username
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, "/my_usage", "")
+
+	user, err := b.db.GetUserByTelegramID(update.Message.From.ID)
+	if err != nil {
+		b.logger.Error("Failed to fetch user", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Произошла ошибка. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/my_usage", err.Error(), "Не удалось получить пользователя")
+		return
+	}
+
+	text, err := b.usageReport(user)
+	if err != nil {
+		b.logger.Error("Failed to build usage report", slog.String("error", err.Error()))
+		_, _ = bot.SendMessage(tu.Message(tu.ID(chatID), "Не удалось получить статистику. Попробуйте позже."))
+		b.NotifyAdminsOfError(username, chatID, "/my_usage", err.Error(), "Не удалось собрать статистику трафика")
+		return
+	}
+
+	msg := tu.Message(tu.ID(chatID), text).
+		WithParseMode(telego.ModeHTML).
+		WithReplyMarkup(backHomeKeyboard)
+	if _, err := bot.SendMessage(msg); err != nil {
+		b.logger.Error("Failed to send usage message", "error", err)
+		b.NotifyAdminsOfError(username, chatID, "/my_usage", err.Error(), "Не удалось отправить статистику")
+	}
+}
@@ -0,0 +1,374 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/x3ui"
+)
+
+// findUser resolves a command argument to a user. The argument is either a
+// username (with or without @) or a numeric ID, which is looked up as the
+// database user ID first and as a Telegram ID second.
+func (b *Bot) findUser(arg string) (*database.User, error) {
+	arg = strings.TrimPrefix(strings.TrimSpace(arg), "@")
+	if id, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		user, err := b.db.GetUserByID(id)
+		if !errors.Is(err, database.ErrUserNotFound) {
+			return user, err
+		}
+		return b.db.GetUserByTelegramID(id)
+	}
+	return b.db.GetUserByUsername(strings.ToLower(arg))
+}
+
+// isOwner reports whether the user is the bot owner from OWNER_TELEGRAM_ID
+func (b *Bot) isOwner(user *database.User) bool {
+	return b.cfg.OwnerTelegramID != 0 && user.TelegramID != nil && *user.TelegramID == b.cfg.OwnerTelegramID
+}
+
+// adminUserCommand does the common part of admin commands that act on a
+// single user: it notifies admins, checks admin rights and resolves the
+// <username|id> argument. It returns nil if the command must not proceed.
+func (b *Bot) adminUserCommand(bot *telego.Bot, update telego.Update, command string) *database.User {
+	if update.Message == nil {
+		b.logger.Error("Error handling command", slog.String("command", command), slog.String("error", "update.Message == nil"))
+		return nil
+	}
+
+	message := update.Message
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	username := message.From.Username
+	args := strings.Fields(message.Text)
+
+	// Notify admins about command usage
+	b.NotifyAdminsOfCommand(username, chatID, command, strings.Join(args[1:], " "))
+
+	// Check if user is admin
+	isAdmin, err := b.db.IsUserAdmin(userID)
+	if err != nil || !isAdmin {
+		msg := tu.Message(tu.ID(chatID), "У вас нет прав для выполнения этой команды.")
+		_, _ = bot.SendMessage(msg)
+		return nil
+	}
+
+	if len(args) < 2 {
+		msg := tu.Message(tu.ID(chatID), fmt.Sprintf("Использование: %s <username|ID>", command))
+		_, _ = bot.SendMessage(msg)
+		return nil
+	}
+
+	target, err := b.findUser(args[1])
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			msg := tu.Message(tu.ID(chatID), fmt.Sprintf("Пользователь %s не найден.", args[1]))
+			_, _ = bot.SendMessage(msg)
+			return nil
+		}
+		b.logger.Error("Failed to fetch user", slog.String("error", err.Error()))
+		msg := tu.Message(tu.ID(chatID), "Ошибка при получении пользователя.")
+		_, _ = bot.SendMessage(msg)
+		b.NotifyAdminsOfError(username, chatID, command, err.Error(), fmt.Sprintf("Не удалось получить пользователя %s", args[1]))
+		return nil
+	}
+
+	return target
+}
+
+// setUserFlag applies an admin change to a user, reports the result to the
+// admin and to the other admins, and optionally tells the user about it
+func (b *Bot) setUserFlag(update telego.Update, command string, target *database.User, apply func() error, done string, userNotice string) {
+	chatID := update.Message.Chat.ID
+	username := update.Message.From.Username
+
+	if err := apply(); err != nil {
+		b.logger.Error("Failed to update user", slog.String("command", command), slog.String("error", err.Error()))
+		_, _ = b.bot.SendMessage(tu.Message(tu.ID(chatID), "Ошибка при обновлении пользователя."))
+		b.NotifyAdminsOfError(username, chatID, command, err.Error(), fmt.Sprintf("Не удалось обновить пользователя @%s", target.Username))
+		return
+	}
+
+	b.NotifyAdminsOfAction(username, chatID, command, fmt.Sprintf("%s: @%s (ID: %d)", done, target.Username, target.ID))
+	_, _ = b.bot.SendMessage(tu.Message(tu.ID(chatID), fmt.Sprintf("%s: @%s.", done, target.Username)))
+
+	if userNotice != "" && target.TelegramID != nil {
+		if _, err := b.bot.SendMessage(tu.Message(tu.ID(*target.TelegramID), userNotice)); err != nil {
+			b.logger.Error("Failed to notify user", slog.String("username", target.Username), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// Handle /grant_exclusive command
+func (b *Bot) handleGrantExclusive(bot *telego.Bot, update telego.Update) {
+	target := b.adminUserCommand(bot, update, "/grant_exclusive")
+	if target == nil {
+		return
+	}
+	b.setUserFlag(update, "/grant_exclusive", target,
+		func() error { return b.db.UpdateUserExclusiveAccess(target.ID, true) },
+		"Выдан эксклюзивный доступ",
+		"🌟 Вам открыт доступ к эксклюзивным серверам. Получить ключ: /get_key",
+	)
+}
+
+// Handle /revoke_exclusive command
+func (b *Bot) handleRevokeExclusive(bot *telego.Bot, update telego.Update) {
+	target := b.adminUserCommand(bot, update, "/revoke_exclusive")
+	if target == nil {
+		return
+	}
+	b.setUserFlag(update, "/revoke_exclusive", target,
+		func() error { return b.db.UpdateUserExclusiveAccess(target.ID, false) },
+		"Эксклюзивный доступ отозван",
+		"",
+	)
+}
+
+// Handle /make_admin command
+func (b *Bot) handleMakeAdmin(bot *telego.Bot, update telego.Update) {
+	target := b.adminUserCommand(bot, update, "/make_admin")
+	if target == nil {
+		return
+	}
+	b.setUserFlag(update, "/make_admin", target,
+		func() error { return b.db.UpdateUserAdmin(target.ID, true) },
+		"Назначен администратором",
+		"🛡 Вы назначены администратором бота.",
+	)
+}
+
+// Handle /remove_admin command
+func (b *Bot) handleRemoveAdmin(bot *telego.Bot, update telego.Update) {
+	target := b.adminUserCommand(bot, update, "/remove_admin")
+	if target == nil {
+		return
+	}
+	if b.isOwner(target) {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), "Владельца бота нельзя лишить прав администратора."))
+		b.NotifyAdminsOfError(update.Message.From.Username, update.Message.Chat.ID, "/remove_admin", "Отказано", "Попытка снять права администратора с владельца бота")
+		return
+	}
+	b.setUserFlag(update, "/remove_admin", target,
+		func() error { return b.db.UpdateUserAdmin(target.ID, false) },
+		"Сняты права администратора",
+		"",
+	)
+}
+
+// Handle /device_limit command
+func (b *Bot) handleDeviceLimit(bot *telego.Bot, update telego.Update) {
+	target := b.adminUserCommand(bot, update, "/device_limit")
+	if target == nil {
+		return
+	}
+
+	args := strings.Fields(update.Message.Text)
+	var limit *int
+	done := fmt.Sprintf("Лимит устройств сброшен до стандартного (%d)", b.cfg.DeviceLimit)
+	if len(args) < 3 {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), "Использование: /device_limit <username|ID> <число|default>"))
+		return
+	}
+	if args[2] != "default" {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), "Лимит должен быть неотрицательным числом или default."))
+			return
+		}
+		limit = &n
+		done = fmt.Sprintf("Лимит устройств: %d", n)
+	}
+
+	b.setUserFlag(update, "/device_limit", target,
+		func() error { return b.db.UpdateUserDeviceLimit(target.ID, limit) },
+		done,
+		"",
+	)
+}
+
+// Handle /topup command
+func (b *Bot) handleTopUp(bot *telego.Bot, update telego.Update) {
+	target := b.adminUserCommand(bot, update, "/topup")
+	if target == nil {
+		return
+	}
+
+	args := strings.Fields(update.Message.Text)
+	if len(args) < 3 {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), "Использование: /topup <username|ID> <ГБ>\n\nЛимиты трафика действуют на каждый ключ отдельно: ГБ добавляются к основному ключу и к ключу каждого устройства на каждом сервере."))
+		return
+	}
+	gb, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || gb <= 0 {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), "Количество ГБ должно быть положительным числом."))
+		return
+	}
+	if b.sh.QuotaLimit(target) == 0 {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), fmt.Sprintf("У @%s безлимитный тариф, добавлять трафик не нужно.", target.Username)))
+		return
+	}
+
+	b.setUserFlag(update, "/topup", target,
+		func() error {
+			if err := b.db.AddUserTopUp(target.ID, gb*x3ui.GiB, x3ui.QuotaPeriod(time.Now())); err != nil {
+				return err
+			}
+			// Raise the limits on the panels right away instead of on the next job run
+			user, err := b.db.GetUserByID(target.ID)
+			if err != nil {
+				return err
+			}
+			_, err = b.sh.SyncClients([]database.User{*user})
+			return err
+		},
+		fmt.Sprintf("Добавлено %d ГБ трафика до конца месяца", gb),
+		fmt.Sprintf("🎁 Администратор добавил вам %d ГБ трафика до конца месяца на каждом сервере. Статистика: /my_usage", gb),
+	)
+}
+
+// Handle /extend command
+func (b *Bot) handleExtend(bot *telego.Bot, update telego.Update) {
+	target := b.adminUserCommand(bot, update, "/extend")
+	if target == nil {
+		return
+	}
+
+	args := strings.Fields(update.Message.Text)
+	if len(args) < 3 {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), "Использование: /extend <username|ID> <дни|forever>"))
+		return
+	}
+
+	var expiresAt *time.Time
+	msk := time.FixedZone("MSK", 3*60*60)
+	done := "Доступ сделан бессрочным"
+	userNotice := "✅ Ваш доступ к VPN теперь бессрочный."
+	if args[2] != "forever" {
+		days, err := strconv.Atoi(args[2])
+		if err != nil || days <= 0 {
+			_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), "Количество дней должно быть положительным числом или forever."))
+			return
+		}
+		// Extend from the current end unless access has already ended
+		from := time.Now()
+		if target.AccessExpiresAt != nil && target.AccessExpiresAt.After(from) {
+			from = *target.AccessExpiresAt
+		}
+		until := from.AddDate(0, 0, days)
+		expiresAt = &until
+		done = fmt.Sprintf("Доступ продлён на %d дн., до %s МСК", days, until.In(msk).Format("02.01.2006 15:04"))
+		userNotice = fmt.Sprintf("✅ Ваш доступ к VPN продлён до %s МСК.", until.In(msk).Format("02.01.2006 15:04"))
+	}
+
+	b.setUserFlag(update, "/extend", target,
+		func() error {
+			if err := b.db.UpdateUserAccessExpiry(target.ID, expiresAt); err != nil {
+				return err
+			}
+			// Move the expiry on the panels right away, turning stopped clients back on
+			user, err := b.db.GetUserByID(target.ID)
+			if err != nil {
+				return err
+			}
+			if expiresAt == nil {
+				return b.sh.ClearAccessExpiry([]database.User{*user})
+			}
+			_, err = b.sh.SyncClients([]database.User{*user})
+			return err
+		},
+		done,
+		userNotice,
+	)
+}
+
+// Handle /set_trust command
+func (b *Bot) handleSetTrust(bot *telego.Bot, update telego.Update) {
+	target := b.adminUserCommand(bot, update, "/set_trust")
+	if target == nil {
+		return
+	}
+
+	args := strings.Fields(update.Message.Text)
+	if len(args) < 3 {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), fmt.Sprintf(
+			"Использование: /set_trust <username|ID> <%s|%s|%s>\nСейчас у @%s: %s", TrustNew, TrustTrusted, TrustExclusive, target.Username, trustLevel(target))))
+		return
+	}
+
+	var trusted, exclusive bool
+	userNotice := ""
+	switch args[2] {
+	case TrustNew:
+	case TrustTrusted:
+		trusted = true
+		userNotice = "🤝 Вам повышен уровень доверия: теперь вы можете приглашать больше людей."
+	case TrustExclusive:
+		trusted, exclusive = true, true
+		userNotice = "🌟 Вам открыт доступ к эксклюзивным серверам и увеличен лимит приглашений. Получить ключ: /get_key"
+	default:
+		_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), fmt.Sprintf("Уровень должен быть одним из: %s, %s, %s.", TrustNew, TrustTrusted, TrustExclusive)))
+		return
+	}
+
+	done := "Уровень доверия: " + args[2]
+	if !exclusive && target.ExclusiveAccess {
+		done += " (эксклюзивный доступ сохранён, снять его: /revoke_exclusive)"
+	}
+	b.setUserFlag(update, "/set_trust", target,
+		func() error {
+			if err := b.db.UpdateUserTrust(target.ID, trusted, exclusive); err != nil {
+				return err
+			}
+			// Exclusive access changes the traffic plan, apply it to the panels right away
+			user, err := b.db.GetUserByID(target.ID)
+			if err != nil {
+				return err
+			}
+			_, err = b.sh.SyncClients([]database.User{*user})
+			return err
+		},
+		done,
+		userNotice,
+	)
+}
+
+// Handle /set_invites command
+func (b *Bot) handleSetInvites(bot *telego.Bot, update telego.Update) {
+	target := b.adminUserCommand(bot, update, "/set_invites")
+	if target == nil {
+		return
+	}
+
+	args := strings.Fields(update.Message.Text)
+	if len(args) < 3 {
+		_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), "Использование: /set_invites <username|ID> <число|default>"))
+		return
+	}
+	var budget *int
+	defaultTarget := *target
+	defaultTarget.InviteBudget = nil
+	done := fmt.Sprintf("Лимит приглашений сброшен до стандартного для уровня %s (%d)", trustLevel(target), b.inviteBudget(&defaultTarget))
+	if args[2] != "default" {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			_, _ = bot.SendMessage(tu.Message(tu.ID(update.Message.Chat.ID), "Лимит должен быть неотрицательным числом или default."))
+			return
+		}
+		budget = &n
+		done = fmt.Sprintf("Лимит приглашений: %d за %d дн.", n, b.cfg.InviteBudgetDays)
+	}
+
+	b.setUserFlag(update, "/set_invites", target,
+		func() error { return b.db.UpdateUserInviteBudget(target.ID, budget) },
+		done,
+		"",
+	)
+}
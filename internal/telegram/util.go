@@ -1,7 +1,10 @@
 package telegram
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mymmrac/telego"
 )
@@ -53,3 +56,38 @@ func escapeMarkdownV2(text string) string {
 	)
 	return replacer.Replace(text)
 }
+
+// formatBytes formats a byte count for users, in binary units
+func formatBytes(n int64) string {
+	units := []string{"Б", "КБ", "МБ", "ГБ", "ТБ"}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", n, units[0])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// parseUntil parses a moment in the future given as a duration such as 7d or
+// 12h, or as a date such as 31.12.2026, which means midnight Moscow time
+func parseUntil(arg string, now time.Time) (time.Time, bool) {
+	msk := time.FixedZone("MSK", 3*60*60)
+	if days, ok := strings.CutSuffix(arg, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return now.AddDate(0, 0, n), true
+		}
+	}
+	if d, err := time.ParseDuration(arg); err == nil && d > 0 {
+		return now.Add(d), true
+	}
+	for _, layout := range []string{"02.01.2006", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, arg, msk); err == nil && t.After(now) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,115 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+	"github.com/supercakecrumb/otvali-xray-bot/pkg/config"
+)
+
+// ImportApp is a client app that can add a subscription from a deep link
+type ImportApp struct {
+	ID   string // path segment of the import URL
+	Name string // button label
+	link func(subURL string) string
+}
+
+// ImportApps are the apps import buttons are shown for, in button order
+var ImportApps = []ImportApp{
+	{ID: "hiddify", Name: "Hiddify", link: func(subURL string) string {
+		return "hiddify://import/" + subURL + "#" + url.PathEscape(subscriptionTitle)
+	}},
+	{ID: "happ", Name: "Happ", link: func(subURL string) string {
+		return "happ://add/" + subURL
+	}},
+	{ID: "v2rayng", Name: "v2rayNG", link: func(subURL string) string {
+		return "v2rayng://install-config?url=" + url.QueryEscape(subURL) + "#" + url.PathEscape(subscriptionTitle)
+	}},
+	{ID: "streisand", Name: "Streisand", link: func(subURL string) string {
+		return "streisand://import/" + subURL + "#" + url.PathEscape(subscriptionTitle)
+	}},
+	{ID: "v2raytun", Name: "v2RayTun", link: func(subURL string) string {
+		return "v2raytun://import/" + subURL
+	}},
+}
+
+// ImportURL returns the public URL that opens the subscription in an app.
+// Telegram buttons only open http(s) links, so the bot serves a page that
+// forwards to the app's own scheme.
+func ImportURL(cfg config.Config, app ImportApp, token string) string {
+	return fmt.Sprintf("%s/import/%s/%s", cfg.PublicBaseURL, app.ID, token)
+}
+
+// findImportApp looks an app up by its ID
+func findImportApp(id string) (ImportApp, bool) {
+	for _, app := range ImportApps {
+		if app.ID == id {
+			return app, true
+		}
+	}
+	return ImportApp{}, false
+}
+
+// importPage opens the deep link right away and keeps a button for browsers
+// that only follow custom schemes on a tap
+var importPage = template.Must(template.New("import").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Открыть в {{.Name}}</title>
+<style>
+body { font-family: sans-serif; text-align: center; padding: 3em 1em; }
+a { display: inline-block; padding: .8em 1.6em; border-radius: .5em; background: #2a7ae2; color: #fff; text-decoration: none; }
+</style>
+</head>
+<body>
+<p>Открываем {{.Name}}…</p>
+<p><a href="{{.Link}}">Открыть в {{.Name}}</a></p>
+<p>Если ничего не происходит, проверьте, что приложение установлено.</p>
+<script>window.location.href = {{.Link}};</script>
+</body>
+</html>
+`))
+
+// handleImport forwards to an app's deep link for the user's subscription
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	app, ok := findImportApp(r.PathValue("app"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	token := r.PathValue("token")
+	user, err := s.db.GetUserBySubscriptionToken(token)
+	if err != nil {
+		if !errors.Is(err, database.ErrUserNotFound) {
+			s.logger.Error("Failed to fetch user by subscription token", slog.String("error", err.Error()))
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	s.logger.Info("Import link opened", slog.String("username", user.Username), slog.String("app", app.ID))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err = importPage.Execute(w, struct {
+		Name string
+		Link template.URL
+	}{
+		Name: app.Name,
+		// The scheme is ours, so the link is safe to mark as a trusted URL
+		Link: template.URL(app.link(SubscriptionURL(s.cfg, token))),
+	})
+	if err != nil {
+		s.logger.Error("Failed to render import page", slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,54 @@
+package web
+
+import (
+	"bytes"
+	"html/template"
+	"strings"
+	"testing"
+)
+
+const testSubURL = "https://vpn.example.com/sub/abc_DEF-123"
+
+func TestImportAppLinks(t *testing.T) {
+	want := map[string]string{
+		"hiddify":   "hiddify://import/https://vpn.example.com/sub/abc_DEF-123#Otvali%20VPN",
+		"happ":      "happ://add/https://vpn.example.com/sub/abc_DEF-123",
+		"v2rayng":   "v2rayng://install-config?url=https%3A%2F%2Fvpn.example.com%2Fsub%2Fabc_DEF-123#Otvali%20VPN",
+		"streisand": "streisand://import/https://vpn.example.com/sub/abc_DEF-123#Otvali%20VPN",
+		"v2raytun":  "v2raytun://import/https://vpn.example.com/sub/abc_DEF-123",
+	}
+	if len(ImportApps) != len(want) {
+		t.Fatalf("len(ImportApps) = %d, want %d", len(ImportApps), len(want))
+	}
+	for _, app := range ImportApps {
+		if got := app.link(testSubURL); got != want[app.ID] {
+			t.Errorf("%s link = %q, want %q", app.ID, got, want[app.ID])
+		}
+		if found, ok := findImportApp(app.ID); !ok || found.Name != app.Name {
+			t.Errorf("findImportApp(%q) = %v, %v", app.ID, found.Name, ok)
+		}
+	}
+	if _, ok := findImportApp("unknown"); ok {
+		t.Error("findImportApp(unknown) found an app")
+	}
+}
+
+func TestImportPageKeepsDeepLink(t *testing.T) {
+	app, _ := findImportApp("happ")
+	var buf bytes.Buffer
+	err := importPage.Execute(&buf, struct {
+		Name string
+		Link template.URL
+	}{Name: app.Name, Link: template.URL(app.link(testSubURL))})
+	if err != nil {
+		t.Fatalf("Execute returned error: %v", err)
+	}
+
+	page := buf.String()
+	if strings.Contains(page, "ZgotmplZ") {
+		t.Fatal("deep link was filtered out by html/template")
+	}
+	if !strings.Contains(page, `href="happ://add/https://vpn.example.com/sub/abc_DEF-123"`) {
+		t.Errorf("page has no button for the deep link:\n%s", page)
+	}
+}
@@ -0,0 +1,105 @@
+package web
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/x3ui"
+	"github.com/supercakecrumb/otvali-xray-bot/pkg/config"
+)
+
+// subscriptionUpdateHours is how often client apps are asked to refresh a subscription
+const subscriptionUpdateHours = 12
+
+// subscriptionTitle is the profile name client apps show for a subscription
+const subscriptionTitle = "Otvali VPN"
+
+// Server serves subscription URLs and app import links over HTTP
+type Server struct {
+	cfg    config.Config
+	db     *database.DB
+	sh     *x3ui.ServerHandler
+	logger *slog.Logger
+	srv    *http.Server
+}
+
+// SubscriptionURL returns the public subscription URL for a token
+func SubscriptionURL(cfg config.Config, token string) string {
+	return fmt.Sprintf("%s/sub/%s", cfg.PublicBaseURL, token)
+}
+
+func NewServer(cfg config.Config, logger *slog.Logger, db *database.DB, sh *x3ui.ServerHandler) *Server {
+	s := &Server{
+		cfg:    cfg,
+		db:     db,
+		sh:     sh,
+		logger: logger,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sub/{token}", s.handleSubscription)
+	mux.HandleFunc("GET /import/{app}/{token}", s.handleImport)
+
+	s.srv = &http.Server{
+		Addr:              cfg.HTTPListenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// Start serves HTTP until Shutdown is called
+func (s *Server) Start() {
+	s.logger.Info("Starting HTTP server", slog.String("addr", s.srv.Addr))
+	if err := s.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("HTTP server failed", slog.String("error", err.Error()))
+	}
+}
+
+// Shutdown stops the HTTP server, waiting for active requests to finish
+func (s *Server) Shutdown(ctx context.Context) {
+	if err := s.srv.Shutdown(ctx); err != nil {
+		s.logger.Error("Failed to shut down HTTP server", slog.String("error", err.Error()))
+	}
+}
+
+// handleSubscription serves a user's keys in the base64 v2ray subscription format
+func (s *Server) handleSubscription(w http.ResponseWriter, r *http.Request) {
+	user, err := s.db.GetUserBySubscriptionToken(r.PathValue("token"))
+	if err != nil {
+		if !errors.Is(err, database.ErrUserNotFound) {
+			s.logger.Error("Failed to fetch user by subscription token", slog.String("error", err.Error()))
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	sub, err := s.sh.BuildSubscription(user)
+	if err != nil {
+		s.logger.Error("Failed to build subscription", slog.String("username", user.Username), slog.String("error", err.Error()))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("Subscription served", slog.String("username", user.Username), slog.Int("links", len(sub.Links)))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Profile-Update-Interval", fmt.Sprint(subscriptionUpdateHours))
+	w.Header().Set("Profile-Title", "base64:"+base64.StdEncoding.EncodeToString([]byte(subscriptionTitle)))
+	w.Header().Set("Subscription-Userinfo", subscriptionUserinfo(sub))
+	_, _ = w.Write([]byte(base64.StdEncoding.EncodeToString([]byte(strings.Join(sub.Links, "\n")))))
+}
+
+// subscriptionUserinfo formats the subscription-userinfo header
+func subscriptionUserinfo(sub *x3ui.Subscription) string {
+	return fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", sub.Upload, sub.Download, sub.Total, sub.Expire)
+}
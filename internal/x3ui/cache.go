@@ -0,0 +1,60 @@
+package x3ui
+
+import (
+	"fmt"
+	"time"
+
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// inboundCacheTTL is how long an inbound list fetched from a panel is reused.
+// Writes made by the bot invalidate it right away, so the TTL only bounds how
+// long changes made in the panel itself stay invisible.
+var inboundCacheTTL = 15 * time.Second
+
+// inboundSnapshot is the inbound list of one server at a point in time
+type inboundSnapshot struct {
+	inbounds  []x3client.Inbound
+	fetchedAt time.Time
+}
+
+// listInbounds returns the server's inbounds, from the cache when it is fresh
+func (sh *ServerHandler) listInbounds(server *database.Server) ([]x3client.Inbound, error) {
+	sh.cacheMu.Lock()
+	snapshot, ok := sh.inbounds[server.ID]
+	gen := sh.inboundGen[server.ID]
+	sh.cacheMu.Unlock()
+	if ok && time.Since(snapshot.fetchedAt) < inboundCacheTTL {
+		return snapshot.inbounds, nil
+	}
+
+	x3c, exists := sh.getX3Client(server.ID)
+	if !exists {
+		return nil, fmt.Errorf("x3ui client not found for server %s", server.Name)
+	}
+
+	inbounds, err := x3c.ListInbounds()
+	if err != nil {
+		return nil, err
+	}
+
+	// A write during the fetch makes the result stale; return it, but don't cache it
+	sh.cacheMu.Lock()
+	if sh.inboundGen[server.ID] == gen {
+		sh.inbounds[server.ID] = inboundSnapshot{inbounds: inbounds, fetchedAt: time.Now()}
+	}
+	sh.cacheMu.Unlock()
+
+	return inbounds, nil
+}
+
+// invalidateInbounds drops the cached inbound list of a server and discards
+// fetches still running. It must be called after every write to the server's
+// panel.
+func (sh *ServerHandler) invalidateInbounds(serverID int64) {
+	sh.cacheMu.Lock()
+	delete(sh.inbounds, serverID)
+	sh.inboundGen[serverID]++
+	sh.cacheMu.Unlock()
+}
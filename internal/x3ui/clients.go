@@ -0,0 +1,252 @@
+package x3ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// ListClients returns the clients configured on the server's primary inbound.
+func (sh *ServerHandler) ListClients(server *database.Server) ([]x3client.InboundClient, error) {
+	inbound, err := sh.getPrimaryInbound(server)
+	if err != nil {
+		return nil, err
+	}
+	return parseInboundClients(inbound)
+}
+
+// DeleteClients removes every client of the server's primary inbound for which
+// match returns true and reports how many were deleted.
+func (sh *ServerHandler) DeleteClients(server *database.Server, match func(x3client.InboundClient) bool) (int, error) {
+	x3c, exists := sh.getX3Client(server.ID)
+	if !exists {
+		return 0, fmt.Errorf("x3ui client not found for server %s", server.Name)
+	}
+
+	inbound, err := sh.getFreshPrimaryInbound(server)
+	if err != nil {
+		return 0, err
+	}
+	clients, err := parseInboundClients(inbound)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	defer func() {
+		if deleted > 0 {
+			sh.invalidateInbounds(server.ID)
+		}
+	}()
+	for _, client := range clients {
+		if !match(client) {
+			continue
+		}
+		if err := deleteInboundClient(x3c, *server.InboundID, client.ID); err != nil {
+			sh.logger.Error("Failed to delete inbound client",
+				slog.String("server", server.Name),
+				slog.String("email", client.Email),
+				slog.String("error", err.Error()))
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// SetClientsEnabled enables or disables the clients of the server's primary
+// inbound for which match returns true and reports how many were changed.
+// Clients already in the requested state are left alone.
+func (sh *ServerHandler) SetClientsEnabled(server *database.Server, match func(x3client.InboundClient) bool, enable bool) (int, error) {
+	return sh.updateClients(server, func(client x3client.InboundClient, raw map[string]interface{}) bool {
+		if !match(client) || client.Enable == enable {
+			return false
+		}
+		raw["enable"] = enable
+		return true
+	})
+}
+
+// updateClients sends every client of the server's primary inbound for which
+// update returns true back to the panel. update changes the raw client map
+// in place. It reports how many clients were updated.
+func (sh *ServerHandler) updateClients(server *database.Server, update func(client x3client.InboundClient, raw map[string]interface{}) bool) (int, error) {
+	x3c, exists := sh.getX3Client(server.ID)
+	if !exists {
+		return 0, fmt.Errorf("x3ui client not found for server %s", server.Name)
+	}
+
+	inbound, err := sh.getFreshPrimaryInbound(server)
+	if err != nil {
+		return 0, err
+	}
+	clients, err := parseInboundClients(inbound)
+	if err != nil {
+		return 0, err
+	}
+	rawClients, err := rawInboundClients(inbound)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	defer func() {
+		if changed > 0 {
+			sh.invalidateInbounds(server.ID)
+		}
+	}()
+	for i, client := range clients {
+		if i >= len(rawClients) || !update(client, rawClients[i]) {
+			continue
+		}
+		if err := updateInboundClient(x3c, *server.InboundID, client.ID, rawClients[i]); err != nil {
+			sh.logger.Error("Failed to update inbound client",
+				slog.String("server", server.Name),
+				slog.String("email", client.Email),
+				slog.String("error", err.Error()))
+			return changed, err
+		}
+		changed++
+	}
+
+	return changed, nil
+}
+
+// ResetClientsTraffic zeroes the traffic counters of the clients of the
+// server's primary inbound for which match returns true and reports how many
+// were reset
+func (sh *ServerHandler) ResetClientsTraffic(server *database.Server, match func(x3client.InboundClient) bool) (int, error) {
+	x3c, exists := sh.getX3Client(server.ID)
+	if !exists {
+		return 0, fmt.Errorf("x3ui client not found for server %s", server.Name)
+	}
+
+	inbound, err := sh.getFreshPrimaryInbound(server)
+	if err != nil {
+		return 0, err
+	}
+	clients, err := parseInboundClients(inbound)
+	if err != nil {
+		return 0, err
+	}
+
+	reset := 0
+	defer func() {
+		if reset > 0 {
+			sh.invalidateInbounds(server.ID)
+		}
+	}()
+	for _, client := range clients {
+		if !match(client) {
+			continue
+		}
+		if err := resetClientTraffic(x3c, *server.InboundID, client.Email); err != nil {
+			sh.logger.Error("Failed to reset client traffic",
+				slog.String("server", server.Name),
+				slog.String("email", client.Email),
+				slog.String("error", err.Error()))
+			return reset, err
+		}
+		reset++
+	}
+
+	return reset, nil
+}
+
+// parseInboundClients extracts the client list from the inbound settings JSON.
+func parseInboundClients(inbound *x3client.Inbound) ([]x3client.InboundClient, error) {
+	var settings x3client.InboundSettings
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return nil, fmt.Errorf("failed to parse inbound settings: %w", err)
+	}
+	return settings.Clients, nil
+}
+
+// deleteInboundClient removes a client, identified by its UUID, from an inbound.
+// The go-x3ui client has no wrapper for this endpoint, so it is called directly.
+func deleteInboundClient(x3c *x3client.Client, inboundID int, clientID string) error {
+	resp, err := x3c.Resty.R().
+		SetHeader("Accept", "application/json").
+		Post(fmt.Sprintf("/panel/inbound/%d/delClient/%s", inboundID, url.PathEscape(clientID)))
+	if err != nil {
+		return fmt.Errorf("failed to delete client: %w", err)
+	}
+
+	var response x3client.APIResponse[interface{}]
+	if err := json.Unmarshal(resp.Body(), &response); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	if !response.Success {
+		return fmt.Errorf("delete client failed: %s", response.Msg)
+	}
+	return nil
+}
+
+// rawInboundClients extracts the clients from the inbound settings JSON as raw
+// maps, so a client can be sent back to the panel without losing fields that
+// InboundClient does not model.
+func rawInboundClients(inbound *x3client.Inbound) ([]map[string]interface{}, error) {
+	var settings struct {
+		Clients []map[string]interface{} `json:"clients"`
+	}
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return nil, fmt.Errorf("failed to parse inbound settings: %w", err)
+	}
+	return settings.Clients, nil
+}
+
+// updateInboundClient replaces a client, identified by its UUID, on an inbound.
+// Like deleteInboundClient it calls the panel endpoint directly.
+func updateInboundClient(x3c *x3client.Client, inboundID int, clientID string, client map[string]interface{}) error {
+	clientsJSON, err := json.Marshal(map[string]interface{}{
+		"clients": []map[string]interface{}{client},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal client: %w", err)
+	}
+
+	resp, err := x3c.Resty.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(map[string]interface{}{
+			"id":       inboundID,
+			"settings": string(clientsJSON),
+		}).
+		Post(fmt.Sprintf("/panel/inbound/updateClient/%s", url.PathEscape(clientID)))
+	if err != nil {
+		return fmt.Errorf("failed to update client: %w", err)
+	}
+
+	var response x3client.APIResponse[interface{}]
+	if err := json.Unmarshal(resp.Body(), &response); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	if !response.Success {
+		return fmt.Errorf("update client failed: %s", response.Msg)
+	}
+	return nil
+}
+
+// resetClientTraffic zeroes a client's traffic counters. Like deleteInboundClient
+// it calls the panel endpoint directly.
+func resetClientTraffic(x3c *x3client.Client, inboundID int, email string) error {
+	resp, err := x3c.Resty.R().
+		SetHeader("Accept", "application/json").
+		Post(fmt.Sprintf("/panel/inbound/%d/resetClientTraffic/%s", inboundID, url.PathEscape(email)))
+	if err != nil {
+		return fmt.Errorf("failed to reset client traffic: %w", err)
+	}
+
+	var response x3client.APIResponse[interface{}]
+	if err := json.Unmarshal(resp.Body(), &response); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	if !response.Success {
+		return fmt.Errorf("reset client traffic failed: %s", response.Msg)
+	}
+	return nil
+}
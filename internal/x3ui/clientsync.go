@@ -0,0 +1,209 @@
+package x3ui
+
+import (
+	"log/slog"
+	"time"
+
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// clientPlan is what the bot wants a user's clients to look like on the panel.
+// The bot only owns the limit and the expiry of existing clients while it
+// manages them, so values an admin sets by hand in the panel are kept otherwise.
+type clientPlan struct {
+	TotalGB       int64 // Traffic limit in bytes, 0 is unlimited
+	ExpiryTime    int64 // End of access in Unix milliseconds, 0 is unlimited
+	Suspended     bool  // Clients stay disabled while the user is suspended
+	ManagesTotal  bool  // TotalGB is synced to the clients: quotas are configured
+	ManagesExpiry bool  // ExpiryTime is synced to the clients: the user has an access period
+}
+
+// planFor returns the plan of a user's clients for a quota month
+func (sh *ServerHandler) planFor(user *database.User, period string) clientPlan {
+	plan := clientPlan{
+		TotalGB:      sh.quotas.Limit(user, period),
+		Suspended:    user.Suspended(),
+		ManagesTotal: sh.quotas.Enabled(),
+	}
+	if user.AccessExpiresAt != nil {
+		plan.ExpiryTime = user.AccessExpiresAt.UnixMilli()
+		plan.ManagesExpiry = true
+	}
+	return plan
+}
+
+// blocked reports whether the plan keeps the clients disabled: the user is
+// suspended or their access period is over
+func (p clientPlan) blocked(now int64) bool {
+	return p.Suspended || (p.ExpiryTime > 0 && p.ExpiryTime <= now)
+}
+
+// clientRunning reports whether a client is enabled. The panel stops clients
+// in the stats, not in the settings.
+func clientRunning(client x3client.InboundClient, cs *x3client.ClientStats) bool {
+	return client.Enable && (cs == nil || cs.Enable)
+}
+
+// clientChanges returns the fields of a client that differ from the plan.
+// Clients of blocked users are disabled. A stopped client is turned back on
+// once the plan allows it again, but only if the bot disabled it (byBot) or
+// the panel stopped it for running out of traffic or time; clients disabled
+// for any other reason, such as by hand, are left alone.
+func clientChanges(client x3client.InboundClient, cs *x3client.ClientStats, plan clientPlan, byBot bool, now int64) map[string]interface{} {
+	changes := make(map[string]interface{})
+	if plan.ManagesTotal && int64(client.TotalGB) != plan.TotalGB {
+		changes["totalGB"] = plan.TotalGB
+	}
+	if plan.ManagesExpiry && client.ExpiryTime != plan.ExpiryTime {
+		changes["expiryTime"] = plan.ExpiryTime
+	}
+
+	if plan.blocked(now) {
+		if client.Enable {
+			changes["enable"] = false
+		}
+		return changes
+	}
+	if clientRunning(client, cs) {
+		return changes
+	}
+
+	used, byPanel := int64(0), false
+	if cs != nil {
+		used = cs.Up + cs.Down
+		depleted := cs.Total > 0 && used >= cs.Total
+		timedOut := cs.ExpiryTime > 0 && cs.ExpiryTime <= now
+		byPanel = depleted || timedOut
+	}
+	if (byBot || byPanel) && (plan.TotalGB == 0 || used < plan.TotalGB) {
+		changes["enable"] = true
+	}
+	return changes
+}
+
+// SyncClients brings every client of the given users on all connected servers
+// in line with their plan: traffic limit, top-ups and access period. It
+// reports the usage of the clients that have a limit. Servers that fail are
+// logged and skipped.
+func (sh *ServerHandler) SyncClients(users []database.User) ([]QuotaUsage, error) {
+	return sh.syncClients(users, false)
+}
+
+// ClearAccessExpiry is SyncClients for users whose access period was just
+// removed: it also clears the expiry the bot wrote to their clients.
+func (sh *ServerHandler) ClearAccessExpiry(users []database.User) error {
+	_, err := sh.syncClients(users, true)
+	return err
+}
+
+// syncClients is SyncClients, also syncing the expiry of users without an
+// access period when clearExpiry is set
+func (sh *ServerHandler) syncClients(users []database.User, clearExpiry bool) ([]QuotaUsage, error) {
+	servers, err := sh.db.GetAllServers()
+	if err != nil {
+		return nil, err
+	}
+
+	var usage []QuotaUsage
+	for i := range servers {
+		if !sh.isConnected(servers[i].ID) {
+			continue
+		}
+		serverUsage, err := sh.syncServerClients(&servers[i], users, clearExpiry)
+		if err != nil {
+			sh.logger.Warn("Failed to sync clients", slog.String("server", servers[i].Name), slog.String("error", err.Error()))
+			continue
+		}
+		usage = append(usage, serverUsage...)
+	}
+
+	return usage, nil
+}
+
+// SyncServerClients is SyncClients for a single server
+func (sh *ServerHandler) SyncServerClients(server *database.Server, users []database.User) ([]QuotaUsage, error) {
+	return sh.syncServerClients(server, users, false)
+}
+
+func (sh *ServerHandler) syncServerClients(server *database.Server, users []database.User, clearExpiry bool) ([]QuotaUsage, error) {
+	owners := NewClientOwners(users)
+	now := time.Now()
+	period := QuotaPeriod(now)
+
+	stats := make(map[string]x3client.ClientStats)
+	if inbound, err := sh.getPrimaryInbound(server); err == nil {
+		for _, cs := range inbound.ClientStats {
+			stats[cs.Email] = cs
+		}
+	}
+	blocked, err := sh.db.GetBlockedClients(server.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var released []string
+	// Correct the clients first, so the usage below is measured against the plan
+	updated, err := sh.updateClients(server, func(client x3client.InboundClient, raw map[string]interface{}) bool {
+		user, ok := owners.Owner(client)
+		if !ok {
+			return false
+		}
+		var cs *x3client.ClientStats
+		if s, ok := stats[client.Email]; ok {
+			cs = &s
+		}
+		plan := sh.planFor(user, period)
+		plan.ManagesExpiry = plan.ManagesExpiry || clearExpiry
+		changes := clientChanges(client, cs, plan, blocked[client.Email], now.UnixMilli())
+		if enable, ok := changes["enable"].(bool); ok && !enable {
+			// Record the block before disabling, so the client is turned back on later
+			if err := sh.db.AddBlockedClient(server.ID, client.Email); err != nil {
+				sh.logger.Warn("Failed to record blocked client", slog.String("email", client.Email), slog.String("error", err.Error()))
+				delete(changes, "enable")
+			}
+		}
+		if blocked[client.Email] && !plan.blocked(now.UnixMilli()) && clientRunning(client, cs) {
+			// Running again since the last pass
+			released = append(released, client.Email)
+		}
+		for field, value := range changes {
+			raw[field] = value
+		}
+		return len(changes) > 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	if updated > 0 {
+		sh.logger.Info("Synced clients", slog.String("server", server.Name), slog.Int("updated", updated))
+	}
+	if err := sh.db.DeleteBlockedClients(server.ID, released); err != nil {
+		sh.logger.Warn("Failed to forget blocked clients", slog.String("server", server.Name), slog.String("error", err.Error()))
+	}
+
+	inbound, err := sh.getPrimaryInbound(server)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := parseInboundClients(inbound)
+	if err != nil {
+		return nil, err
+	}
+	emailOwners := owners.ByEmail(clients)
+	var usage []QuotaUsage
+	for _, cs := range inbound.ClientStats {
+		user, ok := emailOwners[cs.Email]
+		if !ok || cs.Total == 0 {
+			continue
+		}
+		usage = append(usage, QuotaUsage{
+			User:   *user,
+			Server: *server,
+			Email:  cs.Email,
+			Used:   cs.Up + cs.Down,
+			Limit:  cs.Total,
+		})
+	}
+	return usage, nil
+}
@@ -0,0 +1,62 @@
+package x3ui
+
+import (
+	"reflect"
+	"testing"
+
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+)
+
+func TestClientChanges(t *testing.T) {
+	const now = int64(1_790_000_000_000)
+	limited := clientPlan{TotalGB: 50 * GiB, ManagesTotal: true}
+	depleted := &x3client.ClientStats{Enable: false, Up: 20 * GiB, Down: 30 * GiB, Total: 50 * GiB}
+	timedOut := &x3client.ClientStats{Enable: false, Down: GiB, ExpiryTime: now - 1000}
+
+	tests := []struct {
+		name   string
+		client x3client.InboundClient
+		cs     *x3client.ClientStats
+		plan   clientPlan
+		byBot  bool
+		want   map[string]interface{}
+	}{
+		{"in line", x3client.InboundClient{Enable: true, TotalGB: int(50 * GiB)}, nil, limited, false, map[string]interface{}{}},
+		{"new limit", x3client.InboundClient{Enable: true}, nil, limited, false, map[string]interface{}{"totalGB": 50 * GiB}},
+		{"new expiry", x3client.InboundClient{Enable: true}, nil, clientPlan{ExpiryTime: now + 1000, ManagesExpiry: true}, false,
+			map[string]interface{}{"expiryTime": now + 1000}},
+		{"expired", x3client.InboundClient{Enable: true, ExpiryTime: now - 1000}, nil, clientPlan{ExpiryTime: now - 1000, ManagesExpiry: true}, false,
+			map[string]interface{}{"enable": false}},
+		{"suspended", x3client.InboundClient{Enable: true}, nil, clientPlan{Suspended: true}, false,
+			map[string]interface{}{"enable": false}},
+		{"suspension lifted", x3client.InboundClient{}, &x3client.ClientStats{Enable: false, Down: GiB}, clientPlan{}, true,
+			map[string]interface{}{"enable": true}},
+		{"suspended and out of traffic", x3client.InboundClient{TotalGB: int(50 * GiB)}, depleted, clientPlan{TotalGB: 50 * GiB, Suspended: true, ManagesTotal: true}, true,
+			map[string]interface{}{}},
+		{"suspension lifted out of traffic", x3client.InboundClient{TotalGB: int(50 * GiB)}, depleted, limited, true,
+			map[string]interface{}{}},
+		{"topped up", x3client.InboundClient{TotalGB: int(50 * GiB)}, depleted, clientPlan{TotalGB: 60 * GiB, ManagesTotal: true}, false,
+			map[string]interface{}{"totalGB": 60 * GiB, "enable": true}},
+		{"made unlimited", x3client.InboundClient{TotalGB: int(50 * GiB)}, depleted, clientPlan{ManagesTotal: true}, false,
+			map[string]interface{}{"totalGB": int64(0), "enable": true}},
+		{"limit set by hand", x3client.InboundClient{Enable: true, TotalGB: int(50 * GiB)}, nil, clientPlan{}, false,
+			map[string]interface{}{}},
+		{"expiry set by hand", x3client.InboundClient{Enable: true, ExpiryTime: now + 1000}, nil, clientPlan{}, false,
+			map[string]interface{}{}},
+		{"access made unlimited", x3client.InboundClient{Enable: true, ExpiryTime: now + 1000}, nil, clientPlan{ManagesExpiry: true}, false,
+			map[string]interface{}{"expiryTime": int64(0)}},
+		{"still over the limit", x3client.InboundClient{TotalGB: int(50 * GiB)}, depleted, clientPlan{TotalGB: 40 * GiB, ManagesTotal: true}, false,
+			map[string]interface{}{"totalGB": 40 * GiB}},
+		{"extended", x3client.InboundClient{ExpiryTime: now - 1000}, timedOut, clientPlan{ExpiryTime: now + 1000, ManagesExpiry: true}, false,
+			map[string]interface{}{"expiryTime": now + 1000, "enable": true}},
+		{"out of traffic", x3client.InboundClient{Enable: true, TotalGB: int(50 * GiB)}, depleted, limited, false,
+			map[string]interface{}{}},
+		{"disabled by hand", x3client.InboundClient{}, &x3client.ClientStats{Enable: false, Down: GiB}, clientPlan{}, false,
+			map[string]interface{}{}},
+	}
+	for _, tt := range tests {
+		if got := clientChanges(tt.client, tt.cs, tt.plan, tt.byBot, now); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: clientChanges() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package x3ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// VLESSOutbound holds what a client needs to connect to one VLESS Reality
+// server. It carries the same fields GenerateVLESSLink writes into a link.
+type VLESSOutbound struct {
+	Name        string
+	Server      string
+	Port        int
+	UUID        string
+	Flow        string
+	Network     string
+	Security    string
+	PublicKey   string
+	ShortID     string
+	ServerName  string
+	Fingerprint string
+}
+
+// directDomainSuffixes are sent around the proxy by the exported configs:
+// Russian sites often block foreign IPs, and there is no point in tunnelling them.
+var directDomainSuffixes = []string{"ru", "su", "xn--p1ai"}
+
+// ExportOutbounds returns the user's keys for every server they may use, in
+// the form the config generators take
+func (sh *ServerHandler) ExportOutbounds(user *database.User) ([]VLESSOutbound, error) {
+	sub, err := sh.BuildSubscription(user)
+	if err != nil {
+		return nil, err
+	}
+
+	outbounds := make([]VLESSOutbound, 0, len(sub.Links))
+	for _, link := range sub.Links {
+		outbound, err := ParseVLESSLink(link)
+		if err != nil {
+			return nil, err
+		}
+		outbounds = append(outbounds, outbound)
+	}
+	uniqueOutboundNames(outbounds)
+	return outbounds, nil
+}
+
+// ParseVLESSLink reads a link produced by GenerateVLESSLink back into its parts
+func ParseVLESSLink(link string) (VLESSOutbound, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return VLESSOutbound{}, fmt.Errorf("failed to parse vless link: %w", err)
+	}
+	if u.Scheme != "vless" || u.User == nil {
+		return VLESSOutbound{}, fmt.Errorf("not a vless link: %q", link)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return VLESSOutbound{}, fmt.Errorf("invalid port in vless link: %w", err)
+	}
+
+	query := u.Query()
+	return VLESSOutbound{
+		Name:        u.Fragment,
+		Server:      u.Hostname(),
+		Port:        port,
+		UUID:        u.User.Username(),
+		Flow:        query.Get("flow"),
+		Network:     query.Get("type"),
+		Security:    query.Get("security"),
+		PublicKey:   query.Get("pbk"),
+		ShortID:     query.Get("sid"),
+		ServerName:  query.Get("sni"),
+		Fingerprint: query.Get("fp"),
+	}, nil
+}
+
+// uniqueOutboundNames appends a counter to repeated names, since both config
+// formats refer to outbounds by name
+func uniqueOutboundNames(outbounds []VLESSOutbound) {
+	seen := make(map[string]int, len(outbounds))
+	for i := range outbounds {
+		name := outbounds[i].Name
+		seen[name]++
+		if seen[name] > 1 {
+			outbounds[i].Name = fmt.Sprintf("%s %d", name, seen[name])
+		}
+	}
+}
+
+// SingBoxConfig renders a sing-box (1.11+) client config: a TUN inbound, one
+// outbound per server with automatic selection, and direct routing for
+// private and Russian addresses
+func SingBoxConfig(outbounds []VLESSOutbound) ([]byte, error) {
+	type object = map[string]interface{}
+
+	tags := make([]string, 0, len(outbounds))
+	for _, o := range outbounds {
+		tags = append(tags, o.Name)
+	}
+
+	proxies := []interface{}{
+		object{"type": "selector", "tag": "proxy", "outbounds": append([]string{"auto"}, tags...), "default": "auto"},
+		object{"type": "urltest", "tag": "auto", "outbounds": tags, "interval": "5m"},
+	}
+	for _, o := range outbounds {
+		tls := object{
+			"enabled":     true,
+			"server_name": o.ServerName,
+			"utls":        object{"enabled": true, "fingerprint": o.Fingerprint},
+		}
+		if o.Security == "reality" {
+			tls["reality"] = object{"enabled": true, "public_key": o.PublicKey, "short_id": o.ShortID}
+		}
+		outbound := object{
+			"type":        "vless",
+			"tag":         o.Name,
+			"server":      o.Server,
+			"server_port": o.Port,
+			"uuid":        o.UUID,
+			"tls":         tls,
+		}
+		if o.Flow != "" {
+			outbound["flow"] = o.Flow
+		}
+		proxies = append(proxies, outbound)
+	}
+	proxies = append(proxies, object{"type": "direct", "tag": "direct"})
+
+	config := object{
+		"log": object{"level": "warn"},
+		"dns": object{
+			"servers": []interface{}{
+				object{"tag": "remote", "address": "https://1.1.1.1/dns-query", "detour": "proxy"},
+				object{"tag": "local", "address": "https://77.88.8.8/dns-query", "detour": "direct"},
+			},
+			"rules": []interface{}{
+				object{"domain_suffix": directDomainSuffixes, "server": "local"},
+			},
+			"final":    "remote",
+			"strategy": "prefer_ipv4",
+		},
+		"inbounds": []interface{}{
+			object{"type": "tun", "tag": "tun-in", "address": []string{"172.19.0.1/30"}, "auto_route": true, "strict_route": true, "stack": "system"},
+			object{"type": "mixed", "tag": "mixed-in", "listen": "127.0.0.1", "listen_port": 2080},
+		},
+		"outbounds": proxies,
+		"route": object{
+			"rule_set": []interface{}{
+				object{
+					"tag":             "geoip-ru",
+					"type":            "remote",
+					"format":          "binary",
+					"url":             "https://raw.githubusercontent.com/SagerNet/sing-geoip/rule-set/geoip-ru.srs",
+					"download_detour": "proxy",
+				},
+			},
+			"rules": []interface{}{
+				object{"action": "sniff"},
+				object{"protocol": "dns", "action": "hijack-dns"},
+				object{"ip_is_private": true, "outbound": "direct"},
+				object{"domain_suffix": directDomainSuffixes, "outbound": "direct"},
+				object{"rule_set": []string{"geoip-ru"}, "outbound": "direct"},
+			},
+			"final":                 "proxy",
+			"auto_detect_interface": true,
+		},
+	}
+
+	return json.MarshalIndent(config, "", "  ")
+}
+
+// ClashMetaConfig renders a Clash Meta (mihomo) profile with the same
+// servers and routing as SingBoxConfig
+func ClashMetaConfig(outbounds []VLESSOutbound) []byte {
+	var sb strings.Builder
+	line := func(indent int, format string, args ...interface{}) {
+		sb.WriteString(strings.Repeat("  ", indent))
+		sb.WriteString(fmt.Sprintf(format, args...))
+		sb.WriteString("\n")
+	}
+
+	line(0, "mixed-port: 7890")
+	line(0, "allow-lan: false")
+	line(0, "mode: rule")
+	line(0, "log-level: warning")
+	line(0, "ipv6: true")
+	line(0, "dns:")
+	line(1, "enable: true")
+	line(1, "enhanced-mode: fake-ip")
+	line(1, "default-nameserver: [77.88.8.8, 1.1.1.1]")
+	line(1, "nameserver: [%s]", yamlString("https://1.1.1.1/dns-query"))
+	line(1, "nameserver-policy:")
+	for _, suffix := range directDomainSuffixes {
+		line(2, "%s: %s", yamlString("+."+suffix), yamlString("https://77.88.8.8/dns-query"))
+	}
+	line(0, "tun:")
+	line(1, "enable: true")
+	line(1, "stack: system")
+	line(1, "auto-route: true")
+	line(1, "auto-detect-interface: true")
+	line(1, "dns-hijack: [%s]", yamlString("any:53"))
+
+	line(0, "proxies:")
+	names := make([]string, 0, len(outbounds))
+	for _, o := range outbounds {
+		names = append(names, yamlString(o.Name))
+		line(1, "- name: %s", yamlString(o.Name))
+		line(2, "type: vless")
+		line(2, "server: %s", yamlString(o.Server))
+		line(2, "port: %d", o.Port)
+		line(2, "uuid: %s", yamlString(o.UUID))
+		line(2, "network: %s", yamlString(o.Network))
+		line(2, "udp: true")
+		line(2, "tls: true")
+		if o.Flow != "" {
+			line(2, "flow: %s", yamlString(o.Flow))
+		}
+		line(2, "servername: %s", yamlString(o.ServerName))
+		line(2, "client-fingerprint: %s", yamlString(o.Fingerprint))
+		if o.Security == "reality" {
+			line(2, "reality-opts:")
+			line(3, "public-key: %s", yamlString(o.PublicKey))
+			line(3, "short-id: %s", yamlString(o.ShortID))
+		}
+	}
+
+	line(0, "proxy-groups:")
+	line(1, "- name: PROXY")
+	line(2, "type: select")
+	line(2, "proxies: [auto, %s]", strings.Join(names, ", "))
+	line(1, "- name: auto")
+	line(2, "type: url-test")
+	line(2, "url: %s", yamlString("https://www.gstatic.com/generate_204"))
+	line(2, "interval: 300")
+	line(2, "proxies: [%s]", strings.Join(names, ", "))
+
+	line(0, "rules:")
+	for _, suffix := range directDomainSuffixes {
+		line(1, "- DOMAIN-SUFFIX,%s,DIRECT", suffix)
+	}
+	line(1, "- GEOIP,private,DIRECT,no-resolve")
+	line(1, "- GEOIP,RU,DIRECT")
+	line(1, "- MATCH,PROXY")
+
+	return []byte(sb.String())
+}
+
+// yamlString quotes a string for YAML. A JSON string is a valid YAML
+// double-quoted scalar.
+func yamlString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
@@ -0,0 +1,107 @@
+package x3ui
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testVLESSLink = "vless://11111111-2222-3333-4444-555555555555@fi.example.com:443" +
+	"?flow=xtls-rprx-vision&fp=chrome&pbk=publickey123&security=reality&sid=0a1b&sni=example.com&spx=%2F&type=tcp" +
+	"#Finland, Helsinki"
+
+func TestParseVLESSLink(t *testing.T) {
+	got, err := ParseVLESSLink(testVLESSLink)
+	if err != nil {
+		t.Fatalf("ParseVLESSLink returned error: %v", err)
+	}
+
+	want := VLESSOutbound{
+		Name:        "Finland, Helsinki",
+		Server:      "fi.example.com",
+		Port:        443,
+		UUID:        "11111111-2222-3333-4444-555555555555",
+		Flow:        "xtls-rprx-vision",
+		Network:     "tcp",
+		Security:    "reality",
+		PublicKey:   "publickey123",
+		ShortID:     "0a1b",
+		ServerName:  "example.com",
+		Fingerprint: "chrome",
+	}
+	if got != want {
+		t.Errorf("ParseVLESSLink() = %+v, want %+v", got, want)
+	}
+
+	if _, err := ParseVLESSLink("vmess://abc@host:443"); err == nil {
+		t.Error("expected an error for a non-vless link, got nil")
+	}
+}
+
+func TestUniqueOutboundNames(t *testing.T) {
+	outbounds := []VLESSOutbound{{Name: "A"}, {Name: "B"}, {Name: "A"}}
+	uniqueOutboundNames(outbounds)
+	if outbounds[2].Name != "A 2" {
+		t.Errorf("repeated name = %q, want %q", outbounds[2].Name, "A 2")
+	}
+}
+
+func TestSingBoxConfig(t *testing.T) {
+	outbound, _ := ParseVLESSLink(testVLESSLink)
+	data, err := SingBoxConfig([]VLESSOutbound{outbound})
+	if err != nil {
+		t.Fatalf("SingBoxConfig returned error: %v", err)
+	}
+
+	var config struct {
+		Outbounds []struct {
+			Type       string `json:"type"`
+			Tag        string `json:"tag"`
+			ServerPort int    `json:"server_port"`
+			UUID       string `json:"uuid"`
+			TLS        struct {
+				Reality struct {
+					PublicKey string `json:"public_key"`
+					ShortID   string `json:"short_id"`
+				} `json:"reality"`
+			} `json:"tls"`
+		} `json:"outbounds"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("config is not valid JSON: %v", err)
+	}
+
+	found := false
+	for _, o := range config.Outbounds {
+		if o.Type != "vless" {
+			continue
+		}
+		found = true
+		if o.Tag != outbound.Name || o.ServerPort != 443 || o.UUID != outbound.UUID {
+			t.Errorf("unexpected vless outbound: %+v", o)
+		}
+		if o.TLS.Reality.PublicKey != "publickey123" || o.TLS.Reality.ShortID != "0a1b" {
+			t.Errorf("unexpected reality settings: %+v", o.TLS.Reality)
+		}
+	}
+	if !found {
+		t.Error("no vless outbound in config")
+	}
+}
+
+func TestClashMetaConfig(t *testing.T) {
+	outbound, _ := ParseVLESSLink(testVLESSLink)
+	config := string(ClashMetaConfig([]VLESSOutbound{outbound}))
+
+	for _, want := range []string{
+		`  - name: "Finland, Helsinki"`,
+		`    uuid: "11111111-2222-3333-4444-555555555555"`,
+		`      public-key: "publickey123"`,
+		`    proxies: [auto, "Finland, Helsinki"]`,
+		`  - MATCH,PROXY`,
+	} {
+		if !strings.Contains(config, want+"\n") {
+			t.Errorf("config is missing line %q:\n%s", want, config)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package x3ui
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// ClientEmail returns the panel client email for a Telegram user. It is derived
+// from the Telegram ID so it survives username changes; the display name lives
+// in database.User.Username.
+func ClientEmail(telegramID int64) string {
+	return fmt.Sprintf("tg%d", telegramID)
+}
+
+// DeviceClientEmail returns the panel client email of one of a user's devices
+func DeviceClientEmail(telegramID, deviceID int64) string {
+	return fmt.Sprintf("%s-d%d", ClientEmail(telegramID), deviceID)
+}
+
+// deviceEmailPrefix is what every device client email of a user starts with
+func deviceEmailPrefix(telegramID int64) string {
+	return ClientEmail(telegramID) + "-d"
+}
+
+// OwnerClientEmail strips the device suffix from a device client email, so
+// device clients can be traced back to their user. Other emails are returned
+// unchanged.
+func OwnerClientEmail(email string) string {
+	i := strings.LastIndex(email, "-d")
+	if i <= 0 || i+2 == len(email) {
+		return email
+	}
+	for _, r := range email[i+2:] {
+		if r < '0' || r > '9' {
+			return email
+		}
+	}
+	return email[:i]
+}
+
+// EmailTelegramID returns the Telegram ID encoded in a stable or device client
+// email. ok is false for any other email, such as a legacy username.
+func EmailTelegramID(email string) (telegramID int64, ok bool) {
+	digits, found := strings.CutPrefix(OwnerClientEmail(email), "tg")
+	if !found || digits == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || ClientEmail(id) != OwnerClientEmail(email) {
+		return 0, false
+	}
+	return id, true
+}
+
+// ClientOwnedBy is the one rule for whether a panel client belongs to a user.
+// A stable or device email belongs to the Telegram ID it is derived from, and
+// a client with a tgId to that Telegram ID. Only a client with neither, issued
+// before clients were keyed by Telegram ID, is matched by username: usernames
+// can be taken over, so a username match with someone else's tgId is not the
+// user's.
+func ClientOwnedBy(client x3client.InboundClient, username string, telegramID *int64) bool {
+	if id, ok := EmailTelegramID(client.Email); ok {
+		return telegramID != nil && id == *telegramID
+	}
+	if client.TgID.Value != nil {
+		return telegramID != nil && *client.TgID.Value == *telegramID
+	}
+	return username != "" && strings.EqualFold(client.Email, username)
+}
+
+// ClientOwners finds the users panel clients belong to, by ClientOwnedBy
+type ClientOwners struct {
+	byTelegramID map[int64]*database.User
+	byUsername   map[string]*database.User
+}
+
+// NewClientOwners indexes users for finding the owners of their clients
+func NewClientOwners(users []database.User) *ClientOwners {
+	owners := &ClientOwners{
+		byTelegramID: make(map[int64]*database.User, len(users)),
+		byUsername:   make(map[string]*database.User, len(users)),
+	}
+	for i := range users {
+		owners.byUsername[strings.ToLower(users[i].Username)] = &users[i]
+		if users[i].TelegramID != nil {
+			owners.byTelegramID[*users[i].TelegramID] = &users[i]
+		}
+	}
+	return owners
+}
+
+// Owner returns the user a client belongs to
+func (o *ClientOwners) Owner(client x3client.InboundClient) (*database.User, bool) {
+	var user *database.User
+	if id, ok := EmailTelegramID(client.Email); ok {
+		user = o.byTelegramID[id]
+	} else if client.TgID.Value != nil {
+		user = o.byTelegramID[*client.TgID.Value]
+	} else {
+		user = o.byUsername[strings.ToLower(client.Email)]
+	}
+	if user == nil || !ClientOwnedBy(client, user.Username, user.TelegramID) {
+		return nil, false
+	}
+	return user, true
+}
+
+// ByEmail maps the emails of an inbound's clients to their owners, for panel
+// data that only carries the email, such as client stats
+func (o *ClientOwners) ByEmail(clients []x3client.InboundClient) map[string]*database.User {
+	owners := make(map[string]*database.User, len(clients))
+	for _, client := range clients {
+		if user, ok := o.Owner(client); ok {
+			owners[client.Email] = user
+		}
+	}
+	return owners
+}
+
+// isLegacyClient reports whether a client was issued for the user before
+// clients were keyed by Telegram ID, that is it belongs to the user but does
+// not have their stable or a device email
+func isLegacyClient(client x3client.InboundClient, user *database.User) bool {
+	if user.TelegramID == nil || OwnerClientEmail(client.Email) == ClientEmail(*user.TelegramID) {
+		return false
+	}
+	return ClientOwnedBy(client, user.Username, user.TelegramID)
+}
+
+// relinkClient renames a legacy client to the user's stable email. The UUID is
+// kept, so keys already in use keep working.
+func (sh *ServerHandler) relinkClient(server *database.Server, x3c *x3client.Client, inbound *x3client.Inbound, clientID string, telegramID int64) error {
+	clients, err := rawInboundClients(inbound)
+	if err != nil {
+		return err
+	}
+
+	for _, client := range clients {
+		if id, _ := client["id"].(string); id != clientID {
+			continue
+		}
+		oldEmail, _ := client["email"].(string)
+		client["email"] = ClientEmail(telegramID)
+		client["tgId"] = telegramID
+		err := updateInboundClient(x3c, *server.InboundID, clientID, client)
+		sh.invalidateInbounds(server.ID)
+		if err != nil {
+			return err
+		}
+		sh.logger.Info("Relinked client to stable email",
+			slog.String("server", server.Name),
+			slog.String("old_email", oldEmail),
+			slog.String("email", ClientEmail(telegramID)))
+		return nil
+	}
+
+	return fmt.Errorf("client %s not found in inbound", clientID)
+}
+
+// MigrationResult reports what MigrateClients did on one server
+type MigrationResult struct {
+	Server     database.Server
+	Relinked   int
+	Duplicates []string // Extra legacy clients left untouched, by email
+	Err        error
+}
+
+// MigrateClients renames the legacy clients of every user to the stable email
+// scheme. If a user has several legacy clients on a server (one per username
+// they had), the one matching the current username is relinked and the rest
+// are reported. Running it again is a no-op.
+func (sh *ServerHandler) MigrateClients(users []database.User) ([]MigrationResult, error) {
+	servers, err := sh.db.GetAllServers()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]MigrationResult, 0, len(servers))
+	for _, server := range servers {
+		result := MigrationResult{Server: server}
+		result.Relinked, result.Duplicates, result.Err = sh.migrateServerClients(&server, users)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (sh *ServerHandler) migrateServerClients(server *database.Server, users []database.User) (int, []string, error) {
+	if server.InboundID == nil {
+		return 0, nil, errors.New("primary inbound not set")
+	}
+	x3c, exists := sh.getX3Client(server.ID)
+	if !exists {
+		return 0, nil, fmt.Errorf("x3ui client not found for server %s", server.Name)
+	}
+
+	inbound, err := sh.getFreshPrimaryInbound(server)
+	if err != nil {
+		return 0, nil, err
+	}
+	clients, err := parseInboundClients(inbound)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	relinked := 0
+	var duplicates []string
+	for i := range users {
+		user := &users[i]
+		if user.TelegramID == nil {
+			continue
+		}
+
+		var legacy []x3client.InboundClient
+		hasStable := false
+		for _, client := range clients {
+			if client.Email == ClientEmail(*user.TelegramID) {
+				hasStable = true
+			} else if isLegacyClient(client, user) {
+				legacy = append(legacy, client)
+			}
+		}
+		if len(legacy) == 0 {
+			continue
+		}
+
+		// Prefer the client issued under the current username
+		keep := -1
+		if !hasStable {
+			keep = 0
+			for j, client := range legacy {
+				if strings.EqualFold(client.Email, user.Username) {
+					keep = j
+					break
+				}
+			}
+			if err := sh.relinkClient(server, x3c, inbound, legacy[keep].ID, *user.TelegramID); err != nil {
+				return relinked, duplicates, err
+			}
+			relinked++
+		}
+
+		for j, client := range legacy {
+			if j != keep {
+				duplicates = append(duplicates, client.Email)
+			}
+		}
+	}
+
+	return relinked, duplicates, nil
+}
@@ -0,0 +1,134 @@
+package x3ui
+
+import (
+	"testing"
+
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+func TestIsLegacyClient(t *testing.T) {
+	tgID := int64(42)
+	otherID := int64(7)
+	user := &database.User{Username: "alice", TelegramID: &tgID}
+
+	tests := []struct {
+		name   string
+		client x3client.InboundClient
+		want   bool
+	}{
+		{"stable email", x3client.InboundClient{Email: "tg42"}, false},
+		{"device client", x3client.InboundClient{Email: "tg42-d3", TgID: x3client.FlexibleInt64{Value: &tgID}}, false},
+		{"current username", x3client.InboundClient{Email: "Alice"}, true},
+		{"old username by tgId", x3client.InboundClient{Email: "alice_old", TgID: x3client.FlexibleInt64{Value: &tgID}}, true},
+		{"recycled username", x3client.InboundClient{Email: "alice", TgID: x3client.FlexibleInt64{Value: &otherID}}, false},
+		{"someone else", x3client.InboundClient{Email: "bob", TgID: x3client.FlexibleInt64{Value: &otherID}}, false},
+		{"no tgId", x3client.InboundClient{Email: "bob"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLegacyClient(tt.client, user); got != tt.want {
+				t.Errorf("isLegacyClient(%q) = %v, want %v", tt.client.Email, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOwnerClientEmail(t *testing.T) {
+	tests := map[string]string{
+		DeviceClientEmail(42, 3): "tg42",
+		"tg42":                   "tg42",
+		"tg42-d":                 "tg42-d",
+		"tg42-dx":                "tg42-dx",
+		"bob-d12":                "bob",
+		"-d1":                    "-d1",
+	}
+	for email, want := range tests {
+		if got := OwnerClientEmail(email); got != want {
+			t.Errorf("OwnerClientEmail(%q) = %q, want %q", email, got, want)
+		}
+	}
+}
+
+func TestClientMatcher(t *testing.T) {
+	tgID := int64(42)
+	otherID := int64(7)
+
+	tests := []struct {
+		name       string
+		email      string
+		telegramID *int64
+		client     x3client.InboundClient
+		want       bool
+	}{
+		{"username without tgId", "alice", &tgID, x3client.InboundClient{Email: "Alice"}, true},
+		{"username with own tgId", "alice", &tgID, x3client.InboundClient{Email: "alice", TgID: x3client.FlexibleInt64{Value: &tgID}}, true},
+		{"recycled username", "alice", &tgID, x3client.InboundClient{Email: "alice", TgID: x3client.FlexibleInt64{Value: &otherID}}, false},
+		{"recycled username, no Telegram ID", "alice", nil, x3client.InboundClient{Email: "alice", TgID: x3client.FlexibleInt64{Value: &otherID}}, false},
+		{"stable email", "alice", &tgID, x3client.InboundClient{Email: "tg42"}, true},
+		{"device client", "alice", &tgID, x3client.InboundClient{Email: "tg42-d3", TgID: x3client.FlexibleInt64{Value: &tgID}}, true},
+		{"old username by tgId", "alice", &tgID, x3client.InboundClient{Email: "alice_old", TgID: x3client.FlexibleInt64{Value: &tgID}}, true},
+		{"device revocation", "tg42-d3", nil, x3client.InboundClient{Email: "tg42-d3", TgID: x3client.FlexibleInt64{Value: &tgID}}, true},
+		{"other device", "tg42-d3", nil, x3client.InboundClient{Email: "tg42-d4", TgID: x3client.FlexibleInt64{Value: &tgID}}, false},
+		{"someone else", "alice", &tgID, x3client.InboundClient{Email: "bob", TgID: x3client.FlexibleInt64{Value: &otherID}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientMatcher(tt.email, tt.telegramID)(tt.client); got != tt.want {
+				t.Errorf("clientMatcher(%q)(%q) = %v, want %v", tt.email, tt.client.Email, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmailTelegramID(t *testing.T) {
+	tests := map[string]int64{
+		"tg42":                   42,
+		DeviceClientEmail(42, 3): 42,
+		"tg":                     0,
+		"tg42x":                  0,
+		"tg042":                  0,
+		"alice":                  0,
+	}
+	for email, want := range tests {
+		got, ok := EmailTelegramID(email)
+		if ok != (want != 0) || got != want {
+			t.Errorf("EmailTelegramID(%q) = %d, %v, want %d", email, got, ok, want)
+		}
+	}
+}
+
+func TestClientOwners(t *testing.T) {
+	aliceID, bobID, otherID := int64(42), int64(7), int64(99)
+	owners := NewClientOwners([]database.User{
+		{ID: 1, Username: "alice", TelegramID: &aliceID},
+		{ID: 2, Username: "bob", TelegramID: &bobID},
+		{ID: 3, Username: "carol"},
+	})
+
+	tests := []struct {
+		name   string
+		client x3client.InboundClient
+		want   int64 // User.ID, 0 for no owner
+	}{
+		{"stable email", x3client.InboundClient{Email: "tg42"}, 1},
+		{"device client", x3client.InboundClient{Email: "tg7-d2", TgID: x3client.FlexibleInt64{Value: &bobID}}, 2},
+		{"legacy username", x3client.InboundClient{Email: "Alice"}, 1},
+		{"old username by tgId", x3client.InboundClient{Email: "bob_old", TgID: x3client.FlexibleInt64{Value: &bobID}}, 2},
+		{"recycled username", x3client.InboundClient{Email: "alice", TgID: x3client.FlexibleInt64{Value: &otherID}}, 0},
+		{"user without Telegram ID", x3client.InboundClient{Email: "carol"}, 3},
+		{"unknown stable email", x3client.InboundClient{Email: "tg99"}, 0},
+	}
+	for _, tt := range tests {
+		user, ok := owners.Owner(tt.client)
+		got := int64(0)
+		if ok {
+			got = user.ID
+		}
+		if got != tt.want {
+			t.Errorf("%s: Owner(%q) = %d, want %d", tt.name, tt.client.Email, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package x3ui
+
+import (
+	"time"
+
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// GiB is the unit quotas are configured in
+const GiB int64 = 1 << 30
+
+// quotaLocation is the time zone quota months start in
+var quotaLocation = time.FixedZone("MSK", 3*60*60)
+
+// Quotas are the monthly traffic plans, in bytes per key and server. Zero
+// means unlimited.
+type Quotas struct {
+	Default   int64 // Invited users
+	Exclusive int64 // Users with exclusive access
+}
+
+// Enabled reports whether any plan has a limit. Without one the bot leaves
+// the traffic limits of existing clients to the admins.
+func (q Quotas) Enabled() bool {
+	return q.Default != 0 || q.Exclusive != 0
+}
+
+// QuotaPeriod returns the quota month a moment belongs to, as 2006-01
+func QuotaPeriod(t time.Time) string {
+	return t.In(quotaLocation).Format("2006-01")
+}
+
+// QuotaPeriodStart returns the start of the quota month a moment belongs to
+func QuotaPeriodStart(t time.Time) time.Time {
+	t = t.In(quotaLocation)
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, quotaLocation)
+}
+
+// Limit returns the user's traffic limit for a month: the plan, plus the
+// top-up granted for that month. Zero means unlimited.
+func (q Quotas) Limit(user *database.User, period string) int64 {
+	limit := q.Default
+	if user.ExclusiveAccess {
+		limit = q.Exclusive
+	}
+	if limit == 0 {
+		return 0
+	}
+	if user.QuotaTopUpPeriod == period {
+		limit += user.QuotaTopUp
+	}
+	return limit
+}
+
+// QuotaLimit returns the user's traffic limit for the current month
+func (sh *ServerHandler) QuotaLimit(user *database.User) int64 {
+	return sh.quotas.Limit(user, QuotaPeriod(time.Now()))
+}
+
+// QuotaUsage is the traffic of one client with a limit
+type QuotaUsage struct {
+	User   database.User
+	Server database.Server
+	Email  string
+	Used   int64 // Bytes since the last reset
+	Limit  int64 // Bytes
+}
+
+// ResetUsersTraffic zeroes the traffic counters of the given users' clients on
+// a server, for the monthly quota reset
+func (sh *ServerHandler) ResetUsersTraffic(server *database.Server, users []database.User) (int, error) {
+	owners := NewClientOwners(users)
+	return sh.ResetClientsTraffic(server, func(client x3client.InboundClient) bool {
+		_, ok := owners.Owner(client)
+		return ok
+	})
+}
@@ -0,0 +1,46 @@
+package x3ui
+
+import (
+	"testing"
+	"time"
+
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+func TestQuotasLimit(t *testing.T) {
+	q := Quotas{Default: 50 * GiB, Exclusive: 200 * GiB}
+
+	tests := []struct {
+		name string
+		user database.User
+		want int64
+	}{
+		{"invited", database.User{}, 50 * GiB},
+		{"exclusive", database.User{ExclusiveAccess: true}, 200 * GiB},
+		{"top-up this month", database.User{QuotaTopUp: 10 * GiB, QuotaTopUpPeriod: "2026-10"}, 60 * GiB},
+		{"top-up last month", database.User{QuotaTopUp: 10 * GiB, QuotaTopUpPeriod: "2026-09"}, 50 * GiB},
+	}
+	for _, tt := range tests {
+		if got := q.Limit(&tt.user, "2026-10"); got != tt.want {
+			t.Errorf("%s: Limit() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// A top-up does not turn an unlimited plan into a limited one
+	unlimited := Quotas{Default: 0, Exclusive: 200 * GiB}
+	if got := unlimited.Limit(&database.User{QuotaTopUp: GiB, QuotaTopUpPeriod: "2026-10"}, "2026-10"); got != 0 {
+		t.Errorf("unlimited plan with top-up: Limit() = %d, want 0", got)
+	}
+}
+
+func TestQuotaPeriod(t *testing.T) {
+	// 22:30 UTC on September 30th is already October in Moscow
+	moment := time.Date(2026, 9, 30, 22, 30, 0, 0, time.UTC)
+	if got := QuotaPeriod(moment); got != "2026-10" {
+		t.Errorf("QuotaPeriod() = %q, want 2026-10", got)
+	}
+	want := time.Date(2026, 9, 30, 21, 0, 0, 0, time.UTC)
+	if got := QuotaPeriodStart(moment); !got.Equal(want) {
+		t.Errorf("QuotaPeriodStart() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+package x3ui
+
+import (
+	"strings"
+
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// ReconcileReport lists the differences between a server's inbound clients and
+// the bot's database
+type ReconcileReport struct {
+	Orphans  []string             // Clients that belong to no known user, by email
+	Legacy   []string             // Clients of known users still keyed by username
+	Missing  []database.IssuedKey // Active issued keys with no client on the panel
+	Disabled []string             // Clients of known users disabled in the inbound settings, except suspended and expired users
+	Depleted []string             // Clients enabled in the settings but stopped by the panel (traffic or expiry limit)
+}
+
+// Clean reports whether nothing needs attention
+func (r *ReconcileReport) Clean() bool {
+	return len(r.Orphans) == 0 && len(r.Legacy) == 0 && len(r.Missing) == 0 &&
+		len(r.Disabled) == 0 && len(r.Depleted) == 0
+}
+
+// ReconcileServer compares the server's primary inbound with the users and the
+// active issued keys of that server
+func (sh *ServerHandler) ReconcileServer(server *database.Server, users []database.User, keys []database.IssuedKey) (*ReconcileReport, error) {
+	inbound, err := sh.getFreshPrimaryInbound(server)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := parseInboundClients(inbound)
+	if err != nil {
+		return nil, err
+	}
+
+	report := reconcile(clients, inbound.ClientStats, users, keys)
+	return &report, nil
+}
+
+// reconcile does the comparison behind ReconcileServer
+func reconcile(clients []x3client.InboundClient, stats []x3client.ClientStats, users []database.User, keys []database.IssuedKey) ReconcileReport {
+	stable := make(map[string]bool, len(users))
+	usernames := make(map[string]bool, len(users))
+	telegramIDs := make(map[int64]bool, len(users))
+	// Clients of suspended and expired users are meant to be disabled
+	blocked := make(map[string]bool)
+	for _, user := range users {
+		usernames[strings.ToLower(user.Username)] = true
+		isBlocked := user.Suspended() || user.AccessExpired()
+		if isBlocked {
+			blocked[strings.ToLower(user.Username)] = true
+		}
+		if user.TelegramID != nil {
+			stable[ClientEmail(*user.TelegramID)] = true
+			telegramIDs[*user.TelegramID] = true
+			if isBlocked {
+				blocked[ClientEmail(*user.TelegramID)] = true
+			}
+		}
+	}
+
+	statsEnabled := make(map[string]bool, len(stats))
+	for _, cs := range stats {
+		statsEnabled[cs.Email] = cs.Enable
+	}
+
+	var report ReconcileReport
+	emails := make(map[string]bool, len(clients))
+	for _, client := range clients {
+		emails[client.Email] = true
+
+		switch {
+		case stable[OwnerClientEmail(client.Email)]:
+		case usernames[strings.ToLower(client.Email)],
+			client.TgID.Value != nil && telegramIDs[*client.TgID.Value]:
+			report.Legacy = append(report.Legacy, client.Email)
+		default:
+			report.Orphans = append(report.Orphans, client.Email)
+			continue
+		}
+
+		isBlocked := blocked[OwnerClientEmail(client.Email)] || blocked[strings.ToLower(client.Email)] ||
+			client.TgID.Value != nil && blocked[ClientEmail(*client.TgID.Value)]
+		if !client.Enable {
+			if !isBlocked {
+				report.Disabled = append(report.Disabled, client.Email)
+			}
+		} else if enabled, ok := statsEnabled[client.Email]; ok && !enabled {
+			report.Depleted = append(report.Depleted, client.Email)
+		}
+	}
+
+	for _, key := range keys {
+		if !emails[key.Email] {
+			report.Missing = append(report.Missing, key)
+		}
+	}
+
+	return report
+}
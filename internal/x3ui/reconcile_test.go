@@ -0,0 +1,54 @@
+package x3ui
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+func TestReconcile(t *testing.T) {
+	aliceID, bobID, carolID, strangerID := int64(1), int64(2), int64(3), int64(99)
+	suspendedAt := time.Now()
+	users := []database.User{
+		{ID: 10, Username: "alice", TelegramID: &aliceID},
+		{ID: 11, Username: "bob", TelegramID: &bobID},
+		{ID: 12, Username: "carol", TelegramID: &carolID, SuspendedAt: &suspendedAt},
+	}
+	clients := []x3client.InboundClient{
+		{Email: "tg1", Enable: true},
+		{Email: "tg1-d5", Enable: true, TgID: x3client.FlexibleInt64{Value: &aliceID}},
+		{Email: "Bob", Enable: false},
+		{Email: "bob_old", Enable: true, TgID: x3client.FlexibleInt64{Value: &bobID}},
+		{Email: "mallory", Enable: true, TgID: x3client.FlexibleInt64{Value: &strangerID}},
+		{Email: "tg3", Enable: false},
+	}
+	stats := []x3client.ClientStats{
+		{Email: "tg1", Enable: false},
+		{Email: "Bob", Enable: false},
+	}
+	keys := []database.IssuedKey{
+		{UserID: 10, Email: "tg1"},
+		{UserID: 11, Email: "tg2"},
+	}
+
+	got := reconcile(clients, stats, users, keys)
+
+	if want := []string{"mallory"}; !reflect.DeepEqual(got.Orphans, want) {
+		t.Errorf("Orphans = %v, want %v", got.Orphans, want)
+	}
+	if want := []string{"Bob", "bob_old"}; !reflect.DeepEqual(got.Legacy, want) {
+		t.Errorf("Legacy = %v, want %v", got.Legacy, want)
+	}
+	if want := []string{"Bob"}; !reflect.DeepEqual(got.Disabled, want) {
+		t.Errorf("Disabled = %v, want %v", got.Disabled, want)
+	}
+	if want := []string{"tg1"}; !reflect.DeepEqual(got.Depleted, want) {
+		t.Errorf("Depleted = %v, want %v", got.Depleted, want)
+	}
+	if len(got.Missing) != 1 || got.Missing[0].Email != "tg2" {
+		t.Errorf("Missing = %v, want the tg2 key", got.Missing)
+	}
+}
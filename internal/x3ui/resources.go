@@ -1,6 +1,7 @@
 package x3ui
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -27,6 +28,7 @@ func (sh *ServerHandler) CreateInbound(server *database.Server) (*x3client.Inbou
 
 	// Create inbound
 	inbound, err := x3c.AddInbound(inboundPayload)
+	sh.invalidateInbounds(server.ID)
 	if err != nil {
 		sh.logger.Error("Failed to create inbound", slog.String("error", err.Error()))
 		return nil, fmt.Errorf("failed to create inbound: %w", err)
@@ -35,7 +37,52 @@ func (sh *ServerHandler) CreateInbound(server *database.Server) (*x3client.Inbou
 	return inbound, nil
 }
 
-func (sh *ServerHandler) GetUserKey(server *database.Server, email string, tgID int64) (string, error) {
+// GetUserKey returns the user's VLESS key for the server. The client is looked
+// up by the stable email from ClientEmail; a client issued under an older
+// username is relinked instead of creating a second one. Concurrent calls for
+// the same user and server share a single request to the panel.
+func (sh *ServerHandler) GetUserKey(server *database.Server, user *database.User) (string, error) {
+	return sh.getKey(server, user, nil)
+}
+
+// GetDeviceKey returns the VLESS key of one of the user's devices on the
+// server, creating the device's own client on first use
+func (sh *ServerHandler) GetDeviceKey(server *database.Server, user *database.User, device *database.Device) (string, error) {
+	return sh.getKey(server, user, device)
+}
+
+// getKey deduplicates concurrent key requests for the same client
+func (sh *ServerHandler) getKey(server *database.Server, user *database.User, device *database.Device) (string, error) {
+	if user.TelegramID == nil {
+		return "", fmt.Errorf("user %s has no Telegram ID", user.Username)
+	}
+
+	email := clientEmail(user, device)
+	key, err, shared := sh.keyGroup.Do(fmt.Sprintf("%d:%s", server.ID, email), func() (interface{}, error) {
+		return sh.getUserKey(server, user, device)
+	})
+	if shared {
+		sh.logger.Debug("Shared in-flight key request", slog.String("server", server.Name), slog.String("email", email))
+	}
+	if err != nil {
+		return "", err
+	}
+	return key.(string), nil
+}
+
+// clientEmail is the panel email of the user's main client, or of the device's
+// client when device is not nil
+func clientEmail(user *database.User, device *database.Device) string {
+	if device != nil {
+		return DeviceClientEmail(*user.TelegramID, device.ID)
+	}
+	return ClientEmail(*user.TelegramID)
+}
+
+func (sh *ServerHandler) getUserKey(server *database.Server, user *database.User, device *database.Device) (string, error) {
+	tgID := *user.TelegramID
+	email := clientEmail(user, device)
+
 	// Validate connection before proceeding
 	if err := sh.validateConnection(server); err != nil {
 		sh.logger.Error("connection validation failed",
@@ -55,16 +102,34 @@ func (sh *ServerHandler) GetUserKey(server *database.Server, email string, tgID
 		return "", err
 	}
 
+	clients, err := parseInboundClients(inbound)
+	if err != nil {
+		return "", err
+	}
+
 	created := false
-	for _, cs := range inbound.ClientStats {
-		if cs.Email == email {
+	var legacyID string
+	for _, client := range clients {
+		if client.Email == email {
 			created = true
 			break
 		}
+		// Device clients are always created by the bot, never relinked
+		if device == nil && legacyID == "" && isLegacyClient(client, user) {
+			legacyID = client.ID
+		}
 	}
-	if !created {
+	switch {
+	case created:
+	case legacyID != "":
+		sh.logger.Debug("Relinking legacy client", slog.String("email", email), slog.Int64("tgID", tgID))
+		if err := sh.relinkClient(server, x3c, inbound, legacyID, tgID); err != nil {
+			sh.logger.Error("error relinking user key", slog.String("error", err.Error()))
+			return "", err
+		}
+	default:
 		sh.logger.Debug("User is not created yet", slog.String("email", email), slog.Int64("tgID", tgID))
-		err = sh.createUserKey(server, x3c, email, tgID)
+		err = sh.createUserKey(server, x3c, user, device)
 		if err != nil {
 			sh.logger.Error("error cretin user key", slog.String("error", err.Error()))
 			return "", err
@@ -77,6 +142,11 @@ func (sh *ServerHandler) GetUserKey(server *database.Server, email string, tgID
 		return "", err
 	}
 
+	if created || legacyID != "" {
+		// Keys issued before the registry existed are recorded on first use
+		sh.ensureIssuedKey(server, user, device, inbound)
+	}
+
 	key, err := x3client.GenerateVLESSLink(*inbound, email)
 	if err != nil {
 		sh.logger.Error("error generating vless link", slog.String("error", err.Error()))
@@ -110,17 +180,14 @@ func replaceVLESSHost(rawLink, host string, port int) (string, error) {
 	return u.String(), nil
 }
 
+// getPrimaryInbound returns the server's primary inbound, possibly from the
+// inbound cache. Use getFreshPrimaryInbound before acting on the client list.
 func (sh *ServerHandler) getPrimaryInbound(server *database.Server) (*x3client.Inbound, error) {
 	if server.InboundID == nil {
 		return nil, fmt.Errorf("primary inbound not set for server %s", server.Name)
 	}
 
-	x3c, exists := sh.getX3Client(server.ID)
-	if !exists {
-		return nil, fmt.Errorf("x3ui client not found for server %s", server.Name)
-	}
-
-	inbounds, err := x3c.ListInbounds()
+	inbounds, err := sh.listInbounds(server)
 	if err != nil {
 		sh.logger.Error("error getting primary inbound", slog.String("error", err.Error()))
 		return nil, err
@@ -137,24 +204,100 @@ func (sh *ServerHandler) getPrimaryInbound(server *database.Server) (*x3client.I
 	return nil, err
 }
 
-func (sh *ServerHandler) createUserKey(server *database.Server, x3c *x3client.Client, email string, tgID int64) error {
+// getFreshPrimaryInbound fetches the server's primary inbound from the panel,
+// bypassing the inbound cache
+func (sh *ServerHandler) getFreshPrimaryInbound(server *database.Server) (*x3client.Inbound, error) {
+	sh.invalidateInbounds(server.ID)
+	return sh.getPrimaryInbound(server)
+}
+
+// createUserKey creates the user's client, or the device's client when device
+// is not nil, and records it in the key registry
+func (sh *ServerHandler) createUserKey(server *database.Server, x3c *x3client.Client, user *database.User, device *database.Device) error {
 	if server.InboundID == nil {
 		return fmt.Errorf("primary inbound not set for server %s", server.Name)
 	}
-	newUserConfig := x3c.GenerateDefaultInboundClient(email, tgID)
+	newUserConfig := x3c.GenerateDefaultInboundClient(clientEmail(user, device), *user.TelegramID)
+	plan := sh.planFor(user, QuotaPeriod(time.Now()))
+	newUserConfig.TotalGB = int(plan.TotalGB)
+	newUserConfig.ExpiryTime = plan.ExpiryTime
+	var deviceID *int64
+	if device != nil {
+		newUserConfig.LimitIP = deviceIPLimit
+		deviceID = &device.ID
+	}
 	err := x3c.AddInboundClient(*server.InboundID, newUserConfig)
+	sh.invalidateInbounds(server.ID)
 	if err != nil {
 		sh.logger.Error("error creating new inbound client", slog.String("error", err.Error()))
 		return err
 	}
+
+	// The client exists on the panel now, so a registry failure must not fail the request
+	err = sh.db.AddIssuedKey(&database.IssuedKey{
+		UserID:     user.ID,
+		DeviceID:   deviceID,
+		ServerID:   server.ID,
+		InboundID:  *server.InboundID,
+		ClientUUID: newUserConfig.ID,
+		Email:      newUserConfig.Email,
+		SubID:      newUserConfig.SubID,
+		Status:     database.KeyStatusActive,
+	})
+	if err != nil {
+		sh.logger.Error("error recording issued key", slog.String("error", err.Error()))
+	}
 	return nil
 }
 
-// validateConnection checks if SSH and X3UI connections are alive
+// ensureIssuedKey records the user's or device's existing client in the key
+// registry if it is not there yet
+func (sh *ServerHandler) ensureIssuedKey(server *database.Server, user *database.User, device *database.Device, inbound *x3client.Inbound) {
+	var deviceID *int64
+	if device != nil {
+		deviceID = &device.ID
+	}
+	_, err := sh.db.GetActiveIssuedKey(user.ID, server.ID, deviceID)
+	if !errors.Is(err, database.ErrIssuedKeyNotFound) {
+		if err != nil {
+			sh.logger.Error("error fetching issued key", slog.String("error", err.Error()))
+		}
+		return
+	}
+
+	clients, err := parseInboundClients(inbound)
+	if err != nil {
+		sh.logger.Error("error parsing inbound clients", slog.String("error", err.Error()))
+		return
+	}
+	email := clientEmail(user, device)
+	for _, client := range clients {
+		if client.Email != email {
+			continue
+		}
+		err := sh.db.AddIssuedKey(&database.IssuedKey{
+			UserID:     user.ID,
+			DeviceID:   deviceID,
+			ServerID:   server.ID,
+			InboundID:  inbound.ID,
+			ClientUUID: client.ID,
+			Email:      client.Email,
+			SubID:      client.SubID,
+			Status:     database.KeyStatusActive,
+		})
+		if err != nil {
+			sh.logger.Error("error recording issued key", slog.String("error", err.Error()))
+		}
+		return
+	}
+}
+
+// validateConnection checks that the server's tunnel is up. It only probes the
+// SSH connection; a broken panel session shows up as an error on the next call.
 func (sh *ServerHandler) validateConnection(server *database.Server) error {
 	sh.mutex.RLock()
 	sshClient, sshExists := sh.sshClients[server.ID]
-	x3Client, x3Exists := sh.x3Clients[server.ID]
+	_, x3Exists := sh.x3Clients[server.ID]
 	sh.mutex.RUnlock()
 
 	if !sshExists || !x3Exists {
@@ -166,12 +309,6 @@ func (sh *ServerHandler) validateConnection(server *database.Server) error {
 		return fmt.Errorf("SSH connection dead for server %s", server.Name)
 	}
 
-	// Try a simple API call to validate X3UI connection
-	_, err := x3Client.ListInbounds()
-	if err != nil {
-		return fmt.Errorf("X3UI API not responding for server %s: %w", server.Name, err)
-	}
-
 	return nil
 }
 
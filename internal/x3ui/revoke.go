@@ -0,0 +1,238 @@
+package x3ui
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// revocationRetryInterval is how often queued revocations are retried
+var revocationRetryInterval = time.Minute
+
+// RevokeStatus is the outcome of revoking a user's clients on one server
+type RevokeStatus string
+
+const (
+	RevokeDone     RevokeStatus = "revoked"   // Clients were deleted
+	RevokeNotFound RevokeStatus = "not_found" // The user had no clients on the server
+	RevokeFailed   RevokeStatus = "failed"    // The removal failed and could not be queued
+	RevokeQueued   RevokeStatus = "queued"    // The server is offline or failed, removal will be retried
+)
+
+// RevokeResult reports what happened to a user's clients on one server
+type RevokeResult struct {
+	Server  database.Server
+	Status  RevokeStatus
+	Deleted int
+	Err     error
+}
+
+// clientMatcher matches the clients issued for a user, by ClientOwnedBy with
+// the username in email, or the single client of a device email. Device emails
+// cannot be usernames, as Telegram usernames have no '-'.
+func clientMatcher(email string, telegramID *int64) func(x3client.InboundClient) bool {
+	if OwnerClientEmail(email) != email {
+		return func(client x3client.InboundClient) bool {
+			return strings.EqualFold(client.Email, email)
+		}
+	}
+	return func(client x3client.InboundClient) bool {
+		return ClientOwnedBy(client, email, telegramID)
+	}
+}
+
+// queueRevocation queues a client removal on the result's server for a retry
+// in the background. cause is the error of the failed attempt, nil when the
+// server was offline. The result is RevokeFailed only if nothing was queued.
+func (sh *ServerHandler) queueRevocation(result *RevokeResult, email string, telegramID *int64, cause error) {
+	revocation := &database.PendingRevocation{
+		ServerID:   result.Server.ID,
+		Email:      email,
+		TelegramID: telegramID,
+	}
+	if cause != nil {
+		revocation.Attempts = 1
+		revocation.LastError = cause.Error()
+	}
+	if err := sh.db.AddPendingRevocation(revocation); err != nil {
+		result.Status = RevokeFailed
+		result.Err = errors.Join(cause, err)
+		return
+	}
+	result.Status = RevokeQueued
+	result.Err = cause
+}
+
+// RevokeUserClients deletes the user's clients from every server. Servers that
+// are offline or fail get a pending revocation that is retried in the background.
+func (sh *ServerHandler) RevokeUserClients(user *database.User) ([]RevokeResult, error) {
+	servers, err := sh.db.GetAllServers()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]RevokeResult, 0, len(servers))
+	for _, server := range servers {
+		result := RevokeResult{Server: server}
+
+		if !sh.isConnected(server.ID) {
+			sh.queueRevocation(&result, user.Username, user.TelegramID, nil)
+			results = append(results, result)
+			continue
+		}
+
+		deleted, err := sh.DeleteClients(&server, clientMatcher(user.Username, user.TelegramID))
+		result.Deleted = deleted
+		switch {
+		case err != nil:
+			sh.queueRevocation(&result, user.Username, user.TelegramID, err)
+		case deleted == 0:
+			result.Status = RevokeNotFound
+		default:
+			result.Status = RevokeDone
+		}
+		if err == nil && user.TelegramID != nil {
+			sh.markUserKeysRevoked(server.ID, *user.TelegramID)
+		}
+
+		sh.logger.Info("Revoked user clients",
+			slog.String("server", server.Name),
+			slog.String("username", user.Username),
+			slog.String("status", string(result.Status)),
+			slog.Int("deleted", deleted))
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// RevokeDeviceClients deletes a device's clients from every server. Like
+// RevokeUserClients, offline and failing servers get a pending revocation.
+func (sh *ServerHandler) RevokeDeviceClients(user *database.User, device *database.Device) ([]RevokeResult, error) {
+	if user.TelegramID == nil {
+		return nil, fmt.Errorf("user %s has no Telegram ID", user.Username)
+	}
+	email := DeviceClientEmail(*user.TelegramID, device.ID)
+
+	servers, err := sh.db.GetAllServers()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]RevokeResult, 0, len(servers))
+	for _, server := range servers {
+		result := RevokeResult{Server: server}
+
+		// No Telegram ID in the retries, so they only match this device's client
+		if !sh.isConnected(server.ID) {
+			sh.queueRevocation(&result, email, nil, nil)
+			results = append(results, result)
+			continue
+		}
+
+		deleted, err := sh.DeleteClients(&server, clientMatcher(email, nil))
+		result.Deleted = deleted
+		switch {
+		case err != nil:
+			sh.queueRevocation(&result, email, nil, err)
+		case deleted == 0:
+			result.Status = RevokeNotFound
+		default:
+			result.Status = RevokeDone
+		}
+		if err == nil {
+			if err := sh.db.RevokeIssuedKeys(server.ID, email); err != nil {
+				sh.logger.Error("Failed to mark issued keys revoked", slog.String("error", err.Error()))
+			}
+		}
+
+		sh.logger.Info("Revoked device clients",
+			slog.String("server", server.Name),
+			slog.String("email", email),
+			slog.String("status", string(result.Status)),
+			slog.Int("deleted", deleted))
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// markUserKeysRevoked marks the user's main and device keys on a server as revoked
+func (sh *ServerHandler) markUserKeysRevoked(serverID, telegramID int64) {
+	if err := sh.db.RevokeIssuedKeys(serverID, ClientEmail(telegramID)); err != nil {
+		sh.logger.Error("Failed to mark issued keys revoked", slog.String("error", err.Error()))
+	}
+	if err := sh.db.RevokeIssuedKeysWithPrefix(serverID, deviceEmailPrefix(telegramID)); err != nil {
+		sh.logger.Error("Failed to mark issued keys revoked", slog.String("error", err.Error()))
+	}
+}
+
+// retryPendingRevocations periodically retries revocations queued while their
+// server was offline
+func (sh *ServerHandler) retryPendingRevocations() {
+	ticker := time.NewTicker(revocationRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sh.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		revocations, err := sh.db.GetPendingRevocations()
+		if err != nil {
+			sh.logger.Error("Failed to fetch pending revocations", slog.String("error", err.Error()))
+			continue
+		}
+
+		for _, revocation := range revocations {
+			// Look the server up first: a removed server is never connected again
+			server, err := sh.db.GetServerByID(revocation.ServerID)
+			if errors.Is(err, database.ErrServerNotFound) {
+				// The server is gone together with its clients
+				_ = sh.db.DeletePendingRevocation(revocation.ID)
+				continue
+			}
+			if err != nil {
+				sh.logger.Error("Failed to fetch server", slog.String("error", err.Error()))
+				continue
+			}
+			if !sh.isConnected(server.ID) {
+				continue
+			}
+
+			deleted, err := sh.DeleteClients(server, clientMatcher(revocation.Email, revocation.TelegramID))
+			if err != nil {
+				sh.logger.Warn("Pending revocation failed",
+					slog.String("server", server.Name),
+					slog.String("email", revocation.Email),
+					slog.String("error", err.Error()))
+				if err := sh.db.UpdatePendingRevocationAttempt(revocation.ID, err.Error()); err != nil {
+					sh.logger.Error("Failed to update pending revocation", slog.String("error", err.Error()))
+				}
+				continue
+			}
+
+			if err := sh.db.RevokeIssuedKeys(server.ID, revocation.Email); err != nil {
+				sh.logger.Error("Failed to mark issued keys revoked", slog.String("error", err.Error()))
+			}
+			if revocation.TelegramID != nil {
+				sh.markUserKeysRevoked(server.ID, *revocation.TelegramID)
+			}
+
+			sh.logger.Info("Pending revocation completed",
+				slog.String("server", server.Name),
+				slog.String("email", revocation.Email),
+				slog.Int("deleted", deleted))
+			if err := sh.db.DeletePendingRevocation(revocation.ID); err != nil {
+				sh.logger.Error("Failed to delete pending revocation", slog.String("error", err.Error()))
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package x3ui
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"net"
 	"sync"
@@ -10,34 +11,50 @@ import (
 	x3client "github.com/supercakecrumb/go-x3ui/client"
 	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
 	defaultInboundRemark = "DefaultInbound"
 	defaultInboundPort   = 443
+	// deviceIPLimit is how many IPs may use a device key at once. It leaves room
+	// for a phone switching between Wi-Fi and mobile data, but not for sharing.
+	deviceIPLimit = 2
 )
 
 type ServerHandler struct {
 	SSHKeyPath string
+	db         *database.DB
 	x3Clients  map[int64]*x3client.Client // Map of server ID to x3ui client
 	sshClients map[int64]*ssh.Client      // Map of server ID to SSH client
 	localPorts map[int64]int              // Map of server ID to local port
 	listeners  map[int64]net.Listener     // Map of server ID to Listener
+	scopes     map[int64]*serverScope     // Map of server ID to its background goroutine scope
 	mutex      sync.RWMutex
+	inbounds   map[int64]inboundSnapshot // Map of server ID to its cached inbound list
+	inboundGen map[int64]uint64          // Map of server ID to its cache generation, bumped on every write
+	cacheMu    sync.Mutex
+	keyGroup   singleflight.Group // Deduplicates concurrent GetUserKey calls for the same user and server
+	quotas     Quotas             // Traffic plans applied to the clients
 	logger     *slog.Logger
 	ctx        context.Context
 	cancel     context.CancelFunc
 	wg         sync.WaitGroup
 }
 
-func NewServerHandler(sshKeyPath string, servers []database.Server, logger *slog.Logger) *ServerHandler {
+func NewServerHandler(sshKeyPath string, servers []database.Server, quotas Quotas, db *database.DB, logger *slog.Logger) *ServerHandler {
 	ctx, cancel := context.WithCancel(context.Background())
 	sh := ServerHandler{
 		SSHKeyPath: sshKeyPath,
+		db:         db,
 		x3Clients:  make(map[int64]*x3client.Client),
 		sshClients: make(map[int64]*ssh.Client),
 		localPorts: make(map[int64]int),
 		listeners:  make(map[int64]net.Listener),
+		scopes:     make(map[int64]*serverScope),
+		inbounds:   make(map[int64]inboundSnapshot),
+		inboundGen: make(map[int64]uint64),
+		quotas:     quotas,
 		logger:     logger,
 		ctx:        ctx,
 		cancel:     cancel,
@@ -53,36 +70,77 @@ func NewServerHandler(sshKeyPath string, servers []database.Server, logger *slog
 				slog.Int64("server_id", server.ID),
 				slog.String("error", err.Error()),
 			)
-			sh.wg.Add(1)
-			go func(s *database.Server) {
-				defer sh.wg.Done()
-				sh.retryConnect(s)
-			}(&server)
+			sh.goServer(server.ID, func(ctx context.Context) {
+				sh.retryConnect(ctx, &server)
+			})
 		}
 	}
 
+	sh.wg.Add(1)
+	go func() {
+		defer sh.wg.Done()
+		sh.retryPendingRevocations()
+	}()
+
+	sh.wg.Add(1)
+	go func() {
+		defer sh.wg.Done()
+		sh.collectTraffic()
+	}()
+
 	return &sh
 }
 
-func (sh *ServerHandler) Close() {
-	if sh.cancel != nil {
-		sh.cancel()
+// serverScope ties the background goroutines of a single server (connection
+// monitor, reconnect loop) to a context that can be cancelled on its own.
+type serverScope struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// scope returns the goroutine scope of a server, creating it on first use.
+// The caller must hold sh.mutex.
+func (sh *ServerHandler) scope(serverID int64) *serverScope {
+	sc, exists := sh.scopes[serverID]
+	if !exists {
+		ctx, cancel := context.WithCancel(sh.ctx)
+		sc = &serverScope{ctx: ctx, cancel: cancel}
+		sh.scopes[serverID] = sc
 	}
+	return sc
+}
+
+// goServer runs fn in a goroutine bound to the server's scope, so that it
+// is stopped both by Close and by RemoveServer.
+func (sh *ServerHandler) goServer(serverID int64, fn func(ctx context.Context)) {
 	sh.mutex.Lock()
-	for id := range sh.sshClients {
-		// Close the listener first
-		if listener, exists := sh.listeners[id]; exists {
-			err := listener.Close()
-			if err != nil {
-				sh.logger.Error("Failed to close listener", slog.Int64("server_id", id), slog.String("error", err.Error()))
-			} else {
-				sh.logger.Info("Listener closed", slog.Int64("server_id", id))
-			}
-			delete(sh.listeners, id)
+	sc := sh.scope(serverID)
+	sc.wg.Add(1)
+	sh.wg.Add(1)
+	sh.mutex.Unlock()
+
+	go func() {
+		defer sh.wg.Done()
+		defer sc.wg.Done()
+		fn(sc.ctx)
+	}()
+}
+
+// closeServerLocked closes the listener and SSH client of a server and forgets
+// its x3ui client. The caller must hold sh.mutex.
+func (sh *ServerHandler) closeServerLocked(id int64) {
+	if listener, exists := sh.listeners[id]; exists {
+		err := listener.Close()
+		if err != nil {
+			sh.logger.Error("Failed to close listener", slog.Int64("server_id", id), slog.String("error", err.Error()))
+		} else {
+			sh.logger.Info("Listener closed", slog.Int64("server_id", id))
 		}
+		delete(sh.listeners, id)
+	}
 
-		// Close the SSH client
-		sshClient := sh.sshClients[id]
+	if sshClient, exists := sh.sshClients[id]; exists {
 		err := sshClient.Close()
 		if err != nil {
 			sh.logger.Error("Failed to close SSH client", slog.Int64("server_id", id), slog.String("error", err.Error()))
@@ -90,14 +148,104 @@ func (sh *ServerHandler) Close() {
 			sh.logger.Info("SSH client closed", slog.Int64("server_id", id))
 		}
 		delete(sh.sshClients, id)
+	}
+
+	delete(sh.x3Clients, id)
+	delete(sh.localPorts, id)
+	sh.invalidateInbounds(id)
+}
 
-		// Remove the x3client.Client
-		delete(sh.x3Clients, id)
+func (sh *ServerHandler) Close() {
+	if sh.cancel != nil {
+		sh.cancel()
+	}
+	sh.mutex.Lock()
+	for id := range sh.sshClients {
+		sh.closeServerLocked(id)
 	}
 	sh.mutex.Unlock()
 	sh.wg.Wait()
 }
 
+// RemoveServer stops the background goroutines of a server and closes its
+// listener, SSH client and x3ui client. It is a no-op for unknown servers.
+func (sh *ServerHandler) RemoveServer(serverID int64) {
+	sh.mutex.RLock()
+	sc, exists := sh.scopes[serverID]
+	sh.mutex.RUnlock()
+
+	// The scope stays registered until its goroutines are gone, so a reconnect
+	// that finishes meanwhile starts its monitor in the already cancelled scope.
+	if exists {
+		sc.cancel()
+		sc.wg.Wait()
+	}
+
+	sh.mutex.Lock()
+	if sh.scopes[serverID] == sc {
+		delete(sh.scopes, serverID)
+	}
+	sh.closeServerLocked(serverID)
+	sh.mutex.Unlock()
+
+	sh.logger.Info("Server removed from handler", slog.Int64("server_id", serverID))
+}
+
+// CheckServer opens a throwaway SSH tunnel with the given settings, logs in to
+// the panel and, if an inbound ID is set, makes sure that inbound exists. The
+// connections registered in the handler are left untouched.
+func (sh *ServerHandler) CheckServer(server *database.Server) error {
+	sshClient, listener, localPort, err := sh.openSSHPortForward(server)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	defer listener.Close()
+
+	x3Client, err := InitializeX3uiClient(localPort, server.Username, server.Password, sh.logger)
+	if err != nil {
+		return fmt.Errorf("failed to log in to panel: %w", err)
+	}
+
+	if server.InboundID == nil {
+		return nil
+	}
+
+	inbounds, err := x3Client.ListInbounds()
+	if err != nil {
+		return fmt.Errorf("failed to list inbounds: %w", err)
+	}
+	for _, inbound := range inbounds {
+		if inbound.ID == *server.InboundID {
+			return nil
+		}
+	}
+	return fmt.Errorf("inbound %d not found on panel", *server.InboundID)
+}
+
+// ReloadServer drops the current connections of a server and connects again
+// with the given settings. If the new connection fails, it keeps retrying in
+// the background like servers that are unreachable at startup.
+func (sh *ServerHandler) ReloadServer(server *database.Server) error {
+	sh.RemoveServer(server.ID)
+
+	if _, err := sh.AddClient(server); err != nil {
+		sh.logger.Error("Failed to reconnect server after reload, will retry in background",
+			slog.String("server", server.Name),
+			slog.Int64("server_id", server.ID),
+			slog.String("error", err.Error()),
+		)
+		s := *server
+		sh.goServer(s.ID, func(ctx context.Context) {
+			sh.retryConnect(ctx, &s)
+		})
+		return err
+	}
+
+	sh.logger.Info("Server reloaded", slog.String("server", server.Name), slog.Int64("server_id", server.ID))
+	return nil
+}
+
 func (sh *ServerHandler) AddClient(server *database.Server) (*x3client.Client, error) {
 
 	// Check if client already exists
@@ -141,22 +289,21 @@ func (sh *ServerHandler) connectToServer(server *database.Server) (*x3client.Cli
 	sh.localPorts[server.ID] = localPort
 	sh.mutex.Unlock()
 
-	sh.wg.Add(1)
-	go func(s *database.Server) {
-		defer sh.wg.Done()
-		sh.monitorSSHConnections(s)
-	}(server)
+	s := *server
+	sh.goServer(server.ID, func(ctx context.Context) {
+		sh.monitorSSHConnections(ctx, &s)
+	})
 
 	return x3Client, nil
 }
 
-func (sh *ServerHandler) retryConnect(server *database.Server) {
+func (sh *ServerHandler) retryConnect(ctx context.Context, server *database.Server) {
 	backoff := 5 * time.Second
 	maxBackoff := 2 * time.Minute
 
 	for {
 		select {
-		case <-sh.ctx.Done():
+		case <-ctx.Done():
 			return
 		case <-time.After(backoff):
 		}
@@ -177,6 +324,21 @@ func (sh *ServerHandler) retryConnect(server *database.Server) {
 	}
 }
 
+// IsServerOnline reports whether the bot can reach the server's panel right now
+func (sh *ServerHandler) IsServerOnline(serverID int64) bool {
+	return sh.isConnected(serverID)
+}
+
+// isConnected reports whether the server has a live SSH tunnel and x3ui client
+func (sh *ServerHandler) isConnected(serverID int64) bool {
+	sh.mutex.RLock()
+	sshClient, sshExists := sh.sshClients[serverID]
+	_, x3Exists := sh.x3Clients[serverID]
+	sh.mutex.RUnlock()
+
+	return sshExists && x3Exists && isSSHConnectionAlive(sshClient)
+}
+
 func (sh *ServerHandler) getX3Client(serverID int64) (*x3client.Client, bool) {
 	sh.mutex.RLock()
 	client, exists := sh.x3Clients[serverID]
@@ -1,6 +1,7 @@
 package x3ui
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -26,6 +27,22 @@ func (sh *ServerHandler) StartSSHPortForward(server *database.Server) (*ssh.Clie
 		}
 	}()
 
+	client, listener, localPort, err := sh.openSSHPortForward(server)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Store the listener
+	sh.mutex.Lock()
+	sh.listeners[server.ID] = listener
+	sh.mutex.Unlock()
+
+	return client, localPort, nil
+}
+
+// openSSHPortForward dials the server over SSH and forwards a free local port to
+// the panel API port. The returned listener is not registered in the handler.
+func (sh *ServerHandler) openSSHPortForward(server *database.Server) (*ssh.Client, net.Listener, int, error) {
 	sh.logger.Info("Starting SSH port forwarding",
 		slog.String("server_ip", server.IP),
 		slog.Int("ssh_port", server.SSHPort),
@@ -37,7 +54,7 @@ func (sh *ServerHandler) StartSSHPortForward(server *database.Server) (*ssh.Clie
 	config, err := sh.createSshConfig(server.SSHUser, sh.SSHKeyPath)
 	if err != nil {
 		sh.logger.Error("Failed to create SSH config", slog.String("error", err.Error()))
-		return nil, 0, err
+		return nil, nil, 0, err
 	}
 
 	// Establish SSH connection
@@ -46,7 +63,7 @@ func (sh *ServerHandler) StartSSHPortForward(server *database.Server) (*ssh.Clie
 	client, err := ssh.Dial("tcp", addr, config)
 	if err != nil {
 		sh.logger.Error("Failed to dial SSH server", slog.String("error", err.Error()))
-		return nil, 0, fmt.Errorf("failed to dial SSH: %w", err)
+		return nil, nil, 0, fmt.Errorf("failed to dial SSH: %w", err)
 	}
 	sh.logger.Info("SSH connection established")
 
@@ -55,7 +72,7 @@ func (sh *ServerHandler) StartSSHPortForward(server *database.Server) (*ssh.Clie
 	if err != nil {
 		sh.logger.Error("Error finding local port", slog.String("error", err.Error()))
 		_ = client.Close()
-		return nil, 0, fmt.Errorf("error finding local port: %v", err)
+		return nil, nil, 0, fmt.Errorf("error finding local port: %v", err)
 	}
 	sh.logger.Info("Found available local port", slog.Int("local_port", localPort))
 
@@ -65,15 +82,10 @@ func (sh *ServerHandler) StartSSHPortForward(server *database.Server) (*ssh.Clie
 	if err != nil {
 		sh.logger.Error("Failed to start local listener", slog.String("error", err.Error()))
 		_ = client.Close()
-		return nil, 0, fmt.Errorf("failed to start local listener: %v", err)
+		return nil, nil, 0, fmt.Errorf("failed to start local listener: %v", err)
 	}
 	sh.logger.Info("Local listener started", slog.String("address", localAddr))
 
-	// Store the listener
-	sh.mutex.Lock()
-	sh.listeners[server.ID] = listener
-	sh.mutex.Unlock()
-
 	remoteAddr := fmt.Sprintf("localhost:%v", server.APIPort)
 
 	// Start forwarding connections
@@ -117,7 +129,7 @@ func (sh *ServerHandler) StartSSHPortForward(server *database.Server) (*ssh.Clie
 		slog.Int("local_port", localPort),
 		slog.String("remote_address", remoteAddr),
 	)
-	return client, localPort, nil
+	return client, listener, localPort, nil
 }
 
 func (sh *ServerHandler) runTunnel(localConn, remoteConn net.Conn) {
@@ -275,13 +287,13 @@ func findLocalPort(start int) (int, error) {
 	return 0, fmt.Errorf("no available ports found starting from %d", start)
 }
 
-func (sh *ServerHandler) monitorSSHConnections(server *database.Server) {
+func (sh *ServerHandler) monitorSSHConnections(ctx context.Context, server *database.Server) {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-sh.ctx.Done():
+		case <-ctx.Done():
 			return
 		case <-ticker.C:
 		}
@@ -297,16 +309,7 @@ func (sh *ServerHandler) monitorSSHConnections(server *database.Server) {
 
 			// Clean up old connection
 			sh.mutex.Lock()
-			if oldClient, exists := sh.sshClients[server.ID]; exists {
-				oldClient.Close()
-			}
-			if oldListener, exists := sh.listeners[server.ID]; exists {
-				oldListener.Close()
-			}
-			delete(sh.sshClients, server.ID)
-			delete(sh.listeners, server.ID)
-			delete(sh.x3Clients, server.ID)
-			delete(sh.localPorts, server.ID)
+			sh.closeServerLocked(server.ID)
 			sh.mutex.Unlock()
 
 			// Reconnect with retry
@@ -315,12 +318,12 @@ func (sh *ServerHandler) monitorSSHConnections(server *database.Server) {
 			var err error
 
 			for retries := 0; retries < 3; retries++ {
-				if sh.ctx.Err() != nil {
+				if ctx.Err() != nil {
 					return
 				}
 				if retries > 0 {
 					select {
-					case <-sh.ctx.Done():
+					case <-ctx.Done():
 						return
 					case <-time.After(time.Duration(retries*2) * time.Second):
 					}
@@ -336,7 +339,7 @@ func (sh *ServerHandler) monitorSSHConnections(server *database.Server) {
 			}
 
 			if err != nil {
-				if sh.ctx.Err() != nil {
+				if ctx.Err() != nil {
 					return
 				}
 				sh.logger.Error("Failed to reconnect SSH after retries",
@@ -369,11 +372,9 @@ func (sh *ServerHandler) monitorSSHConnections(server *database.Server) {
 	}
 }
 
+// isSSHConnectionAlive sends an OpenSSH keepalive request. It costs a single
+// round trip and, unlike opening a session, allocates nothing on the server.
 func isSSHConnectionAlive(client *ssh.Client) bool {
-	session, err := client.NewSession()
-	if err != nil {
-		return false
-	}
-	defer session.Close()
-	return true
+	_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+	return err == nil
 }
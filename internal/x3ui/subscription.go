@@ -0,0 +1,98 @@
+package x3ui
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// Subscription holds the keys of every server a user may use together with
+// the traffic and limits of their clients
+type Subscription struct {
+	Links    []string
+	Upload   int64 // Bytes, summed over all servers
+	Download int64 // Bytes, summed over all servers
+	Total    int64 // Traffic limit in bytes, 0 when unlimited
+	Expire   int64 // Unix time of the earliest client expiry, 0 when none
+}
+
+// BuildSubscription collects the user's keys from every server they may use,
+// creating missing clients through GetUserKey. Servers that are offline or
+// fail are left out, so the subscription still works with the others.
+func (sh *ServerHandler) BuildSubscription(user *database.User) (*Subscription, error) {
+	if user.TelegramID == nil {
+		return nil, fmt.Errorf("user %s has no Telegram ID", user.Username)
+	}
+
+	servers, err := sh.db.GetServersForUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	email := ClientEmail(*user.TelegramID)
+	sub := &Subscription{}
+	unlimited := false
+	for i := range servers {
+		server := &servers[i]
+		if !sh.isConnected(server.ID) {
+			sh.logger.Warn("Skipping offline server in subscription", slog.String("server", server.Name))
+			continue
+		}
+
+		key, err := sh.GetUserKey(server, user)
+		if err != nil {
+			sh.logger.Warn("Skipping server in subscription",
+				slog.String("server", server.Name),
+				slog.String("error", err.Error()))
+			continue
+		}
+		key, err = setVLESSRemark(key, ServerRemark(server))
+		if err != nil {
+			sh.logger.Warn("Failed to set key remark", slog.String("error", err.Error()))
+		}
+		sub.Links = append(sub.Links, key)
+
+		// GetUserKey has just fetched the inbound, so this is served from the cache
+		inbound, err := sh.getPrimaryInbound(server)
+		if err != nil {
+			continue
+		}
+		for _, cs := range inbound.ClientStats {
+			if cs.Email != email {
+				continue
+			}
+			sub.Upload += cs.Up
+			sub.Download += cs.Down
+			if cs.Total == 0 {
+				unlimited = true
+			}
+			sub.Total += cs.Total
+			// Negative expiry times count from the first connection and are not dates yet
+			if cs.ExpiryTime > 0 && (sub.Expire == 0 || cs.ExpiryTime/1000 < sub.Expire) {
+				sub.Expire = cs.ExpiryTime / 1000
+			}
+		}
+	}
+	if unlimited {
+		sub.Total = 0
+	}
+
+	return sub, nil
+}
+
+// ServerRemark is the name a server's key shows in client apps
+func ServerRemark(server *database.Server) string {
+	return fmt.Sprintf("%s, %s", server.Country, server.City)
+}
+
+// setVLESSRemark replaces the remark fragment of a VLESS link
+func setVLESSRemark(rawLink, remark string) (string, error) {
+	u, err := url.Parse(rawLink)
+	if err != nil {
+		return rawLink, fmt.Errorf("failed to parse vless link %q: %w", rawLink, err)
+	}
+	u.Fragment = remark
+	return u.String(), nil
+}
@@ -0,0 +1,26 @@
+package x3ui
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSetVLESSRemark(t *testing.T) {
+	const in = "vless://11111111-2222-3333-4444-555555555555@example.com:443?security=reality&type=tcp#DefaultInbound-tg42"
+
+	got, err := setVLESSRemark(in, "Finland, Helsinki")
+	if err != nil {
+		t.Fatalf("setVLESSRemark returned error: %v", err)
+	}
+
+	u, err := url.Parse(got)
+	if err != nil {
+		t.Fatalf("result is not a valid URL %q: %v", got, err)
+	}
+	if u.Fragment != "Finland, Helsinki" {
+		t.Errorf("fragment = %q, want %q", u.Fragment, "Finland, Helsinki")
+	}
+	if u.Host != "example.com:443" || u.RawQuery != "security=reality&type=tcp" {
+		t.Errorf("link changed beyond the remark: %q", got)
+	}
+}
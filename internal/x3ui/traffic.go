@@ -0,0 +1,142 @@
+package x3ui
+
+import (
+	"log/slog"
+	"time"
+
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// trafficPollInterval is how often client traffic is collected from the panels
+var trafficPollInterval = 5 * time.Minute
+
+// trafficBucket is the granularity of the stored traffic history
+const trafficBucket = time.Hour
+
+// collectTraffic periodically stores the traffic of every client of the known
+// users on all connected servers
+func (sh *ServerHandler) collectTraffic() {
+	ticker := time.NewTicker(trafficPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sh.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		servers, err := sh.db.GetAllServers()
+		if err != nil {
+			sh.logger.Error("Failed to fetch servers", slog.String("error", err.Error()))
+			continue
+		}
+		users, err := sh.db.GetAllUsers()
+		if err != nil {
+			sh.logger.Error("Failed to fetch users", slog.String("error", err.Error()))
+			continue
+		}
+		owners := NewClientOwners(users)
+		bucket := time.Now().UTC().Truncate(trafficBucket)
+
+		for _, server := range servers {
+			if !sh.isConnected(server.ID) {
+				continue
+			}
+			if err := sh.collectServerTraffic(&server, owners, bucket); err != nil {
+				sh.logger.Warn("Failed to collect traffic",
+					slog.String("server", server.Name),
+					slog.String("error", err.Error()))
+			}
+		}
+	}
+}
+
+// collectServerTraffic stores one traffic sample of a server's primary inbound
+func (sh *ServerHandler) collectServerTraffic(server *database.Server, owners *ClientOwners, bucket time.Time) error {
+	inbound, err := sh.getPrimaryInbound(server)
+	if err != nil {
+		return err
+	}
+	counters, err := sh.db.GetTrafficCounters(server.ID)
+	if err != nil {
+		return err
+	}
+
+	clients, err := parseInboundClients(inbound)
+	if err != nil {
+		return err
+	}
+
+	records, updated := trafficSample(server.ID, inbound.ClientStats, counters, owners.ByEmail(clients), bucket)
+	if len(updated) == 0 {
+		return nil
+	}
+	if err := sh.db.SaveTrafficSample(records, updated); err != nil {
+		return err
+	}
+
+	sh.logger.Debug("Collected traffic",
+		slog.String("server", server.Name),
+		slog.Int("records", len(records)))
+	return nil
+}
+
+// trafficSample turns the panel's absolute counters into per-bucket records.
+// It returns the records to add and the counters that changed. A client seen
+// for the first time only sets its baseline: when its earlier traffic was used
+// is unknown.
+func trafficSample(serverID int64, stats []x3client.ClientStats, counters []database.TrafficCounter, owners map[string]*database.User, bucket time.Time) ([]database.TrafficRecord, []database.TrafficCounter) {
+	last := make(map[string]database.TrafficCounter, len(counters))
+	for _, counter := range counters {
+		last[counter.Email] = counter
+	}
+
+	var records []database.TrafficRecord
+	var updated []database.TrafficCounter
+	for _, cs := range stats {
+		owner, ok := owners[cs.Email]
+		if !ok {
+			continue
+		}
+
+		prev, seen := last[cs.Email]
+		if seen && prev.Up == cs.Up && prev.Down == cs.Down {
+			continue
+		}
+		updated = append(updated, database.TrafficCounter{
+			ServerID: serverID,
+			Email:    cs.Email,
+			Up:       cs.Up,
+			Down:     cs.Down,
+		})
+		if !seen {
+			continue
+		}
+
+		up, down := trafficDelta(prev.Up, cs.Up), trafficDelta(prev.Down, cs.Down)
+		if up == 0 && down == 0 {
+			continue
+		}
+		records = append(records, database.TrafficRecord{
+			UserID:   owner.ID,
+			ServerID: serverID,
+			Email:    cs.Email,
+			Bucket:   bucket,
+			Up:       up,
+			Down:     down,
+		})
+	}
+	return records, updated
+}
+
+// trafficDelta returns the traffic since the previous counter value. A counter
+// that went down was reset on the panel (monthly reset or by hand), so
+// everything it shows now is new traffic.
+func trafficDelta(prev, cur int64) int64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
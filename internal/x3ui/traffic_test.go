@@ -0,0 +1,80 @@
+package x3ui
+
+import (
+	"testing"
+	"time"
+
+	x3client "github.com/supercakecrumb/go-x3ui/client"
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+func TestTrafficDelta(t *testing.T) {
+	tests := []struct {
+		prev, cur, want int64
+	}{
+		{0, 0, 0},
+		{100, 250, 150},
+		{250, 250, 0},
+		{5000, 300, 300}, // counter reset on the panel
+		{5000, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := trafficDelta(tt.prev, tt.cur); got != tt.want {
+			t.Errorf("trafficDelta(%d, %d) = %d, want %d", tt.prev, tt.cur, got, tt.want)
+		}
+	}
+}
+
+func TestTrafficSample(t *testing.T) {
+	aliceID, bobID := int64(1), int64(2)
+	otherID := int64(3)
+	owners := NewClientOwners([]database.User{
+		{ID: 10, Username: "alice", TelegramID: &aliceID},
+		{ID: 11, Username: "bob", TelegramID: &bobID},
+	}).ByEmail([]x3client.InboundClient{
+		{Email: "tg1", TgID: x3client.FlexibleInt64{Value: &aliceID}},
+		{Email: "tg1-d3", TgID: x3client.FlexibleInt64{Value: &aliceID}},
+		{Email: "Bob"},
+		{Email: "tg2", TgID: x3client.FlexibleInt64{Value: &bobID}},
+		{Email: "stranger"},
+		{Email: "alice", TgID: x3client.FlexibleInt64{Value: &otherID}},
+	})
+	bucket := time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC)
+
+	stats := []x3client.ClientStats{
+		{Email: "tg1", Up: 150, Down: 1000},   // grew
+		{Email: "tg1-d3", Up: 10, Down: 20},   // reset since the last sample
+		{Email: "Bob", Up: 5, Down: 5},        // legacy client, unchanged
+		{Email: "tg2", Up: 7, Down: 9},        // first sample, baseline only
+		{Email: "stranger", Up: 99, Down: 99}, // not ours
+		{Email: "alice", Up: 42, Down: 42},    // username taken over by another tgId
+	}
+	counters := []database.TrafficCounter{
+		{ServerID: 5, Email: "tg1", Up: 100, Down: 400},
+		{ServerID: 5, Email: "tg1-d3", Up: 500, Down: 600},
+		{ServerID: 5, Email: "Bob", Up: 5, Down: 5},
+	}
+
+	records, updated := trafficSample(5, stats, counters, owners, bucket)
+
+	want := []database.TrafficRecord{
+		{UserID: 10, ServerID: 5, Email: "tg1", Bucket: bucket, Up: 50, Down: 600},
+		{UserID: 10, ServerID: 5, Email: "tg1-d3", Bucket: bucket, Up: 10, Down: 20},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("records = %+v, want %+v", records, want)
+	}
+	for i := range want {
+		if records[i] != want[i] {
+			t.Errorf("records[%d] = %+v, want %+v", i, records[i], want[i])
+		}
+	}
+
+	var emails []string
+	for _, counter := range updated {
+		emails = append(emails, counter.Email)
+	}
+	if len(emails) != 3 || emails[0] != "tg1" || emails[1] != "tg1-d3" || emails[2] != "tg2" {
+		t.Errorf("updated counters = %v, want [tg1 tg1-d3 tg2]", emails)
+	}
+}
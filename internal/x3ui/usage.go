@@ -0,0 +1,123 @@
+package x3ui
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/supercakecrumb/otvali-xray-bot/internal/database"
+)
+
+// ServerUsage is the live state of a user's clients on one server, summed over
+// the main key and the device keys
+type ServerUsage struct {
+	Server     database.Server
+	HasKey     bool  // The user has at least one client on the server
+	Up         int64 // Bytes since the panel's last counter reset
+	Down       int64 // Bytes since the panel's last counter reset
+	Total      int64 // Traffic limit of the main key in bytes, 0 when unlimited
+	ExpiryTime int64 // Expiry of the main key as 3x-ui stores it, see ClientStats
+	Online     bool  // One of the clients is connected right now
+	Err        error // The server could not be queried
+}
+
+// GetUserUsage reports the user's traffic, limits and online status on every
+// server they may use. Offline servers are reported with Err set.
+func (sh *ServerHandler) GetUserUsage(user *database.User) ([]ServerUsage, error) {
+	if user.TelegramID == nil {
+		return nil, fmt.Errorf("user %s has no Telegram ID", user.Username)
+	}
+
+	servers, err := sh.db.GetServersForUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	mainEmail := ClientEmail(*user.TelegramID)
+	usage := make([]ServerUsage, 0, len(servers))
+	for i := range servers {
+		server := &servers[i]
+		su := ServerUsage{Server: *server}
+
+		x3c, exists := sh.getX3Client(server.ID)
+		if !exists || !sh.isConnected(server.ID) {
+			su.Err = fmt.Errorf("server %s is offline", server.Name)
+			usage = append(usage, su)
+			continue
+		}
+
+		inbound, err := sh.getPrimaryInbound(server)
+		if err != nil {
+			su.Err = err
+			usage = append(usage, su)
+			continue
+		}
+		for _, cs := range inbound.ClientStats {
+			if OwnerClientEmail(cs.Email) != mainEmail {
+				continue
+			}
+			su.HasKey = true
+			su.Up += cs.Up
+			su.Down += cs.Down
+			if cs.Email == mainEmail {
+				su.Total = cs.Total
+				su.ExpiryTime = cs.ExpiryTime
+			}
+		}
+
+		if su.HasKey {
+			// Online status is best effort; traffic is still worth showing without it
+			online, err := x3c.GetOnlineClients()
+			if err == nil {
+				for _, email := range online {
+					if OwnerClientEmail(email) == mainEmail {
+						su.Online = true
+						break
+					}
+				}
+			}
+		}
+
+		usage = append(usage, su)
+	}
+
+	return usage, nil
+}
+
+// OnlineUsers reports which of the users have a client connected right now on
+// any server, keyed by User.ID. Offline servers are skipped.
+func (sh *ServerHandler) OnlineUsers(users []database.User) map[int64]bool {
+	online := make(map[int64]bool)
+	if len(users) == 0 {
+		return online
+	}
+	owners := NewClientOwners(users)
+
+	servers, err := sh.db.GetAllServers()
+	if err != nil {
+		sh.logger.Error("Failed to fetch servers", slog.String("error", err.Error()))
+		return online
+	}
+	for _, server := range servers {
+		x3c, exists := sh.getX3Client(server.ID)
+		if !exists || !sh.isConnected(server.ID) {
+			continue
+		}
+		emails, err := x3c.GetOnlineClients()
+		if err != nil {
+			sh.logger.Warn("Failed to fetch online clients", slog.String("server", server.Name), slog.String("error", err.Error()))
+			continue
+		}
+		clients, err := sh.ListClients(&server)
+		if err != nil {
+			sh.logger.Warn("Failed to list clients", slog.String("server", server.Name), slog.String("error", err.Error()))
+			continue
+		}
+		emailOwners := owners.ByEmail(clients)
+		for _, email := range emails {
+			if user, ok := emailOwners[email]; ok {
+				online[user.ID] = true
+			}
+		}
+	}
+	return online
+}
@@ -2,20 +2,62 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
 )
 
 type Config struct {
-	TelegramToken string
-	LogLevel      string
-	DatabaseURL   string
-	SSHKeyPath    string
+	TelegramToken    string
+	LogLevel         string
+	DatabaseURL      string
+	SSHKeyPath       string
+	OwnerTelegramID  int64  // Always an admin, promoted on startup and never demoted
+	HTTPListenAddr   string // Address of the subscription HTTP server
+	PublicBaseURL    string // Public URL the HTTP server is reachable at; subscriptions are off when empty
+	DeviceLimit      int    // Devices a user may create unless an admin set a personal limit
+	QuotaDefaultGB   int64  // Monthly traffic per key and server for invited users, 0 for unlimited
+	QuotaExclusiveGB int64  // Monthly traffic per key and server for users with exclusive access, 0 for unlimited
+
+	InviteBudgetNew       int // Invites a new user may send per budget period
+	InviteBudgetTrusted   int // Invites a trusted user may send per budget period
+	InviteBudgetExclusive int // Invites a user with exclusive access may send per budget period
+	InviteBudgetDays      int // Length of the rolling budget period; spent invites come back after it
 }
 
 func LoadConfig() Config {
 	return Config{
-		TelegramToken: os.Getenv("TELEGRAM_TOKEN"),
-		LogLevel:      os.Getenv("LOG_LEVEL"),
-		DatabaseURL:   os.Getenv("DATABASE_URL"),
-		SSHKeyPath:    os.Getenv("SSH_KEY_PATH"),
+		TelegramToken:    os.Getenv("TELEGRAM_TOKEN"),
+		LogLevel:         os.Getenv("LOG_LEVEL"),
+		DatabaseURL:      os.Getenv("DATABASE_URL"),
+		SSHKeyPath:       os.Getenv("SSH_KEY_PATH"),
+		OwnerTelegramID:  getEnvInt64("OWNER_TELEGRAM_ID", 0),
+		HTTPListenAddr:   getEnv("HTTP_LISTEN_ADDR", ":8080"),
+		PublicBaseURL:    strings.TrimSuffix(os.Getenv("PUBLIC_BASE_URL"), "/"),
+		DeviceLimit:      int(getEnvInt64("DEVICE_LIMIT", 3)),
+		QuotaDefaultGB:   getEnvInt64("QUOTA_DEFAULT_GB", 0),
+		QuotaExclusiveGB: getEnvInt64("QUOTA_EXCLUSIVE_GB", 0),
+
+		InviteBudgetNew:       int(getEnvInt64("INVITE_BUDGET_NEW", 2)),
+		InviteBudgetTrusted:   int(getEnvInt64("INVITE_BUDGET_TRUSTED", 5)),
+		InviteBudgetExclusive: int(getEnvInt64("INVITE_BUDGET_EXCLUSIVE", 10)),
+		InviteBudgetDays:      int(getEnvInt64("INVITE_BUDGET_DAYS", 30)),
+	}
+}
+
+// getEnv reads an environment variable, falling back to def when it is unset
+func getEnv(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// getEnvInt64 reads an integer environment variable, falling back to def when
+// it is unset or not a valid number
+func getEnvInt64(key string, def int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return def
 	}
+	return value
 }